@@ -0,0 +1,195 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/state"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	acksNamespace    = "acks"
+	ackCheckInterval = 30 * time.Second
+)
+
+type pendingAck struct {
+	Room          string       `json:"room"`
+	EventID       id.EventID   `json:"eventID"`
+	Title         string       `json:"title"`
+	Markdown      string       `json:"markdown"`
+	SentAt        time.Time    `json:"sentAt"`
+	RemindersSent int          `json:"remindersSent"`
+	Reminders     []id.EventID `json:"reminders,omitempty"`
+}
+
+// acks tracks high priority messages until someone acknowledges them, with a
+// reaction or a reply. Unacknowledged messages are re-posted, mentioning the
+// escalation list.
+type acks struct {
+	mutex    sync.Mutex
+	settings config.AcknowledgementType
+	store    *state.Store
+	now      func() time.Time
+	remind   func(room string, replyTo id.EventID, markdown string) id.EventID
+	edit     func(room string, eventID id.EventID, markdown string) error
+}
+
+func (a *acks) Required(priority int) bool {
+	return priority >= a.settings.MinPriority
+}
+
+func (a *acks) Track(events []sentEvent, title string, markdown string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, sent := range events {
+		pending := pendingAck{
+			Room:     sent.room,
+			EventID:  sent.eventID,
+			Title:    title,
+			Markdown: markdown,
+			SentAt:   a.now(),
+		}
+		if err := a.save(pending); err != nil {
+			log.Error().Err(err).Msgf("Could not track acknowledgement of %s", sent.eventID)
+		}
+	}
+}
+
+func (a *acks) save(pending pendingAck) error {
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return a.store.Set(acksNamespace, pending.Room+" "+pending.EventID.String(), string(data))
+}
+
+func (a *acks) pending() ([]pendingAck, error) {
+	entries, err := a.store.List(acksNamespace)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]pendingAck, 0, len(entries))
+	for key, value := range entries {
+		var pending pendingAck
+		if err := json.Unmarshal([]byte(value), &pending); err != nil {
+			log.Error().Err(err).Msgf("Dropping invalid acknowledgement %s", key)
+			a.store.Delete(acksNamespace, key)
+			continue
+		}
+		result = append(result, pending)
+	}
+	return result, nil
+}
+
+// HandleEvent acknowledges a message when someone reacts to it, or to one of
+// its reminders, with the configured reaction, or replies to it.
+func (a *acks) HandleEvent(_ context.Context, evt *event.Event) {
+	var target id.EventID
+	switch evt.Type {
+	case event.EventReaction:
+		relatesTo := evt.Content.AsReaction().RelatesTo
+		if normalizeReaction(relatesTo.Key) != normalizeReaction(a.settings.Reaction) {
+			return
+		}
+		target = relatesTo.EventID
+	case event.EventMessage:
+		relatesTo := evt.Content.AsMessage().RelatesTo
+		if target = relatesTo.GetNonFallbackReplyTo(); target == "" {
+			target = relatesTo.GetThreadParent()
+		}
+	}
+	if target == "" {
+		return
+	}
+	a.acknowledge(evt.RoomID.String(), target, evt.Sender, time.UnixMilli(evt.Timestamp))
+}
+
+func (a *acks) acknowledge(room string, target id.EventID, sender id.UserID, at time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	pendingAcks, err := a.pending()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read pending acknowledgements")
+		return
+	}
+	for _, pending := range pendingAcks {
+		if pending.Room != room || (pending.EventID != target && !slices.Contains(pending.Reminders, target)) {
+			continue
+		}
+		log.Info().Msgf("Message %s was acknowledged by %s", pending.EventID, sender)
+		if err := a.store.Delete(acksNamespace, pending.Room+" "+pending.EventID.String()); err != nil {
+			log.Error().Err(err).Msgf("Could not remove acknowledgement of %s", pending.EventID)
+		}
+		markdown := pending.Markdown + fmt.Sprintf("\n\n**✅ Acknowledged** by %s at %s", sender, at.Local().Format("15:04"))
+		if err := a.edit(pending.Room, pending.EventID, markdown); err != nil {
+			log.Error().Err(err).Msgf("Could not mark %s as acknowledged", pending.EventID)
+		}
+	}
+}
+
+// RemindDue re-posts messages which were not acknowledged in time, as a reply
+// to the original message. Messages are no longer tracked one timeout after
+// the last reminder.
+func (a *acks) RemindDue() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	pendingAcks, err := a.pending()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read pending acknowledgements")
+		return
+	}
+	now := a.now()
+	for _, pending := range pendingAcks {
+		elapsed := now.Sub(pending.SentAt)
+		if elapsed < time.Duration(pending.RemindersSent+1)*a.settings.Timeout {
+			continue
+		}
+		if pending.RemindersSent >= a.settings.Reminders {
+			log.Info().Msgf("Message %s was not acknowledged after the last reminder, no longer tracking it", pending.EventID)
+			if err := a.store.Delete(acksNamespace, pending.Room+" "+pending.EventID.String()); err != nil {
+				log.Error().Err(err).Msgf("Could not remove acknowledgement of %s", pending.EventID)
+			}
+			continue
+		}
+
+		log.Info().Msgf("Message %s was not acknowledged, sending reminder", pending.EventID)
+		markdown := fmt.Sprintf("**⚠️ Not acknowledged for %s:** %s", elapsed.Round(time.Minute), pending.Title)
+		if len(a.settings.Escalate) > 0 {
+			var mentions []string
+			for _, user := range a.settings.Escalate {
+				mentions = append(mentions, fmt.Sprintf("[%s](https://matrix.to/#/%s)", user, user))
+			}
+			markdown += "\n\n" + strings.Join(mentions, " ")
+		}
+		reminder := a.remind(pending.Room, pending.EventID, markdown)
+		if reminder != "" {
+			pending.Reminders = append(pending.Reminders, reminder)
+		}
+		pending.RemindersSent++
+		if err := a.save(pending); err != nil {
+			log.Error().Err(err).Msgf("Could not update acknowledgement of %s", pending.EventID)
+		}
+	}
+}
+
+func (a *acks) Run(ctx context.Context) {
+	every(ctx, ackCheckInterval, a.RemindDue)
+}
+
+// normalizeReaction removes emoji variation selectors, which clients add
+// inconsistently.
+func normalizeReaction(key string) string {
+	return strings.ReplaceAll(key, "\uFE0F", "")
+}
@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestAcks(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.Local)
+	var reminders []string
+	edits := make(map[id.EventID]string)
+	a := &acks{
+		settings: config.AcknowledgementType{
+			MinPriority: 8,
+			Timeout:     15 * time.Minute,
+			Reaction:    "✅",
+			Reminders:   2,
+			Escalate:    []string{"@bob:example.com"},
+		},
+		store: store,
+		now:   func() time.Time { return now },
+		remind: func(room string, replyTo id.EventID, markdown string) id.EventID {
+			reminders = append(reminders, markdown)
+			return id.EventID("$reminder" + string(rune('0'+len(reminders))))
+		},
+		edit: func(room string, eventID id.EventID, markdown string) error {
+			edits[eventID] = markdown
+			return nil
+		},
+	}
+	assert.Assert(t, a.Required(8))
+	assert.Assert(t, !a.Required(7))
+
+	reaction := func(target id.EventID, key string) *event.Event {
+		return &event.Event{
+			Type:      event.EventReaction,
+			RoomID:    "!room",
+			Sender:    "@alice:example.com",
+			Timestamp: now.UnixMilli(),
+			Content: event.Content{Parsed: &event.ReactionEventContent{
+				RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: target, Key: key},
+			}},
+		}
+	}
+	reply := func(target id.EventID) *event.Event {
+		return &event.Event{
+			Type:      event.EventMessage,
+			RoomID:    "!room",
+			Sender:    "@bob:example.com",
+			Timestamp: now.UnixMilli(),
+			Content: event.Content{Parsed: &event.MessageEventContent{
+				MsgType:   event.MsgText,
+				Body:      "on it",
+				RelatesTo: (&event.RelatesTo{}).SetReplyTo(target),
+			}},
+		}
+	}
+
+	a.Track([]sentEvent{{room: "!room", eventID: "$alert"}}, "Disk full", "# Disk full")
+	a.RemindDue()
+	assert.Equal(t, len(reminders), 0)
+
+	now = now.Add(15 * time.Minute)
+	a.RemindDue()
+	assert.DeepEqual(t, reminders, []string{
+		"**⚠️ Not acknowledged for 15m0s:** Disk full\n\n[@bob:example.com](https://matrix.to/#/@bob:example.com)",
+	})
+	// Reminders are only sent once per timeout, up to the configured number.
+	a.RemindDue()
+	assert.Equal(t, len(reminders), 1)
+	now = now.Add(15 * time.Minute)
+	a.RemindDue()
+	now = now.Add(10 * time.Minute)
+	a.RemindDue()
+	assert.Equal(t, len(reminders), 2)
+
+	// Reactions with another key do not acknowledge.
+	a.HandleEvent(t.Context(), reaction("$alert", "👍"))
+	assert.Equal(t, len(edits), 0)
+
+	// Replies to reminders acknowledge the original message.
+	a.HandleEvent(t.Context(), reply("$reminder1"))
+	assert.Equal(t, edits["$alert"], "# Disk full\n\n**✅ Acknowledged** by @bob:example.com at 10:40")
+
+	// Reactions may differ in the emoji variation selector.
+	a.Track([]sentEvent{{room: "!room", eventID: "$other"}}, "CPU hot", "# CPU hot")
+	a.HandleEvent(t.Context(), reaction("$other", "✅\uFE0F"))
+	assert.Equal(t, edits["$other"], "# CPU hot\n\n**✅ Acknowledged** by @alice:example.com at 10:40")
+
+	entries, err := store.List(acksNamespace)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+
+	// Messages expire one timeout after the last reminder.
+	a.Track([]sentEvent{{room: "!room", eventID: "$ignored"}}, "Fan failed", "# Fan failed")
+	for range 3 {
+		now = now.Add(15 * time.Minute)
+		a.RemindDue()
+	}
+	assert.Equal(t, len(reminders), 4)
+	entries, err = store.List(acksNamespace)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
@@ -0,0 +1,66 @@
+package bot
+
+import (
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/gotify_messages"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/state"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
+)
+
+const appRoomsNamespace = "appRooms"
+
+// appRooms maintains one Matrix room per gotify application. Rooms are
+// created on first use and remembered in the state store.
+type appRooms struct {
+	mutex        sync.Mutex
+	settings     config.RoomPerAppType
+	store        *state.Store
+	matrix       *matrix.MatrixState
+	applications *gotify_messages.ApplicationCache
+}
+
+func (r *appRooms) RoomFor(appId int64) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := strconv.FormatInt(appId, 10)
+	roomID, found, err := r.store.Get(appRoomsNamespace, key)
+	if err != nil || found {
+		return roomID, err
+	}
+
+	app, ok := r.applications.Get(appId)
+	if !ok {
+		app = gotify_messages.Application{Id: appId, Name: "Application " + key}
+	}
+
+	options := matrix.RoomOptions{
+		Name:      r.settings.NamePrefix + app.Name,
+		Topic:     app.Description,
+		Encrypted: !r.settings.DisableEncryption,
+	}
+	for _, user := range r.settings.Invite {
+		options.Invite = append(options.Invite, id.UserID(user))
+	}
+	if app.Image != "" {
+		avatar, err := matrix.UploadImageFromURL(r.matrix, gotify_messages.RestURL()+"/"+strings.TrimPrefix(app.Image, "/"))
+		if err != nil {
+			log.Warn().Err(err).Msgf("Could not upload avatar for application %s", app.Name)
+		} else {
+			options.Avatar = avatar
+		}
+	}
+
+	newRoomID, err := matrix.CreateRoom(r.matrix, options)
+	if err != nil {
+		return "", err
+	}
+	err = r.store.Set(appRoomsNamespace, key, newRoomID.String())
+	return newRoomID.String(), err
+}
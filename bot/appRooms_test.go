@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"context"
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/gotify_messages"
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+
+	"github.com/petergtz/pegomock/v4"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestAppRooms(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	mockClient, matrixState := setupMatrixMock(t)
+	pegomock.When(mockClient.CreateRoom(pegomock.Any[context.Context](), pegomock.Any[*mautrix.ReqCreateRoom]())).
+		ThenReturn(&mautrix.RespCreateRoom{RoomID: "!backup"}, nil).
+		ThenReturn(&mautrix.RespCreateRoom{RoomID: "!unknown"}, nil)
+	applications := gotify_messages.NewApplicationCacheFrom(func() ([]gotify_messages.Application, error) {
+		return []gotify_messages.Application{{Id: 1, Name: "Backup", Description: "Nightly backups"}}, nil
+	})
+	settings := config.RoomPerAppType{Enabled: true, NamePrefix: "Gotify: ", Invite: []string{"@you:example.com"}}
+	rooms := &appRooms{settings: settings, store: store, matrix: matrixState, applications: applications}
+
+	createdRooms := func() []*mautrix.ReqCreateRoom {
+		_, requests := mockClient.VerifyWasCalled(pegomock.AtLeast(0)).CreateRoom(
+			pegomock.Any[context.Context](), pegomock.Any[*mautrix.ReqCreateRoom]()).GetAllCapturedArguments()
+		return requests
+	}
+
+	room, err := rooms.RoomFor(1)
+	assert.NilError(t, err)
+	assert.Equal(t, room, "!backup")
+	requests := createdRooms()
+	assert.Equal(t, len(requests), 1)
+	assert.Equal(t, requests[0].Name, "Gotify: Backup")
+	assert.Equal(t, requests[0].Topic, "Nightly backups")
+	assert.DeepEqual(t, requests[0].Invite, []id.UserID{"@you:example.com"})
+	assert.Equal(t, requests[0].InitialState[0].Type, event.StateEncryption)
+
+	t.Run("Room is reused", func(t *testing.T) {
+		room, err := rooms.RoomFor(1)
+		assert.NilError(t, err)
+		assert.Equal(t, room, "!backup")
+		assert.Equal(t, len(createdRooms()), 1)
+	})
+
+	t.Run("Room is remembered across restarts", func(t *testing.T) {
+		restarted := &appRooms{settings: settings, store: store, matrix: matrixState, applications: applications}
+		room, err := restarted.RoomFor(1)
+		assert.NilError(t, err)
+		assert.Equal(t, room, "!backup")
+		assert.Equal(t, len(createdRooms()), 1)
+	})
+
+	t.Run("Unknown application gets a room named by its id", func(t *testing.T) {
+		room, err := rooms.RoomFor(7)
+		assert.NilError(t, err)
+		assert.Equal(t, room, "!unknown")
+		requests := createdRooms()
+		assert.Equal(t, len(requests), 2)
+		assert.Equal(t, requests[1].Name, "Gotify: Application 7")
+
+		stored, found, err := store.Get(appRoomsNamespace, "7")
+		assert.NilError(t, err)
+		assert.Assert(t, found)
+		assert.Equal(t, stored, "!unknown")
+	})
+}
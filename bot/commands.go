@@ -0,0 +1,246 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"gotify_matrix_bot/gotify_messages"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	commandPrefix    = "!gotify"
+	defaultLastCount = 5
+)
+
+const commandHelp = `**Commands**
+
+* ` + "`!gotify status`" + `: Connection state, uptime, accepted and queued messages
+* ` + "`!gotify apps`" + `: Known gotify applications
+* ` + "`!gotify mute <app> [duration]`" + `: Stop forwarding messages of an application, for example ` + "`!gotify mute Backup 2h`" + `
+* ` + "`!gotify unmute <app>`" + `: Forward messages of an application again
+* ` + "`!gotify last [n]`" + `: The last forwarded messages
+* ` + "`!gotify send <app> [priority] <text>`" + `: Send a message to gotify
+* ` + "`!gotify help`" + `: This help`
+
+// commands answers !gotify commands from authorized users with notices.
+type commands struct {
+	allowedUsers []string
+	applications *gotify_messages.ApplicationCache
+	mutes        *mutes
+	history      *history
+	sender       *gotifySender
+	pipeline     *pipeline
+	startedAt    time.Time
+	matrixSince  time.Time
+	gotifySince  func() time.Time
+	now          func() time.Time
+	reply        func(room string, markdown string)
+}
+
+func (c *commands) HandleEvent(_ context.Context, evt *event.Event) {
+	if evt.Type != event.EventMessage {
+		return
+	}
+	content := evt.Content.AsMessage()
+	if content.MsgType != event.MsgText || content.RelatesTo.GetReplaceID() != "" {
+		return
+	}
+	args := strings.Fields(content.Body)
+	if len(args) == 0 || args[0] != commandPrefix {
+		return
+	}
+	if !slices.Contains(c.allowedUsers, evt.Sender.String()) {
+		log.Warn().Msgf("Ignoring command from unauthorized user %s", evt.Sender)
+		return
+	}
+
+	log.Info().Msgf("Received command %q from %s", content.Body, evt.Sender)
+	c.reply(evt.RoomID.String(), c.execute(evt.Sender, content.Body))
+}
+
+func (c *commands) execute(sender id.UserID, body string) string {
+	_, text := cutField(body)
+	command, text := cutField(text)
+	args := strings.Fields(text)
+	switch command {
+	case "":
+		return commandHelp
+	case "status":
+		return c.status()
+	case "apps":
+		return c.apps()
+	case "mute":
+		return c.mute(args)
+	case "unmute":
+		return c.unmute(args)
+	case "last":
+		return c.last(args)
+	case "send":
+		if c.sender == nil {
+			return "Sending messages to gotify is not configured."
+		}
+		return c.sender.Command(sender, text)
+	case "help":
+		return commandHelp
+	default:
+		return "Unknown command `" + command + "`.\n\n" + commandHelp
+	}
+}
+
+func (c *commands) status() string {
+	now := c.now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "**Status**\n\n")
+	fmt.Fprintf(&b, "* Uptime: %s\n", now.Sub(c.startedAt).Round(time.Second))
+	if gotifySince := c.gotifySince(); gotifySince.IsZero() {
+		fmt.Fprintf(&b, "* Gotify: not connected\n")
+	} else {
+		fmt.Fprintf(&b, "* Gotify: connected for %s\n", now.Sub(gotifySince).Round(time.Second))
+	}
+	fmt.Fprintf(&b, "* Matrix: connected for %s\n", now.Sub(c.matrixSince).Round(time.Second))
+	fmt.Fprintf(&b, "* Messages accepted: %d\n", c.history.Count())
+	if c.pipeline != nil {
+		fmt.Fprintf(&b, "* Queued: %s\n", c.pipeline.Queued())
+	}
+
+	muted, err := c.mutes.List()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read muted applications")
+	}
+	if len(muted) > 0 {
+		fmt.Fprintf(&b, "* Muted: %s\n", strings.Join(c.mutedNames(muted), ", "))
+	}
+	return b.String()
+}
+
+func (c *commands) mutedNames(muted map[int64]time.Time) []string {
+	var names []string
+	for appId, until := range muted {
+		name := c.appName(appId)
+		if !until.IsZero() {
+			name += " until " + until.Local().Format("2006-01-02 15:04")
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *commands) apps() string {
+	applications, err := c.applications.All()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load applications")
+		return "Could not load applications from gotify."
+	}
+	if len(applications) == 0 {
+		return "There are no applications."
+	}
+	muted, _ := c.mutes.List()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "**Applications**\n\n")
+	for _, app := range applications {
+		fmt.Fprintf(&b, "* %d: %s", app.Id, app.Name)
+		if _, ok := muted[app.Id]; ok {
+			fmt.Fprintf(&b, " (muted)")
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	return b.String()
+}
+
+func (c *commands) mute(args []string) string {
+	if len(args) == 0 {
+		return "Usage: `!gotify mute <app> [duration]`"
+	}
+	var until time.Time
+	if duration, err := time.ParseDuration(args[len(args)-1]); err == nil && len(args) > 1 {
+		if duration <= 0 {
+			return "The duration must be positive."
+		}
+		until = c.now().Add(duration)
+		args = args[:len(args)-1]
+	}
+	app, found := c.findApp(strings.Join(args, " "))
+	if !found {
+		return "Unknown application `" + strings.Join(args, " ") + "`."
+	}
+	if err := c.mutes.Mute(app.Id, until); err != nil {
+		log.Error().Err(err).Msgf("Could not mute application %d", app.Id)
+		return "Could not mute " + app.Name + "."
+	}
+	if until.IsZero() {
+		return "Muted " + app.Name + "."
+	}
+	return "Muted " + app.Name + " until " + until.Local().Format("2006-01-02 15:04") + "."
+}
+
+func (c *commands) unmute(args []string) string {
+	if len(args) == 0 {
+		return "Usage: `!gotify unmute <app>`"
+	}
+	app, found := c.findApp(strings.Join(args, " "))
+	if !found {
+		return "Unknown application `" + strings.Join(args, " ") + "`."
+	}
+	if err := c.mutes.Unmute(app.Id); err != nil {
+		log.Error().Err(err).Msgf("Could not unmute application %d", app.Id)
+		return "Could not unmute " + app.Name + "."
+	}
+	return "Unmuted " + app.Name + "."
+}
+
+func (c *commands) last(args []string) string {
+	count := defaultLastCount
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return "Usage: `!gotify last [n]`"
+		}
+		count = min(n, historySize)
+	}
+	entries := c.history.Last(count)
+	if len(entries) == 0 {
+		return "No messages were forwarded yet."
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "**Last %d messages**\n\n", len(entries))
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "* %s %s: %s\n", entry.time.Local().Format("15:04"), c.appName(entry.appId), entry.title)
+	}
+	return b.String()
+}
+
+// findApp looks up an application by id or by name, ignoring case.
+func (c *commands) findApp(nameOrId string) (gotify_messages.Application, bool) {
+	if appId, err := strconv.ParseInt(nameOrId, 10, 64); err == nil {
+		return c.applications.Get(appId)
+	}
+	applications, err := c.applications.All()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load applications")
+		return gotify_messages.Application{}, false
+	}
+	for _, app := range applications {
+		if strings.EqualFold(app.Name, nameOrId) {
+			return app, true
+		}
+	}
+	return gotify_messages.Application{}, false
+}
+
+func (c *commands) appName(appId int64) string {
+	if name := c.applications.Name(appId); name != "" {
+		return name
+	}
+	return fmt.Sprintf("Application %d", appId)
+}
@@ -0,0 +1,117 @@
+package bot
+
+import (
+	"gotify_matrix_bot/gotify_messages"
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestCommands(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.Local)
+	clock := func() time.Time { return now }
+	var replies []string
+	c := &commands{
+		allowedUsers: []string{"@admin:example.com"},
+		applications: gotify_messages.NewApplicationCacheFrom(func() ([]gotify_messages.Application, error) {
+			return []gotify_messages.Application{{Id: 1, Name: "Backup"}, {Id: 2, Name: "Home Assistant"}}, nil
+		}),
+		mutes:       &mutes{store: store, now: clock},
+		history:     &history{},
+		startedAt:   now.Add(-time.Hour),
+		matrixSince: now.Add(-time.Hour),
+		gotifySince: func() time.Time { return now.Add(-30 * time.Minute) },
+		now:         clock,
+		reply: func(room string, markdown string) {
+			assert.Equal(t, room, "!room")
+			replies = append(replies, markdown)
+		},
+	}
+	send := func(body string) string {
+		replies = nil
+		c.HandleEvent(t.Context(), &event.Event{
+			Type:    event.EventMessage,
+			RoomID:  "!room",
+			Sender:  "@admin:example.com",
+			Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+		})
+		assert.Equal(t, len(replies), 1)
+		return replies[0]
+	}
+
+	t.Run("Other messages are ignored", func(t *testing.T) {
+		replies = nil
+		c.HandleEvent(t.Context(), &event.Event{
+			Type:    event.EventMessage,
+			RoomID:  "!room",
+			Sender:  "@admin:example.com",
+			Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "hello !gotify"}},
+		})
+		assert.Equal(t, len(replies), 0)
+	})
+
+	t.Run("Unauthorized users are ignored", func(t *testing.T) {
+		replies = nil
+		c.HandleEvent(t.Context(), &event.Event{
+			Type:    event.EventMessage,
+			RoomID:  "!room",
+			Sender:  "@mallory:example.com",
+			Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "!gotify status"}},
+		})
+		assert.Equal(t, len(replies), 0)
+	})
+
+	t.Run("Help", func(t *testing.T) {
+		assert.Equal(t, send("!gotify"), commandHelp)
+		assert.Equal(t, send("!gotify help"), commandHelp)
+		assert.Equal(t, send("!gotify foo"), "Unknown command `foo`.\n\n"+commandHelp)
+	})
+
+	t.Run("Mute and unmute", func(t *testing.T) {
+		assert.Equal(t, send("!gotify mute home assistant 2h"), "Muted Home Assistant until 2025-03-01 12:00.")
+		assert.Equal(t, send("!gotify mute 1"), "Muted Backup.")
+		assert.Equal(t, send("!gotify mute Unknown"), "Unknown application `Unknown`.")
+
+		muted, err := c.mutes.Muted(2)
+		assert.NilError(t, err)
+		assert.Assert(t, muted)
+		assert.Equal(t, send("!gotify apps"), "**Applications**\n\n* 1: Backup (muted)\n* 2: Home Assistant (muted)\n")
+
+		assert.Equal(t, send("!gotify unmute Backup"), "Unmuted Backup.")
+		muted, err = c.mutes.Muted(1)
+		assert.NilError(t, err)
+		assert.Assert(t, !muted)
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		c.history.Add(historyEntry{time: now, appId: 1, title: "Done"})
+		assert.Equal(t, send("!gotify status"), "**Status**\n\n"+
+			"* Uptime: 1h0m0s\n"+
+			"* Gotify: connected for 30m0s\n"+
+			"* Matrix: connected for 1h0m0s\n"+
+			"* Messages accepted: 1\n"+
+			"* Muted: Home Assistant until 2025-03-01 12:00\n")
+	})
+
+	t.Run("Last messages", func(t *testing.T) {
+		c.history.Add(historyEntry{time: now.Add(time.Minute), appId: 2, title: "Door open"})
+		assert.Equal(t, send("!gotify last 1"), "**Last 1 messages**\n\n* 10:01 Home Assistant: Door open\n")
+		assert.Equal(t, send("!gotify last"), "**Last 2 messages**\n\n* 10:01 Home Assistant: Door open\n* 10:00 Backup: Done\n")
+		assert.Equal(t, send("!gotify last x"), "Usage: `!gotify last [n]`")
+	})
+
+	t.Run("Expired mutes", func(t *testing.T) {
+		now = now.Add(3 * time.Hour)
+		muted, err := c.mutes.Muted(2)
+		assert.NilError(t, err)
+		assert.Assert(t, !muted)
+	})
+}
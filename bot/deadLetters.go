@@ -0,0 +1,170 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/state"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	deadLetterWarningInterval = time.Hour
+	deadLetterPreviewLength   = 40
+)
+
+const deadLettersUsage = `usage: gotify_matrix_bot deadletters <command>
+
+Commands:
+  list                         List messages which could not be delivered
+  show <id>                    Show a message with its content
+  replay [-room <room>] <id>   Send a message again, optionally to another room
+  purge -all | <id>...         Delete messages`
+
+// DeadLettersCommand runs the deadletters subcommand on the state store in
+// the working directory. Replayed messages are sent by the running bot, or
+// on its next start.
+func DeadLettersCommand(args []string, out io.Writer) error {
+	store, err := state.Open(stateFile)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return deadLettersCommand(matrix.NewOutbox(store), args, out)
+}
+
+func deadLettersCommand(outbox *matrix.Outbox, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(deadLettersUsage)
+	}
+	switch args[0] {
+	case "list":
+		return listDeadLetters(outbox, out)
+	case "show":
+		if len(args) != 2 {
+			return errors.New(deadLettersUsage)
+		}
+		return showDeadLetter(outbox, args[1], out)
+	case "replay":
+		flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		room := flags.String("room", "", "room ID to send the message to instead")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() == 0 {
+			return errors.New(deadLettersUsage)
+		}
+		for _, letterID := range flags.Args() {
+			if err := outbox.Replay(letterID, id.RoomID(*room)); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Queued %s for delivery\n", letterID)
+		}
+		return nil
+	case "purge":
+		flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		all := flags.Bool("all", false, "delete all messages")
+		if err := flags.Parse(args[1:]); err != nil || (*all == (flags.NArg() > 0)) {
+			return errors.New(deadLettersUsage)
+		}
+		letterIDs := flags.Args()
+		if *all {
+			letters, err := outbox.DeadLetters()
+			if err != nil {
+				return err
+			}
+			for _, letter := range letters {
+				letterIDs = append(letterIDs, letter.ID)
+			}
+		}
+		for _, letterID := range letterIDs {
+			if err := outbox.Purge(letterID); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "Deleted %d messages\n", len(letterIDs))
+		return nil
+	default:
+		return fmt.Errorf("unknown command %s\n\n%s", args[0], deadLettersUsage)
+	}
+}
+
+func listDeadLetters(outbox *matrix.Outbox, out io.Writer) error {
+	letters, err := outbox.DeadLetters()
+	if err != nil {
+		return err
+	}
+	if len(letters) == 0 {
+		fmt.Fprintln(out, "No undeliverable messages")
+		return nil
+	}
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tFAILED\tROOM\tERROR\tMESSAGE")
+	for _, letter := range letters {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n",
+			letter.ID,
+			letter.FailedAt.Local().Format(time.DateTime),
+			letter.RoomID,
+			letter.Error,
+			preview(letter.Body()))
+	}
+	return table.Flush()
+}
+
+func showDeadLetter(outbox *matrix.Outbox, letterID string, out io.Writer) error {
+	letter, found, err := outbox.DeadLetter(letterID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no dead letter %s", letterID)
+	}
+	content, err := json.MarshalIndent(letter.Content, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "ID:       %s\n", letter.ID)
+	fmt.Fprintf(out, "Room:     %s\n", letter.RoomID)
+	fmt.Fprintf(out, "Type:     %s\n", letter.EventType)
+	fmt.Fprintf(out, "Queued:   %s\n", letter.EnqueuedAt.Local().Format(time.DateTime))
+	fmt.Fprintf(out, "Failed:   %s\n", letter.FailedAt.Local().Format(time.DateTime))
+	fmt.Fprintf(out, "Attempts: %d\n", letter.Attempts)
+	fmt.Fprintf(out, "Error:    %s\n", letter.Error)
+	fmt.Fprintf(out, "Content:\n%s\n", content)
+	return nil
+}
+
+// preview shortens a message body to one line for the list.
+func preview(body string) string {
+	body = strings.Join(strings.Fields(body), " ")
+	runes := []rune(body)
+	if len(runes) > deadLetterPreviewLength {
+		return string(runes[:deadLetterPreviewLength-1]) + "…"
+	}
+	return body
+}
+
+// warnAboutDeadLetters periodically logs a warning while there are messages
+// which could not be delivered.
+func warnAboutDeadLetters(ctx context.Context, outbox *matrix.Outbox) {
+	check := func() {
+		letters, err := outbox.DeadLetters()
+		if err != nil {
+			log.Error().Err(err).Msg("Could not read dead letters")
+			return
+		}
+		if len(letters) > 0 {
+			log.Warn().Msgf("%d messages could not be delivered to Matrix; see `gotify_matrix_bot deadletters list`", len(letters))
+		}
+	}
+	check()
+	every(ctx, deadLetterWarningInterval, check)
+}
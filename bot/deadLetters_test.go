@@ -0,0 +1,73 @@
+package bot
+
+import (
+	"bytes"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDeadLettersCommand(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+	outbox := matrix.NewOutbox(store)
+
+	bury := func(letterID string, body string) {
+		assert.NilError(t, store.Set("deadLetters", letterID, `{"roomID":"!gone","eventType":"m.room.message",`+
+			`"content":{"msgtype":"m.text","body":"`+body+`"},"transactionID":"`+letterID+`",`+
+			`"attempts":1,"lastError":"M_FORBIDDEN (HTTP 403): not in room","failedAt":"2025-03-01T10:00:00Z"}`))
+	}
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := deadLettersCommand(outbox, args, &out)
+		return out.String(), err
+	}
+
+	output, err := run("list")
+	assert.NilError(t, err)
+	assert.Equal(t, output, "No undeliverable messages\n")
+
+	bury("gmb-1", "Backup failed")
+	bury("gmb-2", strings.Repeat("long ", 20))
+	output, err = run("list")
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	assert.Equal(t, len(lines), 3)
+	assert.Assert(t, strings.HasPrefix(lines[0], "ID"))
+	assert.Assert(t, strings.Contains(output, "Backup failed"))
+	assert.Assert(t, strings.Contains(output, "M_FORBIDDEN (HTTP 403): not in room"))
+	assert.Assert(t, strings.Contains(output, "long long…"))
+
+	output, err = run("show", "gmb-1")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(output, "Room:     !gone\n"))
+	assert.Assert(t, strings.Contains(output, `"body": "Backup failed"`))
+	_, err = run("show", "gmb-9")
+	assert.ErrorContains(t, err, "no dead letter gmb-9")
+
+	output, err = run("replay", "-room", "!new", "gmb-1")
+	assert.NilError(t, err)
+	assert.Equal(t, output, "Queued gmb-1 for delivery\n")
+	pending, err := outbox.Pending()
+	assert.NilError(t, err)
+	assert.Equal(t, pending, 1)
+
+	_, err = run("purge")
+	assert.ErrorContains(t, err, "usage")
+	_, err = run("purge", "-all", "gmb-2")
+	assert.ErrorContains(t, err, "usage")
+	output, err = run("purge", "-all")
+	assert.NilError(t, err)
+	assert.Equal(t, output, "Deleted 1 messages\n")
+	letters, err := outbox.DeadLetters()
+	assert.NilError(t, err)
+	assert.Equal(t, len(letters), 0)
+
+	_, err = run("unknown")
+	assert.ErrorContains(t, err, "unknown command unknown")
+}
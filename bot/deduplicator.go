@@ -0,0 +1,98 @@
+package bot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gotify_matrix_bot/template"
+	"strconv"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// sentEvent is a message which was sent to a room.
+type sentEvent struct {
+	room    string
+	eventID id.EventID
+	// How long the event is kept before it is redacted; 0 keeps it forever.
+	retention time.Duration
+}
+
+type duplicate struct {
+	markdown string
+	events   []sentEvent
+	count    int
+	lastSeen time.Time
+}
+
+// deduplicator remembers recently forwarded messages, so that identical
+// messages within the window can update the original instead of being sent
+// again. The window restarts with every repetition.
+type deduplicator struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	entries map[string]*duplicate
+	now     func() time.Time
+}
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{
+		window:  window,
+		entries: make(map[string]*duplicate),
+		now:     time.Now,
+	}
+}
+
+func deduplicationKey(message *template.Message) string {
+	hash := sha256.New()
+	hash.Write([]byte(strconv.FormatInt(message.AppId, 10)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(message.Title))
+	hash.Write([]byte{0})
+	hash.Write([]byte(message.Message))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Repeat records another occurrence of a message. If the message was seen
+// within the window, the updated entry is returned.
+func (d *deduplicator) Repeat(key string) (*duplicate, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	d.expire(now)
+	entry, ok := d.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry.count++
+	entry.lastSeen = now
+	return entry, true
+}
+
+// Remember stores the first occurrence of a message.
+func (d *deduplicator) Remember(key string, markdown string, events []sentEvent) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.entries[key] = &duplicate{
+		markdown: markdown,
+		events:   events,
+		count:    1,
+		lastSeen: d.now(),
+	}
+}
+
+func (d *deduplicator) expire(now time.Time) {
+	for key, entry := range d.entries {
+		if now.Sub(entry.lastSeen) > d.window {
+			delete(d.entries, key)
+		}
+	}
+}
+
+func (entry *duplicate) Markdown() string {
+	return fmt.Sprintf("%s\n\n*(repeated ×%d, last at %s)*", entry.markdown, entry.count, entry.lastSeen.Format("15:04"))
+}
@@ -0,0 +1,41 @@
+package bot
+
+import (
+	"gotify_matrix_bot/template"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 15, 0, 0, time.Local)
+	d := newDeduplicator(time.Minute)
+	d.now = func() time.Time { return now }
+
+	key := deduplicationKey(&template.Message{AppId: 1, Title: "Down", Message: "Host is down"})
+	otherKey := deduplicationKey(&template.Message{AppId: 2, Title: "Down", Message: "Host is down"})
+	assert.Assert(t, key != otherKey)
+
+	_, found := d.Repeat(key)
+	assert.Assert(t, !found)
+	d.Remember(key, "# Down", []sentEvent{{room: "!room", eventID: "$event"}})
+
+	now = now.Add(30 * time.Second)
+	entry, found := d.Repeat(key)
+	assert.Assert(t, found)
+	assert.Equal(t, entry.count, 2)
+	assert.Equal(t, len(entry.events), 1)
+	assert.Equal(t, entry.events[0], sentEvent{room: "!room", eventID: "$event"})
+	assert.Equal(t, entry.Markdown(), "# Down\n\n*(repeated ×2, last at 10:15)*")
+
+	// The window restarts with every repetition.
+	now = now.Add(50 * time.Second)
+	entry, found = d.Repeat(key)
+	assert.Assert(t, found)
+	assert.Equal(t, entry.Markdown(), "# Down\n\n*(repeated ×3, last at 10:16)*")
+
+	now = now.Add(2 * time.Minute)
+	_, found = d.Repeat(key)
+	assert.Assert(t, !found)
+}
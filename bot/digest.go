@@ -0,0 +1,155 @@
+package bot
+
+import (
+	"fmt"
+	"gotify_matrix_bot/matrix"
+	"html"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestMessage is a message held back during a burst.
+type digestMessage struct {
+	appName string
+	title   string
+	// The formatted message, with its images uploaded to Matrix. The title
+	// heading is left out, as the summary shows the title.
+	markdown string
+	priority int
+}
+
+type burst struct {
+	recent []time.Time
+	held   []digestMessage
+	active bool
+}
+
+// digester detects bursts of messages per target. Once more than threshold
+// messages arrive within the window, further messages are held and posted as
+// one summary per window, until a window passes without new messages.
+type digester struct {
+	mutex     sync.Mutex
+	threshold int
+	window    time.Duration
+	bursts    map[string]*burst
+	now       func() time.Time
+	afterFunc func(time.Duration, func())
+	flush     func(target string, messages []digestMessage)
+}
+
+func newDigester(threshold int, window time.Duration, flush func(target string, messages []digestMessage)) *digester {
+	return &digester{
+		threshold: threshold,
+		window:    window,
+		bursts:    make(map[string]*burst),
+		now:       time.Now,
+		afterFunc: func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+		flush:     flush,
+	}
+}
+
+// Offer registers a message for a target. Returns true if the message is
+// held for the digest, false if it should be sent immediately.
+func (d *digester) Offer(target string, message digestMessage) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	b, ok := d.bursts[target]
+	if !ok {
+		b = &burst{}
+		d.bursts[target] = b
+	}
+
+	now := d.now()
+	b.recent = slices.DeleteFunc(b.recent, func(t time.Time) bool {
+		return now.Sub(t) > d.window
+	})
+	b.recent = append(b.recent, now)
+
+	if !b.active && len(b.recent) <= d.threshold {
+		return false
+	}
+
+	b.held = append(b.held, message)
+	if !b.active {
+		b.active = true
+		d.afterFunc(d.window, func() { d.tick(target) })
+	}
+	return true
+}
+
+// tick posts the held messages of a target. The burst ends once a window
+// passes without any held messages.
+func (d *digester) tick(target string) {
+	d.mutex.Lock()
+	b := d.bursts[target]
+	held := b.held
+	b.held = nil
+	if len(held) == 0 {
+		b.active = false
+		b.recent = nil
+	} else {
+		d.afterFunc(d.window, func() { d.tick(target) })
+	}
+	d.mutex.Unlock()
+
+	if len(held) > 0 {
+		d.flush(target, held)
+	}
+}
+
+// FlushAll posts the held messages of all targets right away, so that they
+// are not lost at shutdown.
+func (d *digester) FlushAll() {
+	d.mutex.Lock()
+	held := make(map[string][]digestMessage)
+	for target, b := range d.bursts {
+		if len(b.held) > 0 {
+			held[target] = b.held
+			b.held = nil
+		}
+	}
+	d.mutex.Unlock()
+
+	for target, messages := range held {
+		d.flush(target, messages)
+	}
+}
+
+// withoutHeading removes the title heading which template.FormatMessage
+// puts in front of the message.
+func withoutHeading(markdown string, title string) string {
+	body, found := strings.CutPrefix(markdown, "# "+title+"\n")
+	if !found {
+		return markdown
+	}
+	return strings.TrimLeft(body, "\n")
+}
+
+// digestHTML renders a summary of the held messages, with counts per
+// application, and the full messages in collapsible sections.
+func digestHTML(heading string, messages []digestMessage) string {
+	var counts []string
+	countPerApp := make(map[string]int)
+	for _, message := range messages {
+		if countPerApp[message.appName] == 0 {
+			counts = append(counts, message.appName)
+		}
+		countPerApp[message.appName]++
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<h3>%s</h3>", html.EscapeString(heading))
+	b.WriteString("<ul>")
+	for _, appName := range counts {
+		fmt.Fprintf(&b, "<li>%s: %d</li>", html.EscapeString(appName), countPerApp[appName])
+	}
+	b.WriteString("</ul>")
+	for _, message := range messages {
+		fmt.Fprintf(&b, "<details><summary>%s</summary>%s</details>",
+			html.EscapeString(message.title), matrix.MarkdownToHTML(message.markdown))
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDigester(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	var timers []func()
+	var flushed [][]digestMessage
+
+	d := newDigester(2, time.Minute, func(target string, messages []digestMessage) {
+		assert.Equal(t, target, "!room")
+		flushed = append(flushed, messages)
+	})
+	d.now = func() time.Time { return now }
+	d.afterFunc = func(_ time.Duration, f func()) { timers = append(timers, f) }
+
+	fireTimer := func() {
+		assert.Assert(t, len(timers) > 0)
+		f := timers[0]
+		timers = timers[1:]
+		f()
+	}
+
+	// Below the threshold, messages are sent immediately.
+	assert.Assert(t, !d.Offer("!room", digestMessage{title: "1"}))
+	assert.Assert(t, !d.Offer("!room", digestMessage{title: "2"}))
+	// Other targets are counted separately.
+	assert.Assert(t, !d.Offer("!other", digestMessage{title: "x"}))
+
+	// The third message within the window starts the burst.
+	assert.Assert(t, d.Offer("!room", digestMessage{title: "3"}))
+	now = now.Add(10 * time.Second)
+	assert.Assert(t, d.Offer("!room", digestMessage{title: "4"}))
+	assert.Equal(t, len(timers), 1)
+
+	fireTimer()
+	assert.Equal(t, len(flushed), 1)
+	assert.Equal(t, len(flushed[0]), 2)
+	assert.Equal(t, flushed[0][0].title, "3")
+
+	// Still in burst mode during the next window.
+	now = now.Add(time.Minute)
+	assert.Assert(t, d.Offer("!room", digestMessage{title: "5"}))
+	fireTimer()
+	assert.Equal(t, len(flushed), 2)
+
+	// A window without messages ends the burst.
+	fireTimer()
+	assert.Equal(t, len(flushed), 2)
+	assert.Equal(t, len(timers), 0)
+	now = now.Add(2 * time.Minute)
+	assert.Assert(t, !d.Offer("!room", digestMessage{title: "6"}))
+
+	// At shutdown, held messages are posted without waiting for the window.
+	assert.Assert(t, !d.Offer("!room", digestMessage{title: "7"}))
+	assert.Assert(t, d.Offer("!room", digestMessage{title: "8"}))
+	d.FlushAll()
+	assert.Equal(t, len(flushed), 3)
+	assert.Equal(t, flushed[2][0].title, "8")
+	d.FlushAll()
+	assert.Equal(t, len(flushed), 3)
+}
+
+func TestDigestHTML(t *testing.T) {
+	result := digestHTML("Digest: 3 messages in the last 2m0s", []digestMessage{
+		{appName: "CI", title: "Build <1>", markdown: "failed"},
+		{appName: "Backup", title: "Backup", markdown: "**done** ![](mxc://example.com/image)"},
+		{appName: "CI", title: "Build 2", markdown: "ok"},
+	})
+
+	assert.Equal(t, result, "<h3>Digest: 3 messages in the last 2m0s</h3>"+
+		"<ul><li>CI: 2</li><li>Backup: 1</li></ul>"+
+		"<details><summary>Build &lt;1&gt;</summary>failed</details>"+
+		"<details><summary>Backup</summary><strong>done</strong> <img src=\"mxc://example.com/image\" alt=\"\"></details>"+
+		"<details><summary>Build 2</summary>ok</details>")
+}
+
+func TestWithoutHeading(t *testing.T) {
+	assert.Equal(t, withoutHeading("# Backup\n\n**done**\n", "Backup"), "**done**\n")
+	assert.Equal(t, withoutHeading("# Backup done\n\ntext", "Backup"), "# Backup done\n\ntext")
+	assert.Equal(t, withoutHeading("plain", "Backup"), "plain")
+}
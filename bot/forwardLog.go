@@ -0,0 +1,210 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"gotify_matrix_bot/state"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	forwardLogNamespace     = "forwardLog"
+	eventMessagesNamespace  = "eventMessages"
+	forwardLogPruneInterval = time.Hour
+	// Messages older than this cannot be deleted in gotify with a reaction.
+	gotifyDeleteMaxAge = 30 * 24 * time.Hour
+)
+
+type forwardedMessage struct {
+	Events []storedEvent `json:"events"`
+	SentAt time.Time     `json:"sentAt"`
+}
+
+// forwardLog maps gotify message ids to the Matrix events they were sent as,
+// and back.
+type forwardLog struct {
+	store *state.Store
+	now   func() time.Time
+	// Messages are pruned this long after they were forwarded.
+	maxAge time.Duration
+}
+
+// Record adds the events of a gotify message to the log. Events of queued
+// messages are added once they are sent.
+func (l *forwardLog) Record(messageId int64, events []sentEvent) error {
+	key := strconv.FormatInt(messageId, 10)
+	now := l.now()
+	forwarded := forwardedMessage{SentAt: now}
+	value, found, err := l.store.Get(forwardLogNamespace, key)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := json.Unmarshal([]byte(value), &forwarded); err != nil {
+			forwarded = forwardedMessage{SentAt: now}
+		}
+	}
+	for _, event := range events {
+		stored := storedEvent{Room: event.room, EventID: event.eventID}
+		if event.retention > 0 {
+			stored.ExpiresAt = now.Add(event.retention)
+		}
+		forwarded.Events = append(forwarded.Events, stored)
+		err := l.store.Set(eventMessagesNamespace, eventKey(event.room, event.eventID), strconv.FormatInt(messageId, 10))
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(forwarded)
+	if err != nil {
+		return err
+	}
+	return l.store.Set(forwardLogNamespace, key, string(data))
+}
+
+// MessageFor returns the id of the gotify message an event was sent for.
+func (l *forwardLog) MessageFor(room string, eventID id.EventID) (int64, bool, error) {
+	value, found, err := l.store.Get(eventMessagesNamespace, eventKey(room, eventID))
+	if err != nil || !found {
+		return 0, false, err
+	}
+	messageId, err := strconv.ParseInt(value, 10, 64)
+	return messageId, err == nil, err
+}
+
+// Since returns the gotify messages forwarded at or after the given time.
+func (l *forwardLog) Since(since time.Time) (map[int64]forwardedMessage, error) {
+	entries, err := l.store.List(forwardLogNamespace)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int64]forwardedMessage)
+	for key, value := range entries {
+		messageId, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		var forwarded forwardedMessage
+		if err := json.Unmarshal([]byte(value), &forwarded); err != nil || forwarded.SentAt.Before(since) {
+			continue
+		}
+		result[messageId] = forwarded
+	}
+	return result, nil
+}
+
+// Forget removes a gotify message and its events from the log.
+func (l *forwardLog) Forget(messageId int64) error {
+	key := strconv.FormatInt(messageId, 10)
+	value, found, err := l.store.Get(forwardLogNamespace, key)
+	if err != nil || !found {
+		return err
+	}
+	var forwarded forwardedMessage
+	if err := json.Unmarshal([]byte(value), &forwarded); err == nil {
+		for _, event := range forwarded.Events {
+			if err := l.store.Delete(eventMessagesNamespace, eventKey(event.Room, event.EventID)); err != nil {
+				return err
+			}
+		}
+	}
+	return l.store.Delete(forwardLogNamespace, key)
+}
+
+// Prune removes the messages forwarded more than maxAge ago. Messages with
+// events which have a retention are kept, until the retention removes them.
+func (l *forwardLog) Prune() error {
+	entries, err := l.store.List(forwardLogNamespace)
+	if err != nil {
+		return err
+	}
+	before := l.now().Add(-l.maxAge)
+	for key, value := range entries {
+		messageId, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		var forwarded forwardedMessage
+		if err := json.Unmarshal([]byte(value), &forwarded); err != nil || !forwarded.SentAt.Before(before) {
+			continue
+		}
+		if slices.ContainsFunc(forwarded.Events, func(event storedEvent) bool { return !event.ExpiresAt.IsZero() }) {
+			continue
+		}
+		if err := l.Forget(messageId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *forwardLog) Run(ctx context.Context) {
+	every(ctx, forwardLogPruneInterval, func() {
+		if err := l.Prune(); err != nil {
+			log.Error().Err(err).Msg("Could not prune the forward log")
+		}
+	})
+}
+
+// Expired returns the events whose retention ended before the given time,
+// by gotify message id.
+func (l *forwardLog) Expired(now time.Time) (map[int64][]storedEvent, error) {
+	entries, err := l.store.List(forwardLogNamespace)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int64][]storedEvent)
+	for key, value := range entries {
+		messageId, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		var forwarded forwardedMessage
+		if err := json.Unmarshal([]byte(value), &forwarded); err != nil {
+			continue
+		}
+		for _, event := range forwarded.Events {
+			if !event.ExpiresAt.IsZero() && event.ExpiresAt.Before(now) {
+				result[messageId] = append(result[messageId], event)
+			}
+		}
+	}
+	return result, nil
+}
+
+// ForgetEvent removes a single event from the log. The message is removed
+// once it has no events left.
+func (l *forwardLog) ForgetEvent(messageId int64, room string, eventID id.EventID) error {
+	key := strconv.FormatInt(messageId, 10)
+	value, found, err := l.store.Get(forwardLogNamespace, key)
+	if err != nil || !found {
+		return err
+	}
+	var forwarded forwardedMessage
+	if err := json.Unmarshal([]byte(value), &forwarded); err != nil {
+		return err
+	}
+	forwarded.Events = slices.DeleteFunc(forwarded.Events, func(event storedEvent) bool {
+		return event.Room == room && event.EventID == eventID
+	})
+	if err := l.store.Delete(eventMessagesNamespace, eventKey(room, eventID)); err != nil {
+		return err
+	}
+	if len(forwarded.Events) == 0 {
+		return l.store.Delete(forwardLogNamespace, key)
+	}
+	data, err := json.Marshal(forwarded)
+	if err != nil {
+		return err
+	}
+	return l.store.Set(forwardLogNamespace, key, string(data))
+}
+
+func eventKey(room string, eventID id.EventID) string {
+	return room + " " + eventID.String()
+}
@@ -0,0 +1,403 @@
+package bot
+
+import (
+	"fmt"
+	"gotify_matrix_bot/gotify_messages"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/template"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
+)
+
+// forwardRules are the routing and filter rules, which are replaced as a
+// whole when the config is reloaded.
+type forwardRules struct {
+	router      *routing.Router
+	filter      *routing.Filter
+	needAppName bool
+}
+
+// forwarder takes messages received from gotify through filtering, routing
+// and formatting, and sends them to Matrix.
+type forwarder struct {
+	matrix       *matrix.MatrixState
+	rules        atomic.Pointer[forwardRules]
+	applications *gotify_messages.ApplicationCache
+	appRooms     *appRooms
+	space        *space
+	dedup        *deduplicator
+	digest       *digester
+	quietQueue   *quietQueue
+	threads      *threads
+	replacer     *routing.Replacer
+	replacements *replacements
+	correlator   *routing.Correlator
+	incidents    *incidents
+	// Post recoveries as replies instead of in the thread of the problem.
+	replyToIncidents bool
+	acks             *acks
+	mutes            *mutes
+	history          *history
+	forwardLog       *forwardLog
+	sender           *gotifySender
+	queuedEvents     *queuedEvents
+}
+
+// forwardJob is a message on its way from gotify to Matrix.
+type forwardJob struct {
+	// nil if the message could not be parsed
+	message      *template.Message
+	info         routing.MessageInfo
+	markdown     string
+	destinations []routing.Destination
+}
+
+// Transform parses, filters, formats and routes a message received from
+// gotify. Returns false if the message is dropped.
+func (f *forwarder) Transform(rawMessage []byte) (*forwardJob, bool) {
+	rules := f.rules.Load()
+	message, err := template.ParseMessage(rawMessage)
+	if err != nil {
+		destinations, _ := rules.router.Route(routing.MessageInfo{})
+		return &forwardJob{
+			markdown:     template.GetFormattedMessageString(rawMessage),
+			destinations: destinations,
+		}, true
+	}
+
+	if f.sender != nil && f.sender.Sent(message.AppId) {
+		log.Debug().Msgf("Message %d was sent from Matrix, not forwarding it", message.Id)
+		return nil, false
+	}
+	info := messageInfo(message, rules.needAppName, f.applications)
+	if !rules.filter.Allow(info) {
+		return nil, false
+	}
+	if f.mutes != nil {
+		muted, err := f.mutes.Muted(message.AppId)
+		if err != nil {
+			log.Error().Err(err).Msgf("Could not check whether application %d is muted", message.AppId)
+		} else if muted {
+			log.Info().Msgf("Application %d is muted, dropping message %d", message.AppId, message.Id)
+			return nil, false
+		}
+	}
+	if f.history != nil {
+		f.history.Add(historyEntry{time: time.Now(), appId: message.AppId, title: message.Title, message: message.Message})
+	}
+
+	destinations, matched := rules.router.Route(info)
+	if !matched && f.appRooms != nil {
+		appRoom, err := f.appRooms.RoomFor(message.AppId)
+		if err != nil {
+			log.Error().Err(err).Msgf("Could not get room for application %d", message.AppId)
+		} else {
+			destinations = []routing.Destination{{
+				Target:     appRoom,
+				QuietHours: rules.router.DefaultQuietHours(),
+				Retention:  rules.router.DefaultRetention(),
+			}}
+		}
+	}
+	return &forwardJob{
+		message:      message,
+		info:         info,
+		markdown:     template.FormatMessage(message),
+		destinations: destinations,
+	}, true
+}
+
+// Media uploads the images of a message to Matrix.
+func (f *forwarder) Media(job *forwardJob) {
+	job.markdown = matrix.UploadImages(f.matrix, job.markdown)
+}
+
+// Deliver sends a message to its destinations, or updates earlier messages
+// it replaces, repeats or resolves.
+func (f *forwarder) Deliver(job *forwardJob) {
+	message := job.message
+	if message == nil {
+		f.send(job.destinations, job.markdown, nil, 0)
+		return
+	}
+
+	var replaceKey string
+	if f.replacements != nil {
+		replaceKey = f.replacer.Key(job.info)
+		if replaceKey != "" && f.replaceExisting(replaceKey, message, job.markdown) {
+			return
+		}
+	}
+
+	var incidentKey string
+	var incidentState routing.IncidentState
+	if f.incidents != nil {
+		incidentKey, incidentState = f.correlator.Correlate(job.info)
+		if incidentState == routing.IncidentRecovery && f.resolveIncident(incidentKey, message, job.markdown) {
+			return
+		}
+	}
+
+	var dedupKey string
+	if f.dedup != nil && replaceKey == "" {
+		dedupKey = deduplicationKey(message)
+		if entry, found := f.dedup.Repeat(dedupKey); found {
+			log.Info().Msgf("Message %d/%d is a repeat, updating original", message.AppId, message.Id)
+			for _, sent := range entry.events {
+				if err := matrix.EditMessage(f.matrix, sent.room, sent.eventID, entry.Markdown()); err != nil {
+					log.Error().Err(err).Msgf("Could not update repeated message in %s", sent.room)
+				}
+			}
+			return
+		}
+	}
+
+	var heldItem *digestMessage
+	if f.digest != nil || f.quietQueue != nil {
+		heldItem = &digestMessage{
+			appName:  f.applications.Name(message.AppId),
+			title:    message.Title,
+			markdown: withoutHeading(job.markdown, message.Title),
+			priority: message.Priority,
+		}
+	}
+	markdownMessage := job.markdown
+	events, queued := f.send(job.destinations, markdownMessage, heldItem, message.AppId)
+	if dedupKey != "" && len(events) > 0 {
+		f.dedup.Remember(dedupKey, markdownMessage, events)
+	}
+	delivered := delivery{MessageID: message.Id, ReplaceKey: replaceKey, Markdown: markdownMessage}
+	if f.acks != nil && f.acks.Required(message.Priority) {
+		delivered.Acknowledge = true
+		delivered.Title = message.Title
+	}
+	if incidentState == routing.IncidentProblem {
+		delivered.IncidentKey = incidentKey
+	}
+	f.remember(delivered, events)
+	if f.queuedEvents != nil && len(queued) > 0 {
+		if err := f.queuedEvents.Add(queued, delivered); err != nil {
+			log.Error().Err(err).Msgf("Could not remember queued message %d", message.Id)
+		}
+	}
+}
+
+// remember records the sent events of a message, so that it can be deleted,
+// replaced, resolved or acknowledged later.
+func (f *forwarder) remember(delivered delivery, events []sentEvent) {
+	if len(events) == 0 {
+		return
+	}
+	if delivered.ReplaceKey != "" && f.replacements != nil {
+		if err := f.replacements.Remember(delivered.ReplaceKey, events); err != nil {
+			log.Error().Err(err).Msgf("Could not remember events for replace key %s", delivered.ReplaceKey)
+		}
+	}
+	if f.forwardLog != nil {
+		if err := f.forwardLog.Record(delivered.MessageID, events); err != nil {
+			log.Error().Err(err).Msgf("Could not record forwarded message %d", delivered.MessageID)
+		}
+	}
+	if delivered.Acknowledge && f.acks != nil {
+		f.acks.Track(events, delivered.Title, delivered.Markdown)
+	}
+	if delivered.IncidentKey != "" && f.incidents != nil {
+		if err := f.incidents.Open(delivered.IncidentKey, delivered.Markdown, events); err != nil {
+			log.Error().Err(err).Msgf("Could not remember incident %s", delivered.IncidentKey)
+		}
+	}
+}
+
+// Delivered records the event of a message which the outbox sent after it
+// was queued. It is called by the outbox.
+func (f *forwarder) Delivered(transactionID string, eventID id.EventID) {
+	if f.threads != nil {
+		f.threads.Delivered(transactionID, eventID)
+	}
+	if f.queuedEvents == nil {
+		return
+	}
+	queued, found, err := f.queuedEvents.Take(transactionID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not read queued message %s", transactionID)
+		return
+	}
+	if !found || eventID == "" {
+		return
+	}
+	f.remember(queued.Delivery, []sentEvent{{room: queued.Room, eventID: eventID, retention: queued.Retention}})
+}
+
+// resolveIncident posts a recovery message in the thread of, or as a reply
+// to, the first problem message of the incident, and marks all problem
+// messages as resolved. Returns false if there is no open incident.
+func (f *forwarder) resolveIncident(incidentKey string, message *template.Message, markdownMessage string) bool {
+	events, found, err := f.incidents.Resolve(incidentKey)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not read incident %s", incidentKey)
+		return false
+	}
+	if !found {
+		return false
+	}
+
+	log.Info().Msgf("Message %d/%d resolves incident %s", message.AppId, message.Id, incidentKey)
+	answered := make(map[string]bool)
+	for _, problem := range events {
+		// The recovery is posted once per room, linked to the first problem message.
+		if !answered[problem.room] {
+			answered[problem.room] = true
+			// Messages in an application thread cannot start a thread of their own.
+			if f.replyToIncidents || f.threads != nil {
+				matrix.SendReplyMessage(f.matrix, problem.room, problem.eventID, markdownMessage)
+			} else {
+				matrix.SendThreadMessage(f.matrix, problem.room, problem.eventID, markdownMessage)
+			}
+		}
+		if err := matrix.EditMessage(f.matrix, problem.room, problem.eventID, problem.resolvedMarkdown); err != nil {
+			log.Error().Err(err).Msgf("Could not mark incident %s as resolved in %s", incidentKey, problem.room)
+		}
+	}
+	return true
+}
+
+// replaceExisting edits the events previously sent for the replace key.
+// Returns false if there are none, so the message is sent as usual.
+func (f *forwarder) replaceExisting(replaceKey string, message *template.Message, markdownMessage string) bool {
+	events, found, err := f.replacements.Events(replaceKey)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not read events for replace key %s", replaceKey)
+		return false
+	}
+	if !found {
+		return false
+	}
+
+	log.Info().Msgf("Message %d/%d replaces the message with key %s", message.AppId, message.Id, replaceKey)
+	for _, sent := range events {
+		if err := matrix.EditMessage(f.matrix, sent.room, sent.eventID, markdownMessage); err != nil {
+			log.Error().Err(err).Msgf("Could not replace message in %s", sent.room)
+		}
+	}
+	return true
+}
+
+// send sends a message to all destinations. During quiet hours or bursts,
+// the held item is queued instead. With threads enabled, the message is
+// sent into the thread of its application; appId is 0 for messages which
+// could not be parsed. Returns the sent events, and the messages left to the
+// outbox.
+func (f *forwarder) send(destinations []routing.Destination, markdownMessage string, heldItem *digestMessage, appId int64) ([]sentEvent, []queuedEvent) {
+	if len(destinations) == 0 {
+		log.Info().Msg("Message was not routed to any room")
+		return nil, nil
+	}
+
+	var sendTo []routing.Destination
+	for _, destination := range destinations {
+		if heldItem != nil && f.quietQueue != nil && f.quietQueue.Hold(destination, *heldItem) {
+			log.Info().Msgf("Message for %s was queued during quiet hours", destination.Target)
+			continue
+		}
+		if heldItem != nil && f.digest != nil && f.digest.Offer(destination.Target, *heldItem) {
+			log.Info().Msgf("Message for %s was held for digest", destination.Target)
+			continue
+		}
+		sendTo = append(sendTo, destination)
+	}
+	if len(sendTo) == 0 {
+		return nil, nil
+	}
+
+	var events []sentEvent
+	var queued []queuedEvent
+	for _, destination := range sendTo {
+		room, err := resolveTarget(f.matrix, destination.Target)
+		if err != nil {
+			log.Error().Err(err).Msgf("Could not find room for %s", destination.Target)
+			continue
+		}
+		if f.space != nil && !isUserTarget(destination.Target) {
+			f.space.Add(room)
+		}
+		var retention time.Duration
+		if destination.Retention != nil {
+			retention = destination.Retention.MaxAge
+		}
+		eventID, transactionID := f.sendToRoom(room, markdownMessage, appId)
+		if eventID != "" {
+			events = append(events, sentEvent{room: room, eventID: eventID, retention: retention})
+		} else if transactionID != "" {
+			// Recorded once the outbox has sent it.
+			queued = append(queued, queuedEvent{TransactionID: transactionID, Room: room, Retention: retention})
+		}
+	}
+	return events, queued
+}
+
+// sendToRoom returns the event ID of the message, or its transaction ID if
+// it was left to the outbox.
+func (f *forwarder) sendToRoom(room string, markdownMessage string, appId int64) (id.EventID, string) {
+	if f.threads == nil || appId == 0 {
+		return matrix.SendTrackedMessage(f.matrix, room, "", markdownMessage)
+	}
+	root, err := f.threads.RootFor(room, appId, f.applications.Name(appId))
+	if err != nil {
+		log.Warn().Err(err).Msgf("Could not get thread for application %d, sending the message outside of it", appId)
+	}
+	return matrix.SendTrackedMessage(f.matrix, room, root, markdownMessage)
+}
+
+// sendDigest posts a summary of messages held during a burst.
+func (f *forwarder) sendDigest(target string, messages []digestMessage) {
+	f.sendSummary(target, fmt.Sprintf("Digest: %d messages in the last %s", len(messages), f.digest.window), messages)
+}
+
+// sendQuietHoursDigest posts the messages queued during quiet hours.
+func (f *forwarder) sendQuietHoursDigest(target string, messages []digestMessage) {
+	f.sendSummary(target, fmt.Sprintf("%d messages during quiet hours", len(messages)), messages)
+}
+
+func (f *forwarder) sendSummary(target string, heading string, messages []digestMessage) {
+	room, err := resolveTarget(f.matrix, target)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not find room for %s", target)
+		return
+	}
+	log.Info().Msgf("Sending summary of %d messages to %s", len(messages), room)
+	matrix.SendHTMLMessage(f.matrix, room, digestHTML(heading, messages))
+}
+
+func messageInfo(message *template.Message, needAppName bool, applications *gotify_messages.ApplicationCache) routing.MessageInfo {
+	info := routing.MessageInfo{
+		AppID:    message.AppId,
+		Priority: message.Priority,
+		Title:    message.Title,
+		Message:  message.Message,
+		Extras:   message.StringExtras,
+	}
+	if needAppName {
+		info.AppName = applications.Name(message.AppId)
+	}
+	return info
+}
+
+// isUserTarget returns true if a route target is a Matrix user rather than a room.
+func isUserTarget(target string) bool {
+	return strings.HasPrefix(target, "@")
+}
+
+// resolveTarget returns the room to send to for a route target. Users are
+// resolved to their direct chat with the bot.
+func resolveTarget(matrixConnection *matrix.MatrixState, target string) (string, error) {
+	if !isUserTarget(target) {
+		return target, nil
+	}
+	room, err := matrix.GetDirectRoom(matrixConnection, id.UserID(target))
+	return room.String(), err
+}
@@ -0,0 +1,178 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/state"
+	"gotify_matrix_bot/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petergtz/pegomock/v4"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// sentMessages returns the rooms of the new messages sent with the mock, in
+// order. They are sent with a transaction ID, unlike edits.
+func sentMessages(mockClient *MockMautrixClientType) []id.RoomID {
+	_, rooms, _, _, extras := mockClient.VerifyWasCalled(pegomock.AtLeast(0)).SendMessageEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Any[id.RoomID](),
+		pegomock.Any[event.Type](),
+		pegomock.Any[any](),
+		pegomock.Any[mautrix.ReqSendEvent]()).GetAllCapturedArguments()
+	var sent []id.RoomID
+	for idx := range rooms {
+		if len(extras[idx]) > 0 {
+			sent = append(sent, rooms[idx])
+		}
+	}
+	return sent
+}
+
+// editedMessages returns the edits sent with the mock, in order.
+func editedMessages(mockClient *MockMautrixClientType) []*event.MessageEventContent {
+	_, _, _, contents, extras := mockClient.VerifyWasCalled(pegomock.AtLeast(0)).SendMessageEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Any[id.RoomID](),
+		pegomock.Any[event.Type](),
+		pegomock.Any[any]()).GetAllCapturedArguments()
+	var edits []*event.MessageEventContent
+	for idx, content := range contents {
+		if len(extras[idx]) == 0 {
+			edits = append(edits, content.(*event.MessageEventContent))
+		}
+	}
+	return edits
+}
+
+func TestDeliverDeduplicates(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+	mockClient, matrixState := setupMatrixMock(t)
+	eventCount := 0
+	pegomock.When(mockClient.SendMessageEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Any[id.RoomID](),
+		pegomock.Any[event.Type](),
+		pegomock.Any[any](),
+		pegomock.Any[mautrix.ReqSendEvent]())).
+		Then(func(params []pegomock.Param) pegomock.ReturnValues {
+			eventCount++
+			return []pegomock.ReturnValue{&mautrix.RespSendEvent{EventID: id.EventID(fmt.Sprintf("$%d", eventCount))}, nil}
+		})
+
+	now := time.Date(2025, 3, 1, 10, 15, 0, 0, time.Local)
+	dedup := newDeduplicator(time.Minute)
+	dedup.now = func() time.Time { return now }
+	f := &forwarder{matrix: matrixState, dedup: dedup}
+	job := func(messageId int64, text string) *forwardJob {
+		return &forwardJob{
+			message:      &template.Message{Id: messageId, AppId: 2, Title: "Down", Message: text},
+			markdown:     "**Down**\n\n" + text,
+			destinations: []routing.Destination{{Target: "!room"}, {Target: "!other"}},
+		}
+	}
+
+	f.Deliver(job(1, "Host is down"))
+	assert.DeepEqual(t, sentMessages(mockClient), []id.RoomID{"!room", "!other"})
+	assert.Equal(t, len(editedMessages(mockClient)), 0)
+
+	t.Run("Repeat edits the original messages", func(t *testing.T) {
+		now = now.Add(30 * time.Second)
+		f.Deliver(job(2, "Host is down"))
+
+		assert.Equal(t, len(sentMessages(mockClient)), 2)
+		edits := editedMessages(mockClient)
+		assert.Equal(t, len(edits), 2)
+		for idx, original := range []id.EventID{"$1", "$2"} {
+			assert.Equal(t, edits[idx].RelatesTo.GetReplaceID(), original)
+			assert.Assert(t, strings.Contains(edits[idx].NewContent.Body, "(repeated ×2, last at 10:15)"), edits[idx].NewContent.Body)
+		}
+
+		now = now.Add(45 * time.Second)
+		f.Deliver(job(3, "Host is down"))
+
+		assert.Equal(t, len(sentMessages(mockClient)), 2)
+		edits = editedMessages(mockClient)
+		assert.Equal(t, len(edits), 4)
+		assert.Assert(t, strings.Contains(edits[3].NewContent.Body, "(repeated ×3, last at 10:16)"), edits[3].NewContent.Body)
+	})
+
+	t.Run("Message is sent again after the window", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		f.Deliver(job(4, "Host is down"))
+
+		assert.Equal(t, len(sentMessages(mockClient)), 4)
+		assert.Equal(t, len(editedMessages(mockClient)), 4)
+
+		now = now.Add(10 * time.Second)
+		f.Deliver(job(5, "Host is down"))
+
+		edits := editedMessages(mockClient)
+		assert.Equal(t, len(edits), 6)
+		assert.Equal(t, edits[4].RelatesTo.GetReplaceID(), id.EventID("$3"))
+		assert.Assert(t, strings.Contains(edits[4].NewContent.Body, "(repeated ×2, last at 10:18)"), edits[4].NewContent.Body)
+	})
+
+	t.Run("Different message is not deduplicated", func(t *testing.T) {
+		f.Deliver(job(6, "Host is up"))
+
+		assert.Equal(t, len(sentMessages(mockClient)), 6)
+		assert.Equal(t, len(editedMessages(mockClient)), 6)
+	})
+}
+
+func TestDeliverRecordsQueuedMessages(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	mockClient, matrixState := setupMatrixMock(t)
+	rateLimited := mautrix.HTTPError{
+		Response:  &http.Response{StatusCode: http.StatusTooManyRequests},
+		RespError: &mautrix.RespError{ErrCode: "M_LIMIT_EXCEEDED", ExtraData: map[string]any{"retry_after_ms": float64(0)}},
+	}
+	pegomock.When(mockClient.SendMessageEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Any[id.RoomID](),
+		pegomock.Any[event.Type](),
+		pegomock.Any[any](),
+		pegomock.Any[mautrix.ReqSendEvent]())).
+		ThenReturn(nil, rateLimited).
+		ThenReturn(nil, rateLimited).
+		ThenReturn(nil, rateLimited).
+		ThenReturn(&mautrix.RespSendEvent{EventID: "$late"}, nil)
+
+	f := &forwarder{
+		matrix:       matrixState,
+		forwardLog:   &forwardLog{store: store, now: time.Now},
+		queuedEvents: &queuedEvents{store: store},
+	}
+	matrixState.Outbox = matrix.NewOutbox(store)
+	matrixState.Outbox.OnDelivered = f.Delivered
+
+	f.Deliver(&forwardJob{
+		message:      &template.Message{Id: 7, AppId: 2, Title: "Down", Message: "Host is down"},
+		markdown:     "**Down**\n\nHost is down",
+		destinations: []routing.Destination{{Target: "!room"}},
+	})
+	forwarded, err := f.forwardLog.Since(time.Time{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(forwarded), 0)
+
+	// The event is recorded once the outbox has sent the message.
+	matrixState.Outbox.Flush(matrixState)
+	messageId, found, err := f.forwardLog.MessageFor("!room", "$late")
+	assert.NilError(t, err)
+	assert.Assert(t, found)
+	assert.Equal(t, messageId, int64(7))
+}
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"context"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const deletedReaction = "✔️"
+
+// gotifyDeleter deletes gotify messages when an allowed user reacts to the
+// forwarded message with the configured reaction.
+type gotifyDeleter struct {
+	reaction     string
+	allowedUsers []string
+	log          *forwardLog
+	delete       func(messageId int64) error
+	react        func(room string, eventID id.EventID, key string) error
+}
+
+func (d *gotifyDeleter) HandleEvent(_ context.Context, evt *event.Event) {
+	if evt.Type != event.EventReaction || !slices.Contains(d.allowedUsers, evt.Sender.String()) {
+		return
+	}
+	relatesTo := evt.Content.AsReaction().RelatesTo
+	if normalizeReaction(relatesTo.Key) != normalizeReaction(d.reaction) {
+		return
+	}
+
+	room := evt.RoomID.String()
+	messageId, found, err := d.log.MessageFor(room, relatesTo.EventID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not look up gotify message of %s", relatesTo.EventID)
+		return
+	}
+	if !found {
+		log.Debug().Msgf("Event %s was not forwarded from gotify", relatesTo.EventID)
+		return
+	}
+
+	log.Info().Msgf("Deleting gotify message %d on request of %s", messageId, evt.Sender)
+	if err := d.delete(messageId); err != nil {
+		log.Error().Err(err).Msgf("Could not delete gotify message %d", messageId)
+		return
+	}
+	if err := d.log.Forget(messageId); err != nil {
+		log.Error().Err(err).Msgf("Could not remove gotify message %d from the forward log", messageId)
+	}
+	if err := d.react(room, relatesTo.EventID, deletedReaction); err != nil {
+		log.Warn().Err(err).Msg("Could not confirm deletion of gotify message")
+	}
+}
@@ -0,0 +1,64 @@
+package bot
+
+import (
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestGotifyDeleter(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	forwarded := &forwardLog{store: store, now: time.Now}
+	assert.NilError(t, forwarded.Record(42, []sentEvent{{room: "!room", eventID: "$a"}, {room: "!other", eventID: "$b"}}))
+
+	var deleted []int64
+	var reactions []id.EventID
+	d := &gotifyDeleter{
+		reaction:     "🗑️",
+		allowedUsers: []string{"@admin:example.com"},
+		log:          forwarded,
+		delete: func(messageId int64) error {
+			deleted = append(deleted, messageId)
+			return nil
+		},
+		react: func(room string, eventID id.EventID, key string) error {
+			assert.Equal(t, key, deletedReaction)
+			reactions = append(reactions, eventID)
+			return nil
+		},
+	}
+	reaction := func(sender id.UserID, target id.EventID, key string) *event.Event {
+		return &event.Event{
+			Type:   event.EventReaction,
+			RoomID: "!room",
+			Sender: sender,
+			Content: event.Content{Parsed: &event.ReactionEventContent{
+				RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: target, Key: key},
+			}},
+		}
+	}
+
+	d.HandleEvent(t.Context(), reaction("@other:example.com", "$a", "🗑️"))
+	d.HandleEvent(t.Context(), reaction("@admin:example.com", "$a", "👍"))
+	d.HandleEvent(t.Context(), reaction("@admin:example.com", "$unknown", "🗑️"))
+	assert.Equal(t, len(deleted), 0)
+
+	d.HandleEvent(t.Context(), reaction("@admin:example.com", "$a", "🗑"))
+	assert.DeepEqual(t, deleted, []int64{42})
+	assert.DeepEqual(t, reactions, []id.EventID{"$a"})
+
+	// The message and all of its events are removed from the log.
+	_, found, err := forwarded.MessageFor("!other", "$b")
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+	d.HandleEvent(t.Context(), reaction("@admin:example.com", "$a", "🗑️"))
+	assert.Equal(t, len(deleted), 1)
+}
@@ -0,0 +1,130 @@
+package bot
+
+import (
+	"context"
+	"gotify_matrix_bot/config"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const sentReaction = "✅"
+
+// gotifySender creates gotify messages from Matrix, with the send command or
+// from messages in watched rooms.
+type gotifySender struct {
+	applications []config.GotifySendAppType
+	watchRooms   []config.GotifySendRoomType
+	allowedUsers []string
+	appToken     func(appId int64) string
+	post         func(appToken string, title string, message string, priority *int) error
+	react        func(room string, eventID id.EventID, key string) error
+	reply        func(room string, markdown string)
+}
+
+// Command handles "!gotify send <app> [priority] <text>", where text is
+// everything after "send".
+func (s *gotifySender) Command(sender id.UserID, text string) string {
+	app, rest, found := s.findApp(text)
+	if !found {
+		return "Usage: `!gotify send <app> [priority] <text>`. Applications: " + s.appNames() + "."
+	}
+
+	var priority *int
+	if field, afterField := cutField(rest); field != "" {
+		if p, err := strconv.Atoi(field); err == nil {
+			priority = &p
+			rest = afterField
+		}
+	}
+	if rest == "" {
+		return "Usage: `!gotify send <app> [priority] <text>`"
+	}
+
+	if err := s.post(app.Token, sender.String(), rest, priority); err != nil {
+		log.Error().Err(err).Msgf("Could not send message to gotify application %s", app.Name)
+		return "Could not send the message to gotify."
+	}
+	return "Sent the message to " + app.Name + "."
+}
+
+// HandleEvent forwards messages from allowed users in watched rooms.
+func (s *gotifySender) HandleEvent(_ context.Context, evt *event.Event) {
+	if evt.Type != event.EventMessage {
+		return
+	}
+	roomIdx := slices.IndexFunc(s.watchRooms, func(room config.GotifySendRoomType) bool {
+		return room.Room == evt.RoomID.String()
+	})
+	if roomIdx < 0 || !slices.Contains(s.allowedUsers, evt.Sender.String()) {
+		return
+	}
+	content := evt.Content.AsMessage()
+	if content.MsgType != event.MsgText || content.RelatesTo.GetReplaceID() != "" || strings.HasPrefix(content.Body, commandPrefix) {
+		return
+	}
+
+	watchRoom := s.watchRooms[roomIdx]
+	app, _, _ := s.findApp(watchRoom.Application)
+	if err := s.post(app.Token, evt.Sender.String(), content.Body, watchRoom.Priority); err != nil {
+		log.Error().Err(err).Msgf("Could not send message from %s to gotify", evt.RoomID)
+		s.reply(evt.RoomID.String(), "Could not send the message to gotify.")
+		return
+	}
+	if err := s.react(evt.RoomID.String(), evt.ID, sentReaction); err != nil {
+		log.Warn().Err(err).Msg("Could not confirm message sent to gotify")
+	}
+}
+
+// Sent tells whether a gotify message is from one of the applications, so
+// that messages sent from Matrix are not forwarded back to Matrix.
+func (s *gotifySender) Sent(appId int64) bool {
+	token := s.appToken(appId)
+	return token != "" && slices.ContainsFunc(s.applications, func(app config.GotifySendAppType) bool {
+		return app.Token == token
+	})
+}
+
+// findApp finds the application whose name starts the text, ignoring case,
+// and returns the rest of the text. Names may contain spaces.
+func (s *gotifySender) findApp(text string) (config.GotifySendAppType, string, bool) {
+	var best config.GotifySendAppType
+	var rest string
+	for _, app := range s.applications {
+		if len(text) < len(app.Name) || !strings.EqualFold(text[:len(app.Name)], app.Name) {
+			continue
+		}
+		after := text[len(app.Name):]
+		if after != "" && !unicode.IsSpace(rune(after[0])) {
+			continue
+		}
+		if len(app.Name) > len(best.Name) {
+			best = app
+			rest = strings.TrimSpace(after)
+		}
+	}
+	return best, rest, best.Name != ""
+}
+
+func (s *gotifySender) appNames() string {
+	var names []string
+	for _, app := range s.applications {
+		names = append(names, app.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// cutField splits off the first whitespace separated field of the text.
+func cutField(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	idx := strings.IndexFunc(text, unicode.IsSpace)
+	if idx < 0 {
+		return text, ""
+	}
+	return text[:idx], strings.TrimSpace(text[idx:])
+}
@@ -0,0 +1,107 @@
+package bot
+
+import (
+	"errors"
+	"gotify_matrix_bot/config"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type postedMessage struct {
+	token    string
+	title    string
+	message  string
+	priority *int
+}
+
+func TestGotifySender(t *testing.T) {
+	var posted []postedMessage
+	var reactions []id.EventID
+	var replies []string
+	var postErr error
+	highPriority := 8
+	s := &gotifySender{
+		applications: []config.GotifySendAppType{
+			{Name: "Matrix", Token: "token1"},
+			{Name: "Matrix Alerts", Token: "token2"},
+		},
+		watchRooms:   []config.GotifySendRoomType{{Room: "!watched", Application: "Matrix Alerts", Priority: &highPriority}},
+		allowedUsers: []string{"@admin:example.com"},
+		appToken: func(appId int64) string {
+			return map[int64]string{1: "token1", 2: "token2", 3: "token3"}[appId]
+		},
+		post: func(appToken string, title string, message string, priority *int) error {
+			posted = append(posted, postedMessage{appToken, title, message, priority})
+			return postErr
+		},
+		react: func(room string, eventID id.EventID, key string) error {
+			reactions = append(reactions, eventID)
+			return nil
+		},
+		reply: func(room string, markdown string) {
+			replies = append(replies, markdown)
+		},
+	}
+
+	t.Run("Send command", func(t *testing.T) {
+		posted = nil
+		assert.Equal(t, s.Command("@admin:example.com", "matrix hello  world"), "Sent the message to Matrix.")
+		assert.Equal(t, s.Command("@admin:example.com", "Matrix Alerts 7 disk\nfull"), "Sent the message to Matrix Alerts.")
+		assert.Equal(t, len(posted), 2)
+		assert.Equal(t, posted[0].token, "token1")
+		assert.Equal(t, posted[0].title, "@admin:example.com")
+		assert.Equal(t, posted[0].message, "hello  world")
+		assert.Assert(t, posted[0].priority == nil)
+		assert.Equal(t, posted[1].token, "token2")
+		assert.Equal(t, posted[1].message, "disk\nfull")
+		assert.Equal(t, *posted[1].priority, 7)
+	})
+
+	t.Run("Invalid send command", func(t *testing.T) {
+		posted = nil
+		assert.Equal(t, s.Command("@admin:example.com", "Matrixfoo hello"),
+			"Usage: `!gotify send <app> [priority] <text>`. Applications: Matrix, Matrix Alerts.")
+		assert.Equal(t, s.Command("@admin:example.com", "Matrix 5"), "Usage: `!gotify send <app> [priority] <text>`")
+		assert.Equal(t, len(posted), 0)
+	})
+
+	t.Run("Send fails", func(t *testing.T) {
+		postErr = errors.New("unauthorized")
+		defer func() { postErr = nil }()
+		assert.Equal(t, s.Command("@admin:example.com", "Matrix hello"), "Could not send the message to gotify.")
+	})
+
+	message := func(room id.RoomID, sender id.UserID, body string) *event.Event {
+		return &event.Event{
+			ID:      "$message",
+			Type:    event.EventMessage,
+			RoomID:  room,
+			Sender:  sender,
+			Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+		}
+	}
+
+	t.Run("Watched room", func(t *testing.T) {
+		posted = nil
+		s.HandleEvent(t.Context(), message("!watched", "@admin:example.com", "Door open"))
+		s.HandleEvent(t.Context(), message("!watched", "@other:example.com", "Door open"))
+		s.HandleEvent(t.Context(), message("!other", "@admin:example.com", "Door open"))
+		s.HandleEvent(t.Context(), message("!watched", "@admin:example.com", "!gotify status"))
+
+		assert.Equal(t, len(posted), 1)
+		assert.Equal(t, posted[0].token, "token2")
+		assert.Equal(t, posted[0].message, "Door open")
+		assert.Equal(t, *posted[0].priority, 8)
+		assert.DeepEqual(t, reactions, []id.EventID{"$message"})
+	})
+
+	t.Run("Messages sent from Matrix", func(t *testing.T) {
+		assert.Assert(t, s.Sent(1))
+		assert.Assert(t, s.Sent(2))
+		assert.Assert(t, !s.Sent(3))
+		assert.Assert(t, !s.Sent(4))
+	})
+}
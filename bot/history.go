@@ -0,0 +1,52 @@
+package bot
+
+import (
+	"sync"
+	"time"
+)
+
+const historySize = 50
+
+type historyEntry struct {
+	time    time.Time
+	appId   int64
+	title   string
+	message string
+}
+
+// history keeps the most recent forwarded messages in memory.
+type history struct {
+	mutex   sync.Mutex
+	entries []historyEntry
+	count   int64
+}
+
+func (h *history) Add(entry historyEntry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.count++
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > historySize {
+		h.entries = h.entries[len(h.entries)-historySize:]
+	}
+}
+
+// Last returns up to n of the most recent messages, newest first.
+func (h *history) Last(n int) []historyEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n = min(n, len(h.entries))
+	result := make([]historyEntry, 0, n)
+	for i := len(h.entries) - 1; i >= len(h.entries)-n; i-- {
+		result = append(result, h.entries[i])
+	}
+	return result
+}
+
+// Count returns the number of messages which passed the filters since the
+// start. They may still be waiting in a queue, or fail to be delivered.
+func (h *history) Count() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
@@ -0,0 +1,98 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"gotify_matrix_bot/state"
+	"time"
+)
+
+const incidentsNamespace = "incidents"
+
+type openIncident struct {
+	Markdown string        `json:"markdown"`
+	Events   []storedEvent `json:"events"`
+	Since    time.Time     `json:"since"`
+	// Further problem messages received while the incident was open.
+	Repeats []problemMessage `json:"repeats,omitempty"`
+}
+
+type problemMessage struct {
+	Markdown string        `json:"markdown"`
+	Events   []storedEvent `json:"events"`
+}
+
+// problemEvent is an event of a problem message, with the message updated
+// to show that the incident was resolved.
+type problemEvent struct {
+	sentEvent
+	resolvedMarkdown string
+}
+
+// incidents remembers the problem messages of open incidents, so that the
+// recovery message can be linked to them, even after a restart.
+type incidents struct {
+	store *state.Store
+	now   func() time.Time
+}
+
+func newIncidents(store *state.Store) *incidents {
+	return &incidents{store: store, now: time.Now}
+}
+
+// Open records a problem message. If the incident is already open, the
+// message is added to it, keeping the time the incident started.
+func (i *incidents) Open(key string, markdown string, events []sentEvent) error {
+	var stored []storedEvent
+	for _, event := range events {
+		stored = append(stored, storedEvent{Room: event.room, EventID: event.eventID})
+	}
+
+	value, found, err := i.store.Get(incidentsNamespace, key)
+	if err != nil {
+		return err
+	}
+	var incident openIncident
+	if found && json.Unmarshal([]byte(value), &incident) == nil {
+		incident.Repeats = append(incident.Repeats, problemMessage{Markdown: markdown, Events: stored})
+	} else {
+		incident = openIncident{Markdown: markdown, Events: stored, Since: i.now()}
+	}
+	data, err := json.Marshal(incident)
+	if err != nil {
+		return err
+	}
+	return i.store.Set(incidentsNamespace, key, string(data))
+}
+
+// Resolve closes an incident. It returns the events of the problem
+// messages, oldest first, each with its message updated to show how long the
+// incident lasted.
+func (i *incidents) Resolve(key string) ([]problemEvent, bool, error) {
+	value, found, err := i.store.Get(incidentsNamespace, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	var incident openIncident
+	if err := json.Unmarshal([]byte(value), &incident); err != nil {
+		return nil, false, err
+	}
+	if err := i.store.Delete(incidentsNamespace, key); err != nil {
+		return nil, false, err
+	}
+
+	now := i.now()
+	resolved := fmt.Sprintf("\n\n**✅ Resolved** after %s, at %s",
+		now.Sub(incident.Since).Round(time.Second), now.Format("15:04"))
+	messages := append([]problemMessage{{Markdown: incident.Markdown, Events: incident.Events}}, incident.Repeats...)
+	var events []problemEvent
+	for _, message := range messages {
+		for _, event := range message.Events {
+			events = append(events, problemEvent{
+				sentEvent:        sentEvent{room: event.Room, eventID: event.EventID},
+				resolvedMarkdown: message.Markdown + resolved,
+			})
+		}
+	}
+	return events, true, nil
+}
@@ -0,0 +1,56 @@
+package bot
+
+import (
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestIncidents(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	i := newIncidents(store)
+	i.now = func() time.Time { return now }
+
+	_, found, err := i.Resolve("uptime:web")
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+
+	sent := []sentEvent{{room: "!room", eventID: "$down"}}
+	assert.NilError(t, i.Open("uptime:web", "# web is DOWN", sent))
+
+	now = now.Add(5*time.Minute + 30*time.Second)
+	events, found, err := i.Resolve("uptime:web")
+	assert.NilError(t, err)
+	assert.Assert(t, found)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].sentEvent, sent[0])
+	assert.Equal(t, events[0].resolvedMarkdown, "# web is DOWN\n\n**✅ Resolved** after 5m30s, at 10:05")
+
+	// An incident is only resolved once.
+	_, found, err = i.Resolve("uptime:web")
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+
+	t.Run("Repeated problem keeps the incident", func(t *testing.T) {
+		assert.NilError(t, i.Open("uptime:db", "# db is DOWN", []sentEvent{{room: "!room", eventID: "$first"}}))
+		now = now.Add(10 * time.Minute)
+		assert.NilError(t, i.Open("uptime:db", "# db is DOWN again", []sentEvent{{room: "!room", eventID: "$second"}}))
+
+		now = now.Add(10 * time.Minute)
+		events, found, err := i.Resolve("uptime:db")
+		assert.NilError(t, err)
+		assert.Assert(t, found)
+		assert.Equal(t, len(events), 2)
+		assert.Equal(t, events[0].sentEvent, sentEvent{room: "!room", eventID: "$first"})
+		assert.Equal(t, events[0].resolvedMarkdown, "# db is DOWN\n\n**✅ Resolved** after 20m0s, at 10:25")
+		assert.Equal(t, events[1].sentEvent, sentEvent{room: "!room", eventID: "$second"})
+		assert.Equal(t, events[1].resolvedMarkdown, "# db is DOWN again\n\n**✅ Resolved** after 20m0s, at 10:25")
+	})
+}
@@ -1,16 +1,37 @@
 package bot
 
 import (
+	"context"
 	"gotify_matrix_bot/config"
 	"gotify_matrix_bot/gotify_messages"
 	"gotify_matrix_bot/matrix"
-	"gotify_matrix_bot/template"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/state"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
 )
 
-func MainLoop() {
+const (
+	stateFile = "botState.db"
+	// Leaves time to disconnect before docker kills the container after 10s.
+	defaultShutdownGracePeriod = 8 * time.Second
+)
+
+// MainLoop forwards messages until the context is cancelled, then shuts
+// down gracefully.
+func MainLoop(ctx context.Context) {
 	log.Info().Msg("Starting main loop...")
+	startedAt := time.Now()
+	// Registered before connecting, as the default action of SIGHUP would
+	// end the bot during login.
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
 
 	allowListAsRegexps, err := config.DownloadAllowListAsRegexps(config.Configuration)
 	if err != nil {
@@ -24,15 +45,303 @@ func MainLoop() {
 		config.Configuration.Matrix.Password,
 		config.Configuration.Matrix.Token,
 		allowListAsRegexps,
+		matrix.ImageProcessingOptions{
+			MaxDimension:  config.Configuration.Downloader.ImageProcessing.MaxDimension,
+			Format:        config.Configuration.Downloader.ImageProcessing.Format,
+			Quality:       config.Configuration.Downloader.ImageProcessing.Quality,
+			StripMetadata: config.Configuration.Downloader.ImageProcessing.StripMetadata,
+		},
+		config.Configuration.Downloader.Workers,
+		config.Configuration.Downloader.Timeout,
 	)
 
-	gotify_messages.OnNewMessage(func(rawMessage []byte) {
-		markdownMessage := template.GetFormattedMessageString(rawMessage)
-		messageWithImagesReplaced := matrix.UploadImages(matrixConnection, markdownMessage)
-		matrix.SendMessage(
-			matrixConnection,
-			config.Configuration.Matrix.RoomID, messageWithImagesReplaced,
+	router, err := routing.NewRouter(config.Configuration.Routing, config.Configuration.Matrix.RoomID)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to parse routing rules")
+	}
+	filter, err := routing.NewFilter(config.Configuration.Filtering)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to parse filter rules")
+	}
+	replacer, err := routing.NewReplacer(config.Configuration.Replace)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to parse replace rules")
+	}
+	correlator, err := routing.NewCorrelator(config.Configuration.Correlation)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to parse correlation rules")
+	}
+	needAppName := router.UsesAppName() || filter.UsesAppName() || replacer.UsesAppName() || correlator.UsesAppName()
+	applications := gotify_messages.NewApplicationCache()
+
+	store, err := state.Open(stateFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not open state store")
+	}
+	// The background loops use the store, so they are stopped before it is
+	// closed.
+	loops, stopLoops := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+	matrixConnection.Outbox = matrix.NewOutbox(store)
+	background.Go(func() { warnAboutDeadLetters(loops, matrixConnection.Outbox) })
+
+	var perAppRooms *appRooms
+	if config.Configuration.RoomPerApp.Enabled {
+		perAppRooms = &appRooms{
+			settings:     config.Configuration.RoomPerApp,
+			store:        store,
+			matrix:       matrixConnection,
+			applications: applications,
+		}
+	}
+
+	var notificationSpace *space
+	if config.Configuration.Space.Enabled {
+		notificationSpace = &space{
+			settings: config.Configuration.Space,
+			store:    store,
+			matrix:   matrixConnection,
+		}
+		rooms, err := spaceRooms(router, store)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not read application rooms")
+		}
+		if err := notificationSpace.Init(rooms); err != nil {
+			log.Error().Err(err).Msg("Could not set up space")
+		}
+	}
+
+	var dedup *deduplicator
+	if config.Configuration.Deduplication.Window > 0 {
+		dedup = newDeduplicator(config.Configuration.Deduplication.Window)
+	}
+
+	messageForwarder := &forwarder{
+		matrix:       matrixConnection,
+		applications: applications,
+		appRooms:     perAppRooms,
+		space:        notificationSpace,
+		dedup:        dedup,
+		mutes:        &mutes{store: store, now: time.Now},
+		history:      &history{},
+		queuedEvents: &queuedEvents{store: store},
+	}
+	messageForwarder.rules.Store(&forwardRules{router: router, filter: filter, needAppName: needAppName})
+	background.Go(func() {
+		logFilterStats(loops, func() *routing.Filter { return messageForwarder.rules.Load().filter }, config.Configuration.Filtering.StatsInterval)
+	})
+	messagePipeline := newPipeline(config.Configuration.Pipeline, messageForwarder.Transform, messageForwarder.Media, messageForwarder.Deliver)
+	messagePipeline.backlog = store
+	if config.Configuration.GotifyDelete.Reaction != "" || config.Configuration.Reconcile.Interval > 0 || router.UsesRetention() {
+		messageForwarder.forwardLog = &forwardLog{store: store, now: time.Now}
+		if config.Configuration.GotifyDelete.Reaction != "" {
+			messageForwarder.forwardLog.maxAge = gotifyDeleteMaxAge
+		}
+	}
+	if router.UsesRetention() {
+		setRoomRetentions(matrixConnection, router)
+		expiry := &retention{
+			log: messageForwarder.forwardLog,
+			now: time.Now,
+			redact: func(room string, eventID id.EventID) error {
+				return matrix.RedactEvent(matrixConnection, room, eventID, retentionReason)
+			},
+		}
+		background.Go(func() { expiry.Run(loops) })
+	}
+	if config.Configuration.Reconcile.Interval > 0 {
+		lookback := config.Configuration.Reconcile.Lookback
+		if lookback == 0 {
+			lookback = defaultReconcileLookback
+		}
+		messageForwarder.forwardLog.maxAge = max(messageForwarder.forwardLog.maxAge, lookback)
+		messageReconciler := &reconciler{
+			log:        messageForwarder.forwardLog,
+			lookback:   lookback,
+			now:        time.Now,
+			messageIDs: gotify_messages.GetMessageIDs,
+			redact: func(room string, eventID id.EventID) error {
+				return matrix.RedactEvent(matrixConnection, room, eventID, redactionReason)
+			},
+		}
+		background.Go(func() { messageReconciler.Run(loops, config.Configuration.Reconcile.Interval) })
+	} else if messageForwarder.forwardLog != nil {
+		background.Go(func() { messageForwarder.forwardLog.Run(loops) })
+	}
+
+	if config.Configuration.Digest.Threshold > 0 && config.Configuration.Digest.Window > 0 {
+		messageForwarder.digest = newDigester(
+			config.Configuration.Digest.Threshold,
+			config.Configuration.Digest.Window,
+			messageForwarder.sendDigest,
 		)
+	}
+
+	if replacer.Enabled() {
+		messageForwarder.replacer = replacer
+		messageForwarder.replacements = &replacements{store: store}
+	}
+
+	if correlator.Enabled() {
+		messageForwarder.correlator = correlator
+		messageForwarder.incidents = newIncidents(store)
+		messageForwarder.replyToIncidents = config.Configuration.Correlation.Mode == "reply"
+	}
+
+	if config.Configuration.Acknowledge.MinPriority > 0 {
+		messageForwarder.acks = &acks{
+			settings: config.Configuration.Acknowledge,
+			store:    store,
+			now:      time.Now,
+			remind: func(room string, replyTo id.EventID, markdown string) id.EventID {
+				return matrix.SendReplyMessage(matrixConnection, room, replyTo, markdown)
+			},
+			edit: func(room string, eventID id.EventID, markdown string) error {
+				return matrix.EditMessage(matrixConnection, room, eventID, markdown)
+			},
+		}
+		matrix.OnRoomEvent(matrixConnection, messageForwarder.acks.HandleEvent)
+		background.Go(func() { messageForwarder.acks.Run(loops) })
+	}
+
+	if config.Configuration.Commands.Enabled {
+		var sender *gotifySender
+		if len(config.Configuration.GotifySend.Applications) > 0 {
+			sender = &gotifySender{
+				applications: config.Configuration.GotifySend.Applications,
+				watchRooms:   config.Configuration.GotifySend.WatchRooms,
+				allowedUsers: config.Configuration.Commands.AllowedUsers,
+				appToken: func(appId int64) string {
+					app, _ := applications.Get(appId)
+					return app.Token
+				},
+				post: gotify_messages.SendMessage,
+				react: func(room string, eventID id.EventID, key string) error {
+					return matrix.SendReaction(matrixConnection, room, eventID, key)
+				},
+				reply: func(room string, markdown string) {
+					matrix.SendNotice(matrixConnection, room, markdown)
+				},
+			}
+			matrix.OnRoomEvent(matrixConnection, sender.HandleEvent)
+			messageForwarder.sender = sender
+		}
+		if config.Configuration.GotifyDelete.Reaction != "" {
+			deleter := &gotifyDeleter{
+				reaction:     config.Configuration.GotifyDelete.Reaction,
+				allowedUsers: config.Configuration.Commands.AllowedUsers,
+				log:          messageForwarder.forwardLog,
+				delete:       gotify_messages.DeleteMessage,
+				react: func(room string, eventID id.EventID, key string) error {
+					return matrix.SendReaction(matrixConnection, room, eventID, key)
+				},
+			}
+			matrix.OnRoomEvent(matrixConnection, deleter.HandleEvent)
+		}
+		botCommands := &commands{
+			allowedUsers: config.Configuration.Commands.AllowedUsers,
+			applications: applications,
+			mutes:        messageForwarder.mutes,
+			history:      messageForwarder.history,
+			sender:       sender,
+			pipeline:     messagePipeline,
+			startedAt:    startedAt,
+			matrixSince:  matrixConnection.ConnectedAt,
+			gotifySince:  gotify_messages.ConnectedSince,
+			now:          time.Now,
+			reply: func(room string, markdown string) {
+				matrix.SendNotice(matrixConnection, room, markdown)
+			},
+		}
+		matrix.OnRoomEvent(matrixConnection, botCommands.HandleEvent)
+	}
+
+	if config.Configuration.Threads.Enabled {
+		messageForwarder.threads = newThreads(config.Configuration.Threads.Period, store, matrixConnection)
+	}
+
+	if router.UsesQuietHours() {
+		quietHoursFor := func(target string) *routing.QuietHours {
+			return messageForwarder.rules.Load().router.QuietHoursFor(target)
+		}
+		messageForwarder.quietQueue = newQuietQueue(store, quietHoursFor, messageForwarder.sendQuietHoursDigest)
+		background.Go(func() { messageForwarder.quietQueue.Run(loops) })
+	}
+
+	// Started once the forwarder is complete, as it records the events of
+	// queued messages.
+	matrixConnection.Outbox.OnDelivered = messageForwarder.Delivered
+	background.Go(func() { matrixConnection.Outbox.Run(loops, matrixConnection) })
+
+	configReloader := &reloader{
+		current:    config.Configuration,
+		forwarder:  messageForwarder,
+		matrix:     matrixConnection,
+		replacer:   replacer,
+		correlator: correlator,
+		store:      store,
+		quietHours: router.UsesQuietHours(),
+		retention:  router.UsesRetention(),
+		read:       config.ReadConfig,
+	}
+	background.Go(func() { configReloader.Run(loops, hangup) })
+
+	messagePipeline.Start()
+	background.Go(func() { messagePipeline.logStats(loops, config.Configuration.Pipeline.StatsInterval) })
+	messagePipeline.Restore()
+	gotifyDone := gotify_messages.OnNewMessage(ctx, messagePipeline.Ingest)
+
+	<-ctx.Done()
+	log.Info().Msg("Shutting down...")
+	gracePeriod := config.Configuration.Shutdown.GracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = defaultShutdownGracePeriod
+	}
+	deadline := time.Now().Add(gracePeriod)
+	// Messages which still arrive are stored in the backlog.
+	messagePipeline.StopIngest()
+	select {
+	case <-gotifyDone:
+	case <-time.After(time.Until(deadline)):
+		log.Warn().Msg("The connection to gotify did not close in time")
+	}
+	messagePipeline.Shutdown(time.Until(deadline))
+	if messageForwarder.digest != nil {
+		messageForwarder.digest.FlushAll()
+	}
+	stopLoops()
+	background.Wait()
+	matrix.Disconnect(matrixConnection)
+	if err := store.Close(); err != nil {
+		log.Error().Err(err).Msg("Could not close state store")
+	}
+	log.Info().Msg("Shutdown complete.")
+}
+
+const defaultFilterStatsInterval = time.Hour
+
+// logFilterStats periodically logs how many messages each filter rule dropped.
+func logFilterStats(ctx context.Context, filter func() *routing.Filter, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultFilterStatsInterval
+	}
+	every(ctx, interval, func() {
+		for name, count := range filter().TakeDropCounts() {
+			log.Info().Msgf("Filter rule %s dropped %d messages in the last %s", name, count, interval)
+		}
 	})
-	select {}
+}
+
+// every calls f once per interval until ctx is cancelled.
+func every(ctx context.Context, interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f()
+		}
+	}
 }
@@ -0,0 +1,69 @@
+package bot
+
+import (
+	"gotify_matrix_bot/state"
+	"strconv"
+	"time"
+)
+
+const mutesNamespace = "mutes"
+
+// mutes keeps track of muted applications. A mute either lasts until a given
+// time, or until the application is unmuted.
+type mutes struct {
+	store *state.Store
+	now   func() time.Time
+}
+
+func (m *mutes) Mute(appId int64, until time.Time) error {
+	var value string
+	if !until.IsZero() {
+		value = until.Format(time.RFC3339)
+	}
+	return m.store.Set(mutesNamespace, strconv.FormatInt(appId, 10), value)
+}
+
+func (m *mutes) Unmute(appId int64) error {
+	return m.store.Delete(mutesNamespace, strconv.FormatInt(appId, 10))
+}
+
+// Muted returns true if the application is muted. Expired mutes are removed.
+func (m *mutes) Muted(appId int64) (bool, error) {
+	key := strconv.FormatInt(appId, 10)
+	value, found, err := m.store.Get(mutesNamespace, key)
+	if err != nil || !found {
+		return false, err
+	}
+	if value == "" {
+		return true, nil
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil || !m.now().Before(until) {
+		return false, m.store.Delete(mutesNamespace, key)
+	}
+	return true, nil
+}
+
+// List returns the end of each active mute by application id. The zero time
+// means the mute does not expire.
+func (m *mutes) List() (map[int64]time.Time, error) {
+	entries, err := m.store.List(mutesNamespace)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int64]time.Time, len(entries))
+	for key, value := range entries {
+		appId, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		var until time.Time
+		if value != "" {
+			if until, err = time.Parse(time.RFC3339, value); err != nil || !m.now().Before(until) {
+				continue
+			}
+		}
+		result[appId] = until
+	}
+	return result, nil
+}
@@ -0,0 +1,474 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/state"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultPipelineQueueSize     = 100
+	defaultTransformWorkers      = 1
+	defaultMediaWorkers          = 4
+	defaultDeliverWorkers        = 4
+	defaultPipelineStatsInterval = 10 * time.Minute
+	backlogNamespace             = "backlog"
+	// The end of the grace period, at most this long, is left to deliveries
+	// which already started.
+	maxShutdownDeliveryTime = 30 * time.Second
+)
+
+type pipelineItem struct {
+	seq uint64
+	raw []byte
+	// nil if the message was dropped
+	job *forwardJob
+}
+
+// pipelineStage is the bounded queue in front of a stage. Putting an item
+// into a full queue blocks, which slows down the stages before it down to
+// the websocket connection to gotify.
+type pipelineStage struct {
+	name      string
+	queue     chan *pipelineItem
+	processed atomic.Int64
+	full      atomic.Int64
+	waited    atomic.Int64
+}
+
+func newPipelineStage(name string, size int) *pipelineStage {
+	return &pipelineStage{name: name, queue: make(chan *pipelineItem, size)}
+}
+
+// put waits until there is room in the queue, unless cancel is closed
+// first.
+func (s *pipelineStage) put(item *pipelineItem, cancel <-chan struct{}) {
+	select {
+	case s.queue <- item:
+		return
+	default:
+	}
+	s.full.Add(1)
+	start := time.Now()
+	select {
+	case s.queue <- item:
+	case <-cancel:
+	}
+	s.waited.Add(int64(time.Since(start)))
+}
+
+// stageStats are the counters of a stage since the start.
+type stageStats struct {
+	name      string
+	queued    int
+	processed int64
+	full      int64
+	waited    time.Duration
+}
+
+// pipeline moves messages from gotify to Matrix in stages: ingest from the
+// websocket, transform (parse, filter, format and route), media (upload
+// images) and deliver. Transform and media run in parallel workers; delivery
+// keeps the order in which messages were received for each room, but
+// delivers to different rooms in parallel.
+type pipeline struct {
+	transform func(rawMessage []byte) (*forwardJob, bool)
+	media     func(job *forwardJob)
+	deliver   func(job *forwardJob)
+
+	queueSize        int
+	transformWorkers int
+	mediaWorkers     int
+	deliverWorkers   int
+
+	transformStage *pipelineStage
+	mediaStage     *pipelineStage
+	deliverStage   *pipelineStage
+	// Items taken from the deliver queue which wait for their turn.
+	pending atomic.Int64
+	nextSeq atomic.Uint64
+
+	// Messages whose delivery has not started yet, by sequence number.
+	unfinishedMutex sync.Mutex
+	unfinished      map[uint64][]byte
+	// Set once no more deliveries may start.
+	stopped bool
+	// Keeps unfinished messages across a shutdown. Optional.
+	backlog *state.Store
+
+	// Ingest holds a read lock while it queues a message.
+	ingestMutex    sync.RWMutex
+	ingestClosed   bool
+	stopIngestOnce sync.Once
+	ingestStopped  chan struct{}
+
+	transformWorkersDone sync.WaitGroup
+	mediaWorkersDone     sync.WaitGroup
+	// Closed when the grace period of the shutdown has ended.
+	stop    chan struct{}
+	drained chan struct{}
+}
+
+func newPipeline(settings config.PipelineType, transform func([]byte) (*forwardJob, bool), media func(*forwardJob), deliver func(*forwardJob)) *pipeline {
+	p := &pipeline{
+		transform:        transform,
+		media:            media,
+		deliver:          deliver,
+		queueSize:        orDefault(settings.QueueSize, defaultPipelineQueueSize),
+		transformWorkers: orDefault(settings.TransformWorkers, defaultTransformWorkers),
+		mediaWorkers:     orDefault(settings.MediaWorkers, defaultMediaWorkers),
+		deliverWorkers:   orDefault(settings.DeliverWorkers, defaultDeliverWorkers),
+		unfinished:       make(map[uint64][]byte),
+		ingestStopped:    make(chan struct{}),
+		stop:             make(chan struct{}),
+		drained:          make(chan struct{}),
+	}
+	p.transformStage = newPipelineStage("transform", p.queueSize)
+	p.mediaStage = newPipelineStage("media", p.queueSize)
+	p.deliverStage = newPipelineStage("deliver", p.queueSize)
+	return p
+}
+
+func orDefault(value int, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// Start starts the workers of all stages.
+func (p *pipeline) Start() {
+	p.transformWorkersDone.Add(p.transformWorkers)
+	for range p.transformWorkers {
+		go p.runTransform()
+	}
+	p.mediaWorkersDone.Add(p.mediaWorkers)
+	for range p.mediaWorkers {
+		go p.runMedia()
+	}
+	go p.runDeliver()
+
+	// Each stage ends once the stage before it has ended and its queue is empty.
+	go func() {
+		p.transformWorkersDone.Wait()
+		close(p.mediaStage.queue)
+		p.mediaWorkersDone.Wait()
+		close(p.deliverStage.queue)
+	}()
+}
+
+// Ingest queues a message received from gotify. It blocks while the
+// transform queue is full, until StopIngest is called.
+func (p *pipeline) Ingest(rawMessage []byte) {
+	seq := p.nextSeq.Add(1) - 1
+	p.unfinishedMutex.Lock()
+	p.unfinished[seq] = rawMessage
+	p.unfinishedMutex.Unlock()
+
+	p.ingestMutex.RLock()
+	defer p.ingestMutex.RUnlock()
+	if p.ingestClosed {
+		// Kept for the backlog
+		return
+	}
+	p.transformStage.put(&pipelineItem{seq: seq, raw: rawMessage}, p.ingestStopped)
+}
+
+// StopIngest stops queueing messages. Messages which are ingested later, or
+// which are still waiting for room in the transform queue, are stored in the
+// backlog at shutdown.
+func (p *pipeline) StopIngest() {
+	p.stopIngestOnce.Do(func() {
+		close(p.ingestStopped)
+		p.ingestMutex.Lock()
+		defer p.ingestMutex.Unlock()
+		p.ingestClosed = true
+		close(p.transformStage.queue)
+	})
+}
+
+// Shutdown stops accepting messages and waits until all queued messages are
+// delivered. When a quarter of the grace period is left, at most
+// maxShutdownDeliveryTime, no further deliveries are started; Shutdown waits
+// for the running ones until the grace period ends, and stores the other
+// messages in the backlog, to be processed after the next start.
+func (p *pipeline) Shutdown(gracePeriod time.Duration) {
+	deadline := time.Now().Add(gracePeriod)
+	p.StopIngest()
+	select {
+	case <-p.drained:
+		log.Info().Msg("All queued messages were delivered")
+	case <-time.After(gracePeriod - min(gracePeriod/4, maxShutdownDeliveryTime)):
+		p.unfinishedMutex.Lock()
+		p.stopped = true
+		p.unfinishedMutex.Unlock()
+		close(p.stop)
+		select {
+		case <-p.drained:
+		case <-time.After(time.Until(deadline)):
+			log.Warn().Msg("Deliveries did not finish in time")
+		}
+	}
+	p.saveBacklog()
+}
+
+func (p *pipeline) saveBacklog() {
+	p.unfinishedMutex.Lock()
+	defer p.unfinishedMutex.Unlock()
+
+	if len(p.unfinished) == 0 {
+		return
+	}
+	if p.backlog == nil {
+		log.Warn().Msgf("Shutdown grace period ended, %d queued messages are lost", len(p.unfinished))
+		return
+	}
+	saved := 0
+	for seq, rawMessage := range p.unfinished {
+		if err := p.backlog.Set(backlogNamespace, fmt.Sprintf("%020d", seq), string(rawMessage)); err != nil {
+			log.Error().Err(err).Msg("Could not store queued message in the backlog")
+			continue
+		}
+		saved++
+	}
+	log.Warn().Msgf("%d queued messages were stored for the next start", saved)
+}
+
+// Restore queues the messages stored in the backlog at the last shutdown.
+func (p *pipeline) Restore() {
+	if p.backlog == nil {
+		return
+	}
+	entries, err := p.backlog.List(backlogNamespace)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read the backlog")
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	log.Info().Msgf("Processing %d messages stored at the last shutdown", len(keys))
+	for _, key := range keys {
+		p.Ingest([]byte(entries[key]))
+		if err := p.backlog.Delete(backlogNamespace, key); err != nil {
+			log.Error().Err(err).Msgf("Could not remove message %s from the backlog", key)
+		}
+	}
+}
+
+// started marks a message whose delivery has started, or which was dropped.
+// Returns false if no deliveries may start anymore; the message is then
+// kept for the backlog.
+func (p *pipeline) started(seq uint64) bool {
+	p.unfinishedMutex.Lock()
+	defer p.unfinishedMutex.Unlock()
+	if p.stopped {
+		return false
+	}
+	delete(p.unfinished, seq)
+	return true
+}
+
+func (p *pipeline) isStopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// runTransform and runMedia skip the remaining messages once the grace
+// period has ended, as they are kept for the backlog.
+func (p *pipeline) runTransform() {
+	defer p.transformWorkersDone.Done()
+	for item := range p.transformStage.queue {
+		if p.isStopped() {
+			continue
+		}
+		if job, ok := p.transform(item.raw); ok {
+			item.job = job
+		}
+		item.raw = nil
+		p.transformStage.processed.Add(1)
+		p.mediaStage.put(item, p.stop)
+	}
+}
+
+func (p *pipeline) runMedia() {
+	defer p.mediaWorkersDone.Done()
+	for item := range p.mediaStage.queue {
+		if p.isStopped() {
+			continue
+		}
+		if item.job != nil {
+			p.media(item.job)
+		}
+		p.mediaStage.processed.Add(1)
+		p.deliverStage.put(item, p.stop)
+	}
+}
+
+// runDeliver restores the order in which messages were received, and starts
+// the delivery of a message once a worker is free and no earlier message
+// for one of its rooms is still waiting or being delivered.
+func (p *pipeline) runDeliver() {
+	var nextSeq uint64
+	reorder := make(map[uint64]*pipelineItem)
+	var pending []*pipelineItem
+	busy := make(map[string]int)
+	running := 0
+	done := make(chan *pipelineItem)
+	inputClosed := false
+	stop := p.stop
+	stopped := false
+
+	for {
+		if running == 0 && (stopped || inputClosed && len(pending) == 0) {
+			close(p.drained)
+			return
+		}
+		input := p.deliverStage.queue
+		if inputClosed || stopped || len(pending) >= p.queueSize {
+			input = nil
+		}
+		select {
+		case <-stop:
+			stopped = true
+			stop = nil
+		case item, ok := <-input:
+			if !ok {
+				inputClosed = true
+				break
+			}
+			reorder[item.seq] = item
+			for {
+				next, found := reorder[nextSeq]
+				if !found {
+					break
+				}
+				delete(reorder, nextSeq)
+				nextSeq++
+				if next.job == nil {
+					if p.started(next.seq) {
+						p.deliverStage.processed.Add(1)
+					}
+				} else {
+					pending = append(pending, next)
+				}
+			}
+		case item := <-done:
+			running--
+			for _, room := range orderingKeys(item.job) {
+				if busy[room]--; busy[room] == 0 {
+					delete(busy, room)
+				}
+			}
+			p.deliverStage.processed.Add(1)
+		}
+
+		blocked := make(map[string]bool)
+		waiting := pending[:0]
+		for _, item := range pending {
+			rooms := orderingKeys(item.job)
+			startable := running < p.deliverWorkers
+			for _, room := range rooms {
+				if busy[room] > 0 || blocked[room] {
+					startable = false
+				}
+			}
+			if !startable || !p.started(item.seq) {
+				for _, room := range rooms {
+					blocked[room] = true
+				}
+				waiting = append(waiting, item)
+				continue
+			}
+			for _, room := range rooms {
+				busy[room]++
+			}
+			running++
+			go func() {
+				p.deliver(item.job)
+				done <- item
+			}()
+		}
+		pending = waiting
+		p.pending.Store(int64(len(pending)))
+	}
+}
+
+// orderingKeys are the rooms whose order a job must keep.
+func orderingKeys(job *forwardJob) []string {
+	keys := make([]string, 0, len(job.destinations))
+	for _, destination := range job.destinations {
+		keys = append(keys, destination.Target)
+	}
+	return keys
+}
+
+// Stats returns the counters of all stages.
+func (p *pipeline) Stats() []stageStats {
+	var result []stageStats
+	for _, stage := range []*pipelineStage{p.transformStage, p.mediaStage, p.deliverStage} {
+		queued := len(stage.queue)
+		if stage == p.deliverStage {
+			queued += int(p.pending.Load())
+		}
+		result = append(result, stageStats{
+			name:      stage.name,
+			queued:    queued,
+			processed: stage.processed.Load(),
+			full:      stage.full.Load(),
+			waited:    time.Duration(stage.waited.Load()),
+		})
+	}
+	return result
+}
+
+// Queued returns a short summary of the queue lengths.
+func (p *pipeline) Queued() string {
+	var parts []string
+	for _, stats := range p.Stats() {
+		parts = append(parts, fmt.Sprintf("%s %d", stats.name, stats.queued))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// logStats periodically logs the throughput of the pipeline, and warns when
+// a stage could not keep up.
+func (p *pipeline) logStats(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultPipelineStatsInterval
+	}
+	previous := p.Stats()
+	every(ctx, interval, func() {
+		current := p.Stats()
+		for idx, stats := range current {
+			processed := stats.processed - previous[idx].processed
+			full := stats.full - previous[idx].full
+			if processed == 0 && full == 0 {
+				continue
+			}
+			log.Info().Msgf("Pipeline stage %s processed %d messages in the last %s, %d queued", stats.name, processed, interval, stats.queued)
+			if full > 0 {
+				log.Warn().Msgf("Queue of pipeline stage %s was full %d times in the last %s, waiting %s; consider more workers",
+					stats.name, full, interval, (stats.waited - previous[idx].waited).Round(time.Millisecond))
+			}
+		}
+		previous = current
+	})
+}
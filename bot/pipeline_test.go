@@ -0,0 +1,238 @@
+package bot
+
+import (
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// testJob parses messages of the form "room1,room2 text"; "drop" is dropped.
+func testJob(rawMessage []byte) (*forwardJob, bool) {
+	rooms, text, _ := strings.Cut(string(rawMessage), " ")
+	if rooms == "drop" {
+		return nil, false
+	}
+	job := &forwardJob{markdown: text}
+	for _, room := range strings.Split(rooms, ",") {
+		job.destinations = append(job.destinations, routing.Destination{Target: room})
+	}
+	return job, true
+}
+
+func TestPipelineKeepsOrderPerRoom(t *testing.T) {
+	var mutex sync.Mutex
+	delivered := make(map[string][]string)
+	var wg sync.WaitGroup
+
+	p := newPipeline(config.PipelineType{MediaWorkers: 4, DeliverWorkers: 4}, testJob,
+		func(job *forwardJob) {
+			// Earlier messages take longer, so they finish media last.
+			if job.markdown == "1" {
+				time.Sleep(20 * time.Millisecond)
+			}
+		},
+		func(job *forwardJob) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, destination := range job.destinations {
+				delivered[destination.Target] = append(delivered[destination.Target], job.markdown)
+			}
+			wg.Done()
+		})
+	p.Start()
+
+	wg.Add(4)
+	p.Ingest([]byte("!a 1"))
+	p.Ingest([]byte("drop 2"))
+	p.Ingest([]byte("!a,!b 3"))
+	p.Ingest([]byte("!b 4"))
+	p.Ingest([]byte("!c 5"))
+	wg.Wait()
+
+	assert.DeepEqual(t, delivered, map[string][]string{
+		"!a": {"1", "3"},
+		"!b": {"3", "4"},
+		"!c": {"5"},
+	})
+}
+
+func TestPipelineDeliversRoomsInParallel(t *testing.T) {
+	releaseA := make(chan struct{})
+	deliveredB := make(chan struct{})
+	p := newPipeline(config.PipelineType{DeliverWorkers: 2}, testJob,
+		func(*forwardJob) {},
+		func(job *forwardJob) {
+			switch job.destinations[0].Target {
+			case "!a":
+				<-releaseA
+			case "!b":
+				close(deliveredB)
+			}
+		})
+	p.Start()
+
+	p.Ingest([]byte("!a slow"))
+	p.Ingest([]byte("!b fast"))
+	select {
+	case <-deliveredB:
+	case <-time.After(time.Second):
+		t.Fatal("message for !b waited for !a")
+	}
+	close(releaseA)
+}
+
+func TestPipelineStats(t *testing.T) {
+	release := make(chan struct{})
+	p := newPipeline(config.PipelineType{QueueSize: 1, MediaWorkers: 1, DeliverWorkers: 1}, testJob,
+		func(*forwardJob) {},
+		func(*forwardJob) { <-release })
+	p.Start()
+
+	// While the first message is delivered, one message waits for the room,
+	// each worker holds one and each queue is full, so the last one blocks.
+	ingested := make(chan struct{})
+	go func() {
+		for range 8 {
+			p.Ingest([]byte("!a text"))
+		}
+		close(ingested)
+	}()
+	assert.Assert(t, waitFor(func() bool { return p.Queued() == "transform 1, media 1, deliver 2" }))
+	assert.Assert(t, waitFor(func() bool { return p.Stats()[0].full > 0 }))
+
+	close(release)
+	<-ingested
+	assert.Assert(t, waitFor(func() bool { return p.Stats()[2].processed == 8 }))
+	assert.Equal(t, p.Queued(), "transform 0, media 0, deliver 0")
+	assert.Assert(t, p.Stats()[0].waited > 0)
+}
+
+func waitFor(condition func() bool) bool {
+	for range 100 {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPipelineShutdown(t *testing.T) {
+	t.Run("Queued messages are delivered", func(t *testing.T) {
+		var delivered []string
+		p := newPipeline(config.PipelineType{DeliverWorkers: 1}, testJob,
+			func(*forwardJob) { time.Sleep(time.Millisecond) },
+			func(job *forwardJob) { delivered = append(delivered, job.markdown) })
+		p.Start()
+		p.Ingest([]byte("!a 1"))
+		p.Ingest([]byte("drop 2"))
+		p.Ingest([]byte("!a 3"))
+
+		p.Shutdown(time.Second)
+
+		assert.DeepEqual(t, delivered, []string{"1", "3"})
+	})
+
+	t.Run("Undelivered messages are kept for the next start", func(t *testing.T) {
+		store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+		assert.NilError(t, err)
+		t.Cleanup(func() { store.Close() })
+
+		release := make(chan struct{})
+		var delivered []string
+		var mutex sync.Mutex
+		p := newPipeline(config.PipelineType{}, testJob,
+			func(*forwardJob) {},
+			func(job *forwardJob) {
+				<-release
+				mutex.Lock()
+				defer mutex.Unlock()
+				delivered = append(delivered, job.markdown)
+			})
+		p.backlog = store
+		p.Start()
+		p.Ingest([]byte("!a stuck"))
+		p.Ingest([]byte("!a waiting"))
+		p.Ingest([]byte("!b stuck"))
+		assert.Assert(t, waitFor(func() bool { return p.Queued() == "transform 0, media 0, deliver 1" }))
+
+		// Deliveries which started are finished within the grace period, the
+		// waiting message is not delivered anymore.
+		time.AfterFunc(175*time.Millisecond, func() { close(release) })
+		p.Shutdown(200 * time.Millisecond)
+		assert.DeepEqual(t, delivered, []string{"stuck", "stuck"})
+
+		delivered = nil
+		restarted := newPipeline(config.PipelineType{}, testJob,
+			func(*forwardJob) {},
+			func(job *forwardJob) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				delivered = append(delivered, job.markdown)
+			})
+		restarted.backlog = store
+		restarted.Start()
+		restarted.Restore()
+		restarted.Shutdown(time.Second)
+		assert.DeepEqual(t, delivered, []string{"waiting"})
+
+		backlog, err := store.List(backlogNamespace)
+		assert.NilError(t, err)
+		assert.Equal(t, len(backlog), 0)
+	})
+
+	t.Run("Shutdown ends with the grace period", func(t *testing.T) {
+		release := make(chan struct{})
+		t.Cleanup(func() { close(release) })
+		p := newPipeline(config.PipelineType{}, testJob,
+			func(*forwardJob) {},
+			func(*forwardJob) { <-release })
+		p.Start()
+		p.Ingest([]byte("!a stuck"))
+		assert.Assert(t, waitFor(func() bool { return p.Queued() == "transform 0, media 0, deliver 0" }))
+
+		started := time.Now()
+		p.Shutdown(100 * time.Millisecond)
+		assert.Assert(t, time.Since(started) < 150*time.Millisecond)
+	})
+
+	t.Run("Ingest does not block after StopIngest", func(t *testing.T) {
+		store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+		assert.NilError(t, err)
+		t.Cleanup(func() { store.Close() })
+
+		release := make(chan struct{})
+		p := newPipeline(config.PipelineType{QueueSize: 1}, func(rawMessage []byte) (*forwardJob, bool) {
+			<-release
+			return testJob(rawMessage)
+		}, func(*forwardJob) {}, func(*forwardJob) {})
+		p.backlog = store
+		p.Start()
+		p.Ingest([]byte("!a 1"))
+		p.Ingest([]byte("!a 2"))
+		ingested := make(chan struct{})
+		go func() {
+			// Waits for room in the transform queue.
+			p.Ingest([]byte("!a 3"))
+			p.Ingest([]byte("!a 4"))
+			close(ingested)
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		p.StopIngest()
+		<-ingested
+		close(release)
+		p.Shutdown(time.Second)
+
+		backlog, err := store.List(backlogNamespace)
+		assert.NilError(t, err)
+		assert.Equal(t, len(backlog), 2)
+	})
+}
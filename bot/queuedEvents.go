@@ -0,0 +1,64 @@
+package bot
+
+import (
+	"encoding/json"
+	"gotify_matrix_bot/state"
+	"time"
+)
+
+const queuedEventsNamespace = "queuedEvents"
+
+// delivery is what is remembered about a message once its events are sent,
+// so that it can be deleted, replaced, resolved or acknowledged later.
+type delivery struct {
+	MessageID   int64  `json:"messageID"`
+	ReplaceKey  string `json:"replaceKey,omitempty"`
+	IncidentKey string `json:"incidentKey,omitempty"`
+	Acknowledge bool   `json:"acknowledge,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Markdown    string `json:"markdown"`
+}
+
+// queuedEvent is a message to a room which waits in the outbox.
+type queuedEvent struct {
+	TransactionID string        `json:"-"`
+	Room          string        `json:"room"`
+	Retention     time.Duration `json:"retention,omitempty"`
+	Delivery      delivery      `json:"delivery"`
+}
+
+// queuedEvents remembers the messages which wait in the outbox, until the
+// outbox has sent them and their events can be recorded.
+type queuedEvents struct {
+	store *state.Store
+}
+
+func (q *queuedEvents) Add(events []queuedEvent, delivered delivery) error {
+	for _, queued := range events {
+		queued.Delivery = delivered
+		data, err := json.Marshal(queued)
+		if err != nil {
+			return err
+		}
+		if err := q.store.Set(queuedEventsNamespace, queued.TransactionID, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Take returns and forgets the queued message with the transaction ID.
+func (q *queuedEvents) Take(transactionID string) (queuedEvent, bool, error) {
+	value, found, err := q.store.Get(queuedEventsNamespace, transactionID)
+	if err != nil || !found {
+		return queuedEvent{}, false, err
+	}
+	if err := q.store.Delete(queuedEventsNamespace, transactionID); err != nil {
+		return queuedEvent{}, false, err
+	}
+	queued := queuedEvent{TransactionID: transactionID}
+	if err := json.Unmarshal([]byte(value), &queued); err != nil {
+		return queuedEvent{}, false, err
+	}
+	return queued, true, nil
+}
@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/state"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	quietQueueNamespace = "quietQueue"
+	quietQueueInterval  = time.Minute
+)
+
+type queuedMessage struct {
+	AppName string `json:"appName"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+}
+
+// quietQueue persists messages held during quiet hours, and delivers them as
+// a digest once the quiet hours of their target have ended.
+type quietQueue struct {
+	mutex         sync.Mutex
+	store         *state.Store
+	quietHoursFor func(target string) *routing.QuietHours
+	deliver       func(target string, messages []digestMessage)
+	now           func() time.Time
+	sequence      int
+}
+
+func newQuietQueue(store *state.Store, quietHoursFor func(target string) *routing.QuietHours, deliver func(target string, messages []digestMessage)) *quietQueue {
+	return &quietQueue{
+		store:         store,
+		quietHoursFor: quietHoursFor,
+		deliver:       deliver,
+		now:           time.Now,
+	}
+}
+
+// Hold queues the message if its destination is in quiet hours and the
+// message priority does not bypass them. Returns true if it was queued.
+func (q *quietQueue) Hold(destination routing.Destination, message digestMessage) bool {
+	quietHours := destination.QuietHours
+	if quietHours == nil || quietHours.Bypass(message.priority) || !quietHours.IsQuiet(q.now()) {
+		return false
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	data, err := json.Marshal(queuedMessage{AppName: message.appName, Title: message.title, Message: message.markdown})
+	if err != nil {
+		log.Error().Err(err).Msg("Could not serialize message for quiet hours")
+		return false
+	}
+	// Keys sort by target, then by time of arrival.
+	q.sequence++
+	key := fmt.Sprintf("%s %020d %06d", destination.Target, q.now().UnixNano(), q.sequence)
+	if err := q.store.Set(quietQueueNamespace, key, string(data)); err != nil {
+		log.Error().Err(err).Msg("Could not queue message for quiet hours")
+		return false
+	}
+	return true
+}
+
+// FlushDue delivers the queued messages of all targets which are no longer
+// in quiet hours.
+func (q *quietQueue) FlushDue() {
+	q.mutex.Lock()
+	entries, err := q.store.List(quietQueueNamespace)
+	if err != nil {
+		q.mutex.Unlock()
+		log.Error().Err(err).Msg("Could not read quiet hours queue")
+		return
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	due := make(map[string][]digestMessage)
+	var targets []string
+	now := q.now()
+	for _, key := range keys {
+		target, _, _ := strings.Cut(key, " ")
+		if quietHours := q.quietHoursFor(target); quietHours != nil && quietHours.IsQuiet(now) {
+			continue
+		}
+		var queued queuedMessage
+		if err := json.Unmarshal([]byte(entries[key]), &queued); err != nil {
+			log.Error().Err(err).Msgf("Dropping invalid queued message %s", key)
+		} else {
+			if _, ok := due[target]; !ok {
+				targets = append(targets, target)
+			}
+			due[target] = append(due[target], digestMessage{appName: queued.AppName, title: queued.Title, markdown: queued.Message})
+		}
+		if err := q.store.Delete(quietQueueNamespace, key); err != nil {
+			log.Error().Err(err).Msgf("Could not remove queued message %s", key)
+		}
+	}
+	q.mutex.Unlock()
+
+	for _, target := range targets {
+		q.deliver(target, due[target])
+	}
+}
+
+func (q *quietQueue) Run(ctx context.Context) {
+	q.FlushDue()
+	every(ctx, quietQueueInterval, q.FlushDue)
+}
@@ -0,0 +1,61 @@
+package bot
+
+import (
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestQuietQueue(t *testing.T) {
+	router, err := routing.NewRouter(config.RoutingType{
+		DefaultQuietHours: &config.QuietHoursType{Start: "22:00", End: "07:00", Timezone: "UTC", BypassPriority: 8},
+	}, "!room")
+	assert.NilError(t, err)
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	var delivered map[string][]digestMessage
+	deliver := func(target string, messages []digestMessage) {
+		delivered[target] = messages
+	}
+	newQueue := func(now time.Time) *quietQueue {
+		delivered = make(map[string][]digestMessage)
+		q := newQuietQueue(store, router.QuietHoursFor, deliver)
+		q.now = func() time.Time { return now }
+		return q
+	}
+	destination := routing.Destination{Target: "!room", QuietHours: router.DefaultQuietHours()}
+	night := time.Date(2025, 3, 1, 23, 0, 0, 0, time.UTC)
+	morning := time.Date(2025, 3, 2, 7, 30, 0, 0, time.UTC)
+
+	q := newQueue(night)
+	assert.Assert(t, q.Hold(destination, digestMessage{title: "1", priority: 2}))
+	assert.Assert(t, q.Hold(destination, digestMessage{title: "2", priority: 5}))
+	// High priority messages bypass quiet hours.
+	assert.Assert(t, !q.Hold(destination, digestMessage{title: "urgent", priority: 8}))
+	// Destinations without quiet hours are never held.
+	assert.Assert(t, !q.Hold(routing.Destination{Target: "!other"}, digestMessage{title: "3"}))
+
+	q.FlushDue()
+	assert.Equal(t, len(delivered), 0)
+
+	// The queue is persistent, so a new queue delivers the messages.
+	q = newQueue(morning)
+	assert.Assert(t, !q.Hold(destination, digestMessage{title: "4"}))
+	q.FlushDue()
+	assert.Equal(t, len(delivered["!room"]), 2)
+	assert.Equal(t, delivered["!room"][0].title, "1")
+	assert.Equal(t, delivered["!room"][1].title, "2")
+
+	q.FlushDue()
+	assert.Equal(t, len(delivered["!room"]), 2)
+	entries, err := store.List(quietQueueNamespace)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
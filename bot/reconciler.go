@@ -0,0 +1,74 @@
+package bot
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	defaultReconcileLookback = 24 * time.Hour
+	redactionReason          = "Deleted in gotify"
+)
+
+// reconciler redacts the Matrix events of recently forwarded messages which
+// were deleted in gotify, and prunes older messages from the forward log.
+type reconciler struct {
+	log        *forwardLog
+	lookback   time.Duration
+	now        func() time.Time
+	messageIDs func(minId int64) (map[int64]bool, error)
+	redact     func(room string, eventID id.EventID) error
+}
+
+func (r *reconciler) Reconcile() {
+	if err := r.log.Prune(); err != nil {
+		log.Error().Err(err).Msg("Could not prune the forward log")
+	}
+	recent, err := r.log.Since(r.now().Add(-r.lookback))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read the forward log")
+		return
+	}
+	if len(recent) == 0 {
+		return
+	}
+
+	minId := int64(-1)
+	for messageId := range recent {
+		if minId < 0 || messageId < minId {
+			minId = messageId
+		}
+	}
+	existing, err := r.messageIDs(minId)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list gotify messages")
+		return
+	}
+
+	for messageId, forwarded := range recent {
+		if existing[messageId] {
+			continue
+		}
+		log.Info().Msgf("Gotify message %d was deleted, redacting %d events", messageId, len(forwarded.Events))
+		redacted := true
+		for _, event := range forwarded.Events {
+			if err := r.redact(event.Room, event.EventID); err != nil {
+				log.Error().Err(err).Msgf("Could not redact %s in %s", event.EventID, event.Room)
+				redacted = false
+			}
+		}
+		if !redacted {
+			continue
+		}
+		if err := r.log.Forget(messageId); err != nil {
+			log.Error().Err(err).Msgf("Could not remove gotify message %d from the forward log", messageId)
+		}
+	}
+}
+
+func (r *reconciler) Run(ctx context.Context, interval time.Duration) {
+	every(ctx, interval, r.Reconcile)
+}
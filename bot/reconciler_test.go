@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestReconciler(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	forwarded := &forwardLog{store: store, now: func() time.Time { return now }, maxAge: time.Hour}
+	assert.NilError(t, forwarded.Record(5, []sentEvent{{room: "!room", eventID: "$old"}}))
+	assert.NilError(t, forwarded.Record(6, []sentEvent{{room: "!room", eventID: "$expiring", retention: 3 * time.Hour}}))
+	now = now.Add(2 * time.Hour)
+	assert.NilError(t, forwarded.Record(10, []sentEvent{{room: "!room", eventID: "$kept"}}))
+	assert.NilError(t, forwarded.Record(11, []sentEvent{{room: "!room", eventID: "$a"}, {room: "!other", eventID: "$b"}}))
+
+	var requestedMinId int64
+	var redacted []id.EventID
+	r := &reconciler{
+		log:      forwarded,
+		lookback: time.Hour,
+		now:      func() time.Time { return now },
+		messageIDs: func(minId int64) (map[int64]bool, error) {
+			requestedMinId = minId
+			return map[int64]bool{10: true, 12: true}, nil
+		},
+		redact: func(room string, eventID id.EventID) error {
+			redacted = append(redacted, eventID)
+			return nil
+		},
+	}
+
+	r.Reconcile()
+	// Messages older than the lookback are not checked.
+	assert.Equal(t, requestedMinId, int64(10))
+	assert.DeepEqual(t, redacted, []id.EventID{"$a", "$b"})
+
+	_, found, err := forwarded.MessageFor("!room", "$a")
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+	_, found, err = forwarded.MessageFor("!room", "$kept")
+	assert.NilError(t, err)
+	assert.Assert(t, found)
+
+	// Messages older than the lookback are pruned, unless they wait for
+	// their retention.
+	_, found, err = forwarded.MessageFor("!room", "$old")
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+	_, found, err = forwarded.MessageFor("!room", "$expiring")
+	assert.NilError(t, err)
+	assert.Assert(t, found)
+
+	r.Reconcile()
+	assert.Equal(t, len(redacted), 2)
+}
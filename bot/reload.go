@@ -0,0 +1,153 @@
+package bot
+
+import (
+	"context"
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/state"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// reloader applies changes of config.yaml on SIGHUP. Routing and filter
+// rules, the download allowlist and the log level take effect immediately,
+// along with the space and room retention state which follow the routing;
+// other changes, including the message format, are reported and take effect
+// after a restart. An invalid config is rejected as a whole.
+type reloader struct {
+	// The config in effect
+	current    *config.Config
+	forwarder  *forwarder
+	matrix     *matrix.MatrixState
+	replacer   *routing.Replacer
+	correlator *routing.Correlator
+	store      *state.Store
+	// Whether the features started at startup, which depend on routing.
+	quietHours bool
+	retention  bool
+	read       func() (*config.Config, string, error)
+}
+
+// Run reloads the config on every signal received from hangup, until ctx is
+// cancelled.
+func (r *reloader) Run(ctx context.Context, hangup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			r.Reload()
+		}
+	}
+}
+
+func (r *reloader) Reload() {
+	log.Info().Msg("Reloading config...")
+	newConfig, warn, err := r.read()
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid config, keeping the running config")
+		return
+	}
+	if warn != "" {
+		log.Warn().Msg(warn)
+	}
+
+	// Everything is checked before anything is applied.
+	router, err := routing.NewRouter(newConfig.Routing, r.current.Matrix.RoomID)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid routing rules, keeping the running config")
+		return
+	}
+	filter, err := routing.NewFilter(newConfig.Filtering)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid filter rules, keeping the running config")
+		return
+	}
+	allowlist, err := config.DownloadAllowListAsRegexps(newConfig)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid allow list, keeping the running config")
+		return
+	}
+	level, err := zerolog.ParseLevel(newConfig.Logging.Level)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid log level, keeping the running config")
+		return
+	}
+
+	applied := *r.current
+	var needRestart []string
+	for _, section := range config.ChangedSections(r.current, newConfig) {
+		switch section {
+		case "routing":
+			applied.Routing = newConfig.Routing
+		case "filtering":
+			applied.Filtering = newConfig.Filtering
+			applied.Filtering.StatsInterval = r.current.Filtering.StatsInterval
+		case "downloader":
+			applied.Downloader.AllowedHosts = newConfig.Downloader.AllowedHosts
+		case "logging":
+			applied.Logging.Level = newConfig.Logging.Level
+		case "debug":
+			// Only sets the log level
+			applied.Debug = newConfig.Debug
+		}
+	}
+	needRestart = config.ChangedSections(&applied, newConfig)
+	changed := config.ChangedSections(r.current, &applied)
+	if len(changed) == 0 && len(needRestart) == 0 {
+		log.Info().Msg("Config is unchanged")
+		return
+	}
+
+	if slices.Contains(changed, "routing") || slices.Contains(changed, "filtering") {
+		previous := r.forwarder.rules.Swap(&forwardRules{
+			router:      router,
+			filter:      filter,
+			needAppName: router.UsesAppName() || filter.UsesAppName() || r.replacer.UsesAppName() || r.correlator.UsesAppName(),
+		})
+		// The filter stats cover the time since they were last logged.
+		filter.AddDropCounts(previous.filter.TakeDropCounts())
+		if router.UsesQuietHours() && !r.quietHours {
+			needRestart = append(needRestart, "routing quiet hours")
+		}
+		if router.UsesRetention() && !r.retention {
+			needRestart = append(needRestart, "routing retention")
+		} else if router.UsesRetention() {
+			setRoomRetentions(r.matrix, router)
+		}
+		if r.forwarder.space != nil {
+			r.reconcileSpace(router)
+		}
+	}
+	if !reflect.DeepEqual(applied.Downloader.AllowedHosts, r.current.Downloader.AllowedHosts) {
+		matrix.SetDownloadAllowlist(r.matrix, allowlist)
+	}
+	if applied.Logging.Level != r.current.Logging.Level {
+		zerolog.SetGlobalLevel(level)
+	}
+	r.current = &applied
+
+	if len(changed) > 0 {
+		log.Info().Msgf("Applied changes to %s", strings.Join(changed, ", "))
+	}
+	if len(needRestart) > 0 {
+		log.Warn().Msgf("Changes to %s take effect after a restart", strings.Join(needRestart, ", "))
+	}
+}
+
+func (r *reloader) reconcileSpace(router *routing.Router) {
+	rooms, err := spaceRooms(router, r.store)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read application rooms")
+		return
+	}
+	if err := r.forwarder.space.Reconcile(rooms); err != nil {
+		log.Error().Err(err).Msg("Could not update space")
+	}
+}
@@ -0,0 +1,218 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/petergtz/pegomock/v4"
+	"github.com/rs/zerolog"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestReload(t *testing.T) {
+	previousLevel := zerolog.GlobalLevel()
+	t.Cleanup(func() { zerolog.SetGlobalLevel(previousLevel) })
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	running := &config.Config{
+		Matrix:  config.MatrixType{RoomID: "!default"},
+		Logging: config.LoggingType{Level: "info"},
+		Filtering: config.FilteringType{Rules: []config.FilterRuleType{
+			{Name: "noise", Action: "drop", Match: config.RouteMatchType{AppName: "Noise"}},
+		}},
+	}
+	router, err := routing.NewRouter(running.Routing, running.Matrix.RoomID)
+	assert.NilError(t, err)
+	filter, err := routing.NewFilter(running.Filtering)
+	assert.NilError(t, err)
+	replacer, err := routing.NewReplacer(config.ReplaceType{})
+	assert.NilError(t, err)
+	correlator, err := routing.NewCorrelator(config.CorrelationType{})
+	assert.NilError(t, err)
+	f := &forwarder{}
+	f.rules.Store(&forwardRules{router: router, filter: filter})
+	matrixState := &matrix.MatrixState{}
+
+	var next *config.Config
+	var readErr error
+	r := &reloader{
+		current:    running,
+		forwarder:  f,
+		matrix:     matrixState,
+		replacer:   replacer,
+		correlator: correlator,
+		read: func() (*config.Config, string, error) {
+			return next, "", readErr
+		},
+	}
+	route := func() []string {
+		destinations, _ := f.rules.Load().router.Route(routing.MessageInfo{AppName: "Backup"})
+		var result []string
+		for _, destination := range destinations {
+			result = append(result, destination.Target)
+		}
+		return result
+	}
+
+	t.Run("Invalid config is rejected", func(t *testing.T) {
+		readErr = errors.New("No gotify url specified.")
+		r.Reload()
+		readErr = nil
+
+		next = &config.Config{
+			Matrix:  config.MatrixType{RoomID: "!default"},
+			Logging: config.LoggingType{Level: "debug"},
+			Routing: config.RoutingType{Rules: []config.RouteType{
+				{Match: config.RouteMatchType{Title: "$$$^^("}, Rooms: []string{"!ops"}},
+			}},
+		}
+		r.Reload()
+
+		assert.Equal(t, r.current, running)
+		assert.DeepEqual(t, route(), []string{"!default"})
+		assert.Equal(t, zerolog.GlobalLevel(), zerolog.InfoLevel)
+	})
+
+	t.Run("Changes are applied", func(t *testing.T) {
+		next = &config.Config{
+			Matrix:     config.MatrixType{RoomID: "!default"},
+			Logging:    config.LoggingType{Level: "debug"},
+			Downloader: config.DownloaderType{AllowedHosts: []string{"images\\.example\\.com"}},
+			Routing: config.RoutingType{Rules: []config.RouteType{
+				{Match: config.RouteMatchType{AppName: "Backup"}, Rooms: []string{"!ops"}},
+			}},
+		}
+		assert.Assert(t, !f.rules.Load().filter.Allow(routing.MessageInfo{AppName: "Noise"}))
+		r.Reload()
+
+		assert.DeepEqual(t, route(), []string{"!ops"})
+		assert.DeepEqual(t, f.rules.Load().filter.TakeDropCounts(), map[string]int{"noise": 1})
+		assert.Assert(t, f.rules.Load().needAppName)
+		assert.Equal(t, len(matrixState.DownloadFromHostAllowlist), 1)
+		assert.Equal(t, zerolog.GlobalLevel(), zerolog.DebugLevel)
+		assert.DeepEqual(t, r.current.Routing, next.Routing)
+	})
+
+	t.Run("Other changes are left for a restart", func(t *testing.T) {
+		applied := r.current
+		rules := f.rules.Load()
+		next = &config.Config{
+			Matrix:     config.MatrixType{RoomID: "!other"},
+			Logging:    config.LoggingType{Level: "debug"},
+			Downloader: config.DownloaderType{AllowedHosts: []string{"images\\.example\\.com"}, Timeout: time.Minute},
+			Routing:    applied.Routing,
+		}
+		r.Reload()
+
+		assert.Equal(t, r.current.Matrix.RoomID, "!default")
+		assert.Equal(t, r.current.Downloader.Timeout, time.Duration(0))
+		assert.Equal(t, f.rules.Load(), rules)
+		assert.DeepEqual(t, config.ChangedSections(r.current, next), []string{"matrix", "downloader"})
+	})
+}
+
+func TestReloadReconcilesSpace(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+	mockClient, matrixState := setupMatrixMock(t)
+
+	running := &config.Config{Matrix: config.MatrixType{RoomID: "!default"}}
+	router, err := routing.NewRouter(running.Routing, running.Matrix.RoomID)
+	assert.NilError(t, err)
+	filter, err := routing.NewFilter(running.Filtering)
+	assert.NilError(t, err)
+	replacer, err := routing.NewReplacer(config.ReplaceType{})
+	assert.NilError(t, err)
+	correlator, err := routing.NewCorrelator(config.CorrelationType{})
+	assert.NilError(t, err)
+	assert.NilError(t, store.Set(spaceNamespace, spaceIDKey, "!space"))
+	assert.NilError(t, store.Set(spaceChildrenNamespace, "!default", ""))
+	f := &forwarder{space: &space{store: store, matrix: matrixState}}
+	assert.NilError(t, f.space.Init([]string{"!default"}))
+	f.rules.Store(&forwardRules{router: router, filter: filter})
+
+	next := &config.Config{
+		Matrix:  config.MatrixType{RoomID: "!default"},
+		Routing: config.RoutingType{DefaultRooms: []string{"!ops"}},
+	}
+	r := &reloader{
+		current:    running,
+		forwarder:  f,
+		matrix:     matrixState,
+		replacer:   replacer,
+		correlator: correlator,
+		store:      store,
+		read: func() (*config.Config, string, error) {
+			return next, "", nil
+		},
+	}
+	r.Reload()
+
+	mockClient.VerifyWasCalledOnce().SendStateEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Eq(id.RoomID("!space")),
+		pegomock.Eq(event.StateSpaceChild),
+		pegomock.Eq("!ops"),
+		pegomock.Eq[any](&event.SpaceChildEventContent{Via: []string{"example.com"}}))
+	mockClient.VerifyWasCalledOnce().SendStateEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Eq(id.RoomID("!space")),
+		pegomock.Eq(event.StateSpaceChild),
+		pegomock.Eq("!default"),
+		pegomock.Eq[any](struct{}{}))
+}
+
+func TestReloadSetsRoomRetention(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+	mockClient, matrixState := setupMatrixMock(t)
+
+	running := &config.Config{Matrix: config.MatrixType{RoomID: "!default"}}
+	router, err := routing.NewRouter(running.Routing, running.Matrix.RoomID)
+	assert.NilError(t, err)
+	filter, err := routing.NewFilter(running.Filtering)
+	assert.NilError(t, err)
+	replacer, err := routing.NewReplacer(config.ReplaceType{})
+	assert.NilError(t, err)
+	correlator, err := routing.NewCorrelator(config.CorrelationType{})
+	assert.NilError(t, err)
+	f := &forwarder{}
+	f.rules.Store(&forwardRules{router: router, filter: filter})
+
+	next := &config.Config{
+		Matrix: config.MatrixType{RoomID: "!default"},
+		Routing: config.RoutingType{Rules: []config.RouteType{{
+			Rooms:     []string{"!ops"},
+			Retention: &config.RetentionType{MaxAge: time.Hour, SetRoomState: true},
+		}}},
+	}
+	r := &reloader{
+		current:    running,
+		forwarder:  f,
+		matrix:     matrixState,
+		replacer:   replacer,
+		correlator: correlator,
+		retention:  true,
+		read: func() (*config.Config, string, error) {
+			return next, "", nil
+		},
+	}
+	r.Reload()
+
+	mockClient.VerifyWasCalledOnce().SendStateEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Eq(id.RoomID("!ops")),
+		pegomock.Any[event.Type](),
+		pegomock.Eq(""),
+		pegomock.Any[any]())
+}
@@ -0,0 +1,63 @@
+package bot
+
+import (
+	"encoding/json"
+	"gotify_matrix_bot/state"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const replacementsNamespace = "replaceKeys"
+
+type storedEvent struct {
+	Room      string     `json:"room"`
+	EventID   id.EventID `json:"eventID"`
+	ExpiresAt time.Time  `json:"expiresAt,omitzero"`
+}
+
+// replacements remembers the events sent for each replace key, so that
+// later messages with the same key can edit them, even after a restart.
+type replacements struct {
+	store *state.Store
+}
+
+// Events returns the events sent for a replace key.
+func (r *replacements) Events(key string) ([]sentEvent, bool, error) {
+	value, found, err := r.store.Get(replacementsNamespace, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	var stored []storedEvent
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return nil, false, err
+	}
+	events := make([]sentEvent, 0, len(stored))
+	for _, event := range stored {
+		events = append(events, sentEvent{room: event.Room, eventID: event.EventID})
+	}
+	return events, true, nil
+}
+
+// Remember adds events to a replace key. Events of queued messages are added
+// once they are sent.
+func (r *replacements) Remember(key string, events []sentEvent) error {
+	var stored []storedEvent
+	value, found, err := r.store.Get(replacementsNamespace, key)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			stored = nil
+		}
+	}
+	for _, event := range events {
+		stored = append(stored, storedEvent{Room: event.room, EventID: event.eventID})
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return r.store.Set(replacementsNamespace, key, string(data))
+}
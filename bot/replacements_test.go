@@ -0,0 +1,30 @@
+package bot
+
+import (
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestReplacements(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+	r := &replacements{store: store}
+
+	_, found, err := r.Events("1:deploy")
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+
+	sent := []sentEvent{{room: "!a", eventID: "$1"}, {room: "!b", eventID: "$2"}}
+	assert.NilError(t, r.Remember("1:deploy", sent))
+
+	events, found, err := r.Events("1:deploy")
+	assert.NilError(t, err)
+	assert.Assert(t, found)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0], sent[0])
+	assert.Equal(t, events[1], sent[1])
+}
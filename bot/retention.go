@@ -0,0 +1,73 @@
+package bot
+
+import (
+	"context"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/routing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	retentionCheckInterval = time.Hour
+	retentionReason        = "Retention period ended"
+)
+
+// retention redacts forwarded events once their retention has ended.
+type retention struct {
+	log    *forwardLog
+	now    func() time.Time
+	redact func(room string, eventID id.EventID) error
+}
+
+func (r *retention) Expire() {
+	expired, err := r.log.Expired(r.now())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read the forward log")
+		return
+	}
+	for messageId, events := range expired {
+		for _, event := range events {
+			log.Debug().Msgf("Retention of %s in %s ended, redacting", event.EventID, event.Room)
+			if err := r.redact(event.Room, event.EventID); err != nil {
+				log.Error().Err(err).Msgf("Could not redact %s in %s", event.EventID, event.Room)
+				continue
+			}
+			if err := r.log.ForgetEvent(messageId, event.Room, event.EventID); err != nil {
+				log.Error().Err(err).Msgf("Could not remove %s from the forward log", event.EventID)
+			}
+		}
+	}
+}
+
+func (r *retention) Run(ctx context.Context) {
+	r.Expire()
+	every(ctx, retentionCheckInterval, r.Expire)
+}
+
+// roomRetentions returns the retention of each room which should have its
+// m.room.retention state set.
+func roomRetentions(router *routing.Router, rooms []string) map[string]time.Duration {
+	result := make(map[string]time.Duration)
+	for _, room := range rooms {
+		if isUserTarget(room) {
+			continue
+		}
+		if retention := router.RetentionFor(room); retention != nil && retention.SetRoomState {
+			result[room] = retention.MaxAge
+		}
+	}
+	return result
+}
+
+// setRoomRetentions sets the m.room.retention state of the rooms whose
+// retention asks for it.
+func setRoomRetentions(matrixState *matrix.MatrixState, router *routing.Router) {
+	for room, maxAge := range roomRetentions(router, router.AllRooms()) {
+		if err := matrix.SetRoomRetention(matrixState, id.RoomID(room), maxAge); err != nil {
+			log.Warn().Err(err).Msgf("Could not set retention of room %s", room)
+		}
+	}
+}
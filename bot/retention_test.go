@@ -0,0 +1,68 @@
+package bot
+
+import (
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRetention(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	forwarded := &forwardLog{store: store, now: clock}
+	assert.NilError(t, forwarded.Record(1, []sentEvent{
+		{room: "!low", eventID: "$low", retention: 7 * 24 * time.Hour},
+		{room: "!critical", eventID: "$critical", retention: 90 * 24 * time.Hour},
+		{room: "!keep", eventID: "$keep"},
+	}))
+
+	var redacted []id.EventID
+	r := &retention{
+		log: forwarded,
+		now: clock,
+		redact: func(room string, eventID id.EventID) error {
+			redacted = append(redacted, eventID)
+			return nil
+		},
+	}
+
+	r.Expire()
+	assert.Equal(t, len(redacted), 0)
+
+	now = now.Add(8 * 24 * time.Hour)
+	r.Expire()
+	assert.DeepEqual(t, redacted, []id.EventID{"$low"})
+	_, found, err := forwarded.MessageFor("!low", "$low")
+	assert.NilError(t, err)
+	assert.Assert(t, !found)
+	messageId, found, err := forwarded.MessageFor("!critical", "$critical")
+	assert.NilError(t, err)
+	assert.Assert(t, found)
+	assert.Equal(t, messageId, int64(1))
+
+	now = now.Add(100 * 24 * time.Hour)
+	r.Expire()
+	r.Expire()
+	assert.DeepEqual(t, redacted, []id.EventID{"$low", "$critical"})
+}
+
+func TestRoomRetentions(t *testing.T) {
+	router, err := routing.NewRouter(config.RoutingType{
+		DefaultRetention: &config.RetentionType{MaxAge: time.Hour, SetRoomState: true},
+		Rules: []config.RouteType{
+			{Rooms: []string{"!a", "@user:example.com"}, Retention: &config.RetentionType{MaxAge: time.Minute}},
+		},
+	}, "!default")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, roomRetentions(router, router.AllRooms()), map[string]time.Duration{"!default": time.Hour})
+}
@@ -0,0 +1,140 @@
+package bot
+
+import (
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/routing"
+	"gotify_matrix_bot/state"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	spaceNamespace         = "space"
+	spaceIDKey             = "roomID"
+	spaceChildrenNamespace = "spaceChildren"
+)
+
+// space maintains a Matrix space containing all rooms the bot forwards to.
+// The space and its children are remembered in the state store.
+type space struct {
+	mutex    sync.Mutex
+	settings config.SpaceType
+	store    *state.Store
+	matrix   *matrix.MatrixState
+	spaceID  id.RoomID
+	children map[string]string
+}
+
+// Init creates the space if needed, then reconciles its children with the
+// given rooms.
+func (s *space) Init(rooms []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	spaceID, found, err := s.store.Get(spaceNamespace, spaceIDKey)
+	if err != nil {
+		return err
+	}
+	if !found {
+		options := matrix.RoomOptions{
+			Name:    s.settings.Name,
+			IsSpace: true,
+		}
+		for _, user := range s.settings.Invite {
+			options.Invite = append(options.Invite, id.UserID(user))
+		}
+		newSpaceID, err := matrix.CreateRoom(s.matrix, options)
+		if err != nil {
+			return err
+		}
+		spaceID = newSpaceID.String()
+		if err := s.store.Set(spaceNamespace, spaceIDKey, spaceID); err != nil {
+			return err
+		}
+	}
+	s.spaceID = id.RoomID(spaceID)
+
+	s.children, err = s.store.List(spaceChildrenNamespace)
+	if err != nil {
+		return err
+	}
+	return s.reconcileLocked(rooms)
+}
+
+// Reconcile adds all given rooms to the space and removes rooms which are no
+// longer routed to.
+func (s *space) Reconcile(rooms []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.spaceID == "" {
+		return nil
+	}
+	return s.reconcileLocked(rooms)
+}
+
+func (s *space) reconcileLocked(rooms []string) error {
+	for child := range s.children {
+		if slices.Contains(rooms, child) {
+			continue
+		}
+		log.Info().Str("room_id", child).Msg("Removing room from space")
+		if err := matrix.RemoveFromSpace(s.matrix, s.spaceID, id.RoomID(child)); err != nil {
+			log.Warn().Err(err).Str("room_id", child).Msg("Could not remove room from space")
+			continue
+		}
+		delete(s.children, child)
+		if err := s.store.Delete(spaceChildrenNamespace, child); err != nil {
+			return err
+		}
+	}
+
+	for _, room := range rooms {
+		s.addLocked(room)
+	}
+	return nil
+}
+
+// Add adds a room to the space, unless it is already part of it.
+func (s *space) Add(room string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.addLocked(room)
+}
+
+func (s *space) addLocked(room string) {
+	if _, ok := s.children[room]; ok || s.spaceID == "" {
+		return
+	}
+	log.Info().Str("room_id", room).Msg("Adding room to space")
+	if err := matrix.AddToSpace(s.matrix, s.spaceID, id.RoomID(room)); err != nil {
+		log.Warn().Err(err).Str("room_id", room).Msg("Could not add room to space")
+		return
+	}
+	s.children[room] = ""
+	if err := s.store.Set(spaceChildrenNamespace, room, ""); err != nil {
+		log.Error().Err(err).Msg("Could not store space child")
+	}
+}
+
+// spaceRooms returns the rooms which belong into the space: all rooms routed
+// to, and the rooms of applications.
+func spaceRooms(router *routing.Router, store *state.Store) ([]string, error) {
+	var rooms []string
+	for _, target := range router.AllRooms() {
+		if !isUserTarget(target) {
+			rooms = append(rooms, target)
+		}
+	}
+	appRoomList, err := store.List(appRoomsNamespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, room := range appRoomList {
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
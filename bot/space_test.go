@@ -0,0 +1,77 @@
+package bot
+
+import (
+	"context"
+	"gotify_matrix_bot/config"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+
+	"github.com/petergtz/pegomock/v4"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func setupMatrixMock(t *testing.T) (*MockMautrixClientType, *matrix.MatrixState) {
+	mockClient := NewMockMautrixClientType(pegomock.WithT(t))
+	matrixState := &matrix.MatrixState{
+		UserID:        "@bot:example.com",
+		MatrixContext: context.Background(),
+		MautrixClient: mockClient,
+	}
+	return mockClient, matrixState
+}
+
+func TestSpace(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	mockClient, matrixState := setupMatrixMock(t)
+	pegomock.When(mockClient.CreateRoom(pegomock.Any[context.Context](), pegomock.Any[*mautrix.ReqCreateRoom]())).
+		ThenReturn(&mautrix.RespCreateRoom{RoomID: "!space"}, nil)
+	s := &space{settings: config.SpaceType{Name: "Notifications"}, store: store, matrix: matrixState}
+
+	// Rooms for which m.space.child was set in the space, or cleared if removed.
+	childEvents := func(removed bool) []string {
+		var rooms []string
+		_, spaceIDs, types, stateKeys, contents, _ := mockClient.VerifyWasCalled(pegomock.AtLeast(0)).SendStateEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[string](),
+			pegomock.Any[any]()).GetAllCapturedArguments()
+		for idx := range spaceIDs {
+			if spaceIDs[idx] == "!space" && types[idx] == event.StateSpaceChild && (contents[idx] == struct{}{}) == removed {
+				rooms = append(rooms, stateKeys[idx])
+			}
+		}
+		return rooms
+	}
+
+	assert.NilError(t, s.Init([]string{"!a", "!b"}))
+	mockClient.VerifyWasCalledOnce().CreateRoom(pegomock.Any[context.Context](), pegomock.Any[*mautrix.ReqCreateRoom]())
+	assert.DeepEqual(t, childEvents(false), []string{"!a", "!b"})
+
+	t.Run("Reconcile adds new rooms and removes stale ones", func(t *testing.T) {
+		assert.NilError(t, s.Reconcile([]string{"!b", "!c"}))
+
+		assert.DeepEqual(t, childEvents(false), []string{"!a", "!b", "!c"})
+		assert.DeepEqual(t, childEvents(true), []string{"!a"})
+		children, err := store.List(spaceChildrenNamespace)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, children, map[string]string{"!b": "", "!c": ""})
+	})
+
+	t.Run("Existing space is reused", func(t *testing.T) {
+		restarted := &space{settings: s.settings, store: store, matrix: matrixState}
+		assert.NilError(t, restarted.Init([]string{"!b", "!c"}))
+
+		mockClient.VerifyWasCalledOnce().CreateRoom(pegomock.Any[context.Context](), pegomock.Any[*mautrix.ReqCreateRoom]())
+		assert.DeepEqual(t, childEvents(false), []string{"!a", "!b", "!c"})
+	})
+}
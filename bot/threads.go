@@ -0,0 +1,136 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/state"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	threadsNamespace = "threads"
+	threadPeriodDay  = "day"
+)
+
+type threadRoot struct {
+	EventID id.EventID `json:"eventID"`
+	Day     string     `json:"day,omitempty"`
+	// Set instead of the event ID while the root is queued in the outbox.
+	TransactionID string `json:"transactionID,omitempty"`
+}
+
+// threads groups the messages of each gotify application into one Matrix
+// thread per room, either permanently or per day. Thread roots are
+// remembered in the state store.
+type threads struct {
+	mutex  sync.Mutex
+	period string
+	store  *state.Store
+	now    func() time.Time
+	send   func(room string, markdown string) (id.EventID, string)
+}
+
+func newThreads(period string, store *state.Store, matrixConnection *matrix.MatrixState) *threads {
+	return &threads{
+		period: period,
+		store:  store,
+		now:    time.Now,
+		send: func(room string, markdown string) (id.EventID, string) {
+			return matrix.SendTrackedMessage(matrixConnection, room, "", markdown)
+		},
+	}
+}
+
+// RootFor returns the thread root for an application in a room, posting a
+// new root if there is none yet, or if the day has changed. Returns an error
+// while the root is queued in the outbox.
+func (t *threads) RootFor(room string, appId int64, appName string) (id.EventID, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var day string
+	if t.period == threadPeriodDay {
+		day = t.now().Format(time.DateOnly)
+	}
+
+	key := fmt.Sprintf("%s %d", room, appId)
+	value, found, err := t.store.Get(threadsNamespace, key)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		var root threadRoot
+		if err := json.Unmarshal([]byte(value), &root); err != nil {
+			return "", err
+		}
+		if root.Day == day && root.EventID == "" {
+			return "", fmt.Errorf("thread root in %s is not sent yet", room)
+		}
+		if root.Day == day {
+			return root.EventID, nil
+		}
+	}
+
+	if appName == "" {
+		appName = fmt.Sprintf("Application %d", appId)
+	}
+	heading := "**" + appName + "**"
+	if day != "" {
+		heading += " – " + day
+	}
+	root := threadRoot{Day: day}
+	root.EventID, root.TransactionID = t.send(room, heading)
+	if root.EventID == "" && root.TransactionID == "" {
+		return "", fmt.Errorf("could not post thread root in %s", room)
+	}
+	if err := t.save(key, root); err != nil {
+		return "", err
+	}
+	if root.EventID == "" {
+		return "", fmt.Errorf("thread root in %s is queued", room)
+	}
+	return root.EventID, nil
+}
+
+// Delivered records the event ID of a thread root which was queued in the
+// outbox. A root which could not be sent at all is forgotten, so that the
+// next message posts a new one.
+func (t *threads) Delivered(transactionID string, eventID id.EventID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entries, err := t.store.List(threadsNamespace)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read thread roots")
+		return
+	}
+	for key, value := range entries {
+		var root threadRoot
+		if err := json.Unmarshal([]byte(value), &root); err != nil || root.TransactionID != transactionID {
+			continue
+		}
+		if eventID == "" {
+			err = t.store.Delete(threadsNamespace, key)
+		} else {
+			root.EventID = eventID
+			root.TransactionID = ""
+			err = t.save(key, root)
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("Could not update thread root %s", key)
+		}
+	}
+}
+
+func (t *threads) save(key string, root threadRoot) error {
+	data, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	return t.store.Set(threadsNamespace, key, string(data))
+}
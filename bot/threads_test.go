@@ -0,0 +1,90 @@
+package bot
+
+import (
+	"gotify_matrix_bot/state"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestThreads(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	var roots []string
+	newTestThreads := func(period string) *threads {
+		th := newThreads(period, store, nil)
+		th.now = func() time.Time { return now }
+		th.send = func(room string, markdown string) (id.EventID, string) {
+			roots = append(roots, room+" "+markdown)
+			if room == "!queued" {
+				return "", "txn" + string(rune('0'+len(roots)))
+			}
+			return id.EventID("$root" + string(rune('0'+len(roots)))), ""
+		}
+		return th
+	}
+
+	th := newTestThreads(threadPeriodDay)
+	root, err := th.RootFor("!room", 1, "Backup")
+	assert.NilError(t, err)
+	assert.Equal(t, root, id.EventID("$root1"))
+	assert.DeepEqual(t, roots, []string{"!room **Backup** – 2025-03-01"})
+
+	// Roots are reused, and remembered across restarts.
+	th = newTestThreads(threadPeriodDay)
+	root, err = th.RootFor("!room", 1, "Backup")
+	assert.NilError(t, err)
+	assert.Equal(t, root, id.EventID("$root1"))
+
+	// Other applications and rooms get their own thread.
+	root, err = th.RootFor("!room", 2, "")
+	assert.NilError(t, err)
+	assert.Equal(t, root, id.EventID("$root2"))
+	assert.Equal(t, roots[1], "!room **Application 2** – 2025-03-01")
+	root, err = th.RootFor("!other", 1, "Backup")
+	assert.NilError(t, err)
+	assert.Equal(t, root, id.EventID("$root3"))
+
+	// A new day starts a new thread.
+	now = now.Add(24 * time.Hour)
+	root, err = th.RootFor("!room", 1, "Backup")
+	assert.NilError(t, err)
+	assert.Equal(t, root, id.EventID("$root4"))
+	assert.Equal(t, roots[3], "!room **Backup** – 2025-03-02")
+
+	// Permanent threads have no date.
+	th = newTestThreads("permanent")
+	root, err = th.RootFor("!room", 1, "Backup")
+	assert.NilError(t, err)
+	assert.Equal(t, root, id.EventID("$root5"))
+	now = now.Add(24 * time.Hour)
+	root, err = th.RootFor("!room", 1, "Backup")
+	assert.NilError(t, err)
+	assert.Equal(t, root, id.EventID("$root5"))
+	assert.Equal(t, roots[4], "!room **Backup**")
+
+	// Queued roots are used once they are delivered, and not posted again.
+	_, err = th.RootFor("!queued", 1, "Backup")
+	assert.ErrorContains(t, err, "queued")
+	_, err = th.RootFor("!queued", 1, "Backup")
+	assert.ErrorContains(t, err, "not sent yet")
+	assert.Equal(t, len(roots), 6)
+	th.Delivered("txn6", "$delivered")
+	root, err = th.RootFor("!queued", 1, "Backup")
+	assert.NilError(t, err)
+	assert.Equal(t, root, id.EventID("$delivered"))
+
+	// Roots which could not be delivered are posted again.
+	_, err = th.RootFor("!queued", 2, "Restic")
+	assert.ErrorContains(t, err, "queued")
+	th.Delivered("txn7", "")
+	_, err = th.RootFor("!queued", 2, "Restic")
+	assert.ErrorContains(t, err, "queued")
+	assert.Equal(t, len(roots), 8)
+}
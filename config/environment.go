@@ -0,0 +1,284 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables which override config keys. The rest
+// of the name is the path of the key in config.yaml in upper case, separated
+// by underscores, with the index for lists of sections, e.g.
+// GMB_MATRIX_ROOMID or GMB_ROUTING_RULES_0_ROOMS.
+const envPrefix = "GMB_"
+
+// Source tells where the value of a config key came from.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+)
+
+// Sources has the source of every key of Configuration which was set in
+// config.yaml or the environment, by its path, e.g. "matrix.roomID".
+var Sources map[string]Source = nil
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// Keys whose values are not shown by PrintConfig.
+var secretKeys = []string{"apiToken", "password", "token"}
+
+// EnvName returns the name of the environment variable for the key path.
+func EnvName(path string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+func hasEnvironment(environ []string) bool {
+	return slices.ContainsFunc(environ, func(variable string) bool {
+		return strings.HasPrefix(variable, envPrefix)
+	})
+}
+
+// fileSources records the keys which are set in the config file.
+func fileSources(node *yaml.Node, path string, sources map[string]Source) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			fileSources(child, path, sources)
+		}
+	case yaml.MappingNode:
+		for idx := 0; idx+1 < len(node.Content); idx += 2 {
+			fileSources(node.Content[idx+1], joinPath(path, node.Content[idx].Value), sources)
+		}
+	case yaml.SequenceNode:
+		sources[path] = SourceFile
+		for idx, child := range node.Content {
+			if child.Kind == yaml.MappingNode {
+				fileSources(child, joinPath(path, strconv.Itoa(idx)), sources)
+			}
+		}
+	default:
+		sources[path] = SourceFile
+	}
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// applyEnvironment overrides the values of c with the environment variables
+// starting with GMB_. environ is in the form of os.Environ. Lists of values
+// are separated by commas. Variables which do not match a key are logged and
+// skipped, as other software may use the prefix too, e.g. Kubernetes for a
+// service named gmb. Returns an error for invalid values.
+func applyEnvironment(c *Config, environ []string, sources map[string]Source) error {
+	environ = slices.Clone(environ)
+	// Sorted, so that list entries are created in order
+	slices.Sort(environ)
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(name, envPrefix), "_")
+		// The key is resolved first, so that a variable which is ignored
+		// leaves no empty sections or list entries behind.
+		path, err := resolveKey(reflect.TypeOf(c).Elem(), parts, "")
+		var unknown unknownKeyError
+		if errors.As(err, &unknown) {
+			log.Warn().Msgf("Ignoring environment variable %s: %s", name, err)
+			continue
+		}
+		if err == nil {
+			err = setFromEnv(reflect.ValueOf(c).Elem(), parts, value)
+		}
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %w", name, err)
+		}
+		sources[path] = SourceEnv
+	}
+	return nil
+}
+
+// resolveKey returns the key path named by the remaining parts of a variable
+// name, or an unknownKeyError if no key of typ matches.
+func resolveKey(typ reflect.Type, parts []string, path string) (string, error) {
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if len(parts) == 0 {
+		return path, nil
+	}
+
+	switch {
+	case typ.Kind() == reflect.Struct:
+		for idx := range typ.NumField() {
+			key := yamlName(typ.Field(idx))
+			if strings.EqualFold(key, parts[0]) {
+				return resolveKey(typ.Field(idx).Type, parts[1:], joinPath(path, key))
+			}
+		}
+	case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Struct:
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx < 0 {
+			return "", fmt.Errorf("invalid list index %s", parts[0])
+		}
+		return resolveKey(typ.Elem(), parts[1:], joinPath(path, parts[0]))
+	}
+	return "", unknownKeyError(strings.ToLower(joinPath(path, strings.Join(parts, "."))))
+}
+
+// setFromEnv sets the field of target named by the remaining parts of the
+// variable name, which resolveKey has found. Missing sections and list
+// entries are created.
+func setFromEnv(target reflect.Value, parts []string, value string) error {
+	if target.Kind() == reflect.Pointer {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		target = target.Elem()
+	}
+	if len(parts) == 0 {
+		return setValue(target, value)
+	}
+
+	if target.Kind() == reflect.Struct {
+		for idx := range target.NumField() {
+			if strings.EqualFold(yamlName(target.Type().Field(idx)), parts[0]) {
+				return setFromEnv(target.Field(idx), parts[1:], value)
+			}
+		}
+	}
+	idx, _ := strconv.Atoi(parts[0])
+	if idx >= target.Len() {
+		grown := reflect.MakeSlice(target.Type(), idx+1, idx+1)
+		reflect.Copy(grown, target)
+		target.Set(grown)
+	}
+	return setFromEnv(target.Index(idx), parts[1:], value)
+}
+
+// unknownKeyError is the key path of a variable which matches no config key.
+type unknownKeyError string
+
+func (e unknownKeyError) Error() string {
+	return "unknown config key " + string(e)
+}
+
+func setValue(target reflect.Value, value string) error {
+	if target.Type() == durationType {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		target.SetInt(int64(duration))
+		return nil
+	}
+
+	switch target.Kind() {
+	case reflect.String:
+		target.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		target.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		target.SetInt(parsed)
+	case reflect.Slice:
+		if target.Type().Elem().Kind() == reflect.Struct {
+			return fmt.Errorf("list of sections needs an index")
+		}
+		list := reflect.MakeSlice(target.Type(), 0, 0)
+		if value != "" {
+			for _, item := range strings.Split(value, ",") {
+				element := reflect.New(target.Type().Elem()).Elem()
+				if err := setValue(element, strings.TrimSpace(item)); err != nil {
+					return err
+				}
+				list = reflect.Append(list, element)
+			}
+		}
+		target.Set(list)
+	default:
+		return fmt.Errorf("a section needs a key")
+	}
+	return nil
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	return name
+}
+
+// PrintConfig writes every key of c with its environment variable, source
+// and value to out. Secrets are masked.
+func PrintConfig(c *Config, sources map[string]Source, out io.Writer) error {
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "KEY\tVARIABLE\tSOURCE\tVALUE")
+	printValues(table, reflect.ValueOf(c).Elem(), "", sources)
+	return table.Flush()
+}
+
+func printValues(out io.Writer, value reflect.Value, path string, sources map[string]Source) {
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			if value.Type().Elem().Kind() != reflect.Struct {
+				printValue(out, path, "", sources)
+			}
+			return
+		}
+		value = value.Elem()
+	}
+
+	switch {
+	case value.Kind() == reflect.Struct:
+		for idx := range value.NumField() {
+			printValues(out, value.Field(idx), joinPath(path, yamlName(value.Type().Field(idx))), sources)
+		}
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct:
+		for idx := range value.Len() {
+			printValues(out, value.Index(idx), joinPath(path, strconv.Itoa(idx)), sources)
+		}
+	case value.Kind() == reflect.Slice:
+		var items []string
+		for idx := range value.Len() {
+			items = append(items, fmt.Sprint(value.Index(idx).Interface()))
+		}
+		printValue(out, path, strings.Join(items, ","), sources)
+	default:
+		formatted := fmt.Sprint(value.Interface())
+		key := path[strings.LastIndex(path, ".")+1:]
+		if slices.Contains(secretKeys, key) && formatted != "" {
+			formatted = "***"
+		}
+		printValue(out, path, formatted, sources)
+	}
+}
+
+func printValue(out io.Writer, path string, formatted string, sources map[string]Source) {
+	source, found := sources[path]
+	if !found {
+		source = SourceDefault
+	}
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", path, EnvName(path), source, formatted)
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestApplyEnvironment(t *testing.T) {
+	t.Run("Values, lists and sections", func(t *testing.T) {
+		c := &Config{Matrix: MatrixType{RoomID: "!file", Username: "bot"}}
+		sources := map[string]Source{"matrix.roomID": SourceFile, "matrix.username": SourceFile}
+		err := applyEnvironment(c, []string{
+			"HOME=/root",
+			"GMB_MATRIX_ROOMID=!env",
+			"GMB_DOWNLOADER_ALLOWEDHOSTS=images\\.example\\.com, .*\\.example\\.org",
+			"GMB_DOWNLOADER_TIMEOUT=30s",
+			"GMB_ROUTING_RULES_1_ROOMS=!ops",
+			"GMB_ROUTING_RULES_0_MATCH_APPIDS=1,2",
+			"GMB_ROUTING_RULES_0_MATCH_MINPRIORITY=5",
+			"GMB_ROUTING_RULES_0_ROOMS=!alerts",
+			"GMB_ROUTING_DEFAULTQUIETHOURS_START=22:00",
+			"GMB_SPACE_ENABLED=true",
+		}, sources)
+		assert.NilError(t, err)
+
+		assert.Equal(t, c.Matrix.RoomID, "!env")
+		assert.Equal(t, c.Matrix.Username, "bot")
+		assert.DeepEqual(t, c.Downloader.AllowedHosts, []string{"images\\.example\\.com", ".*\\.example\\.org"})
+		assert.Equal(t, c.Downloader.Timeout, 30*time.Second)
+		assert.Equal(t, len(c.Routing.Rules), 2)
+		assert.DeepEqual(t, c.Routing.Rules[0].Match.AppIDs, []int64{1, 2})
+		assert.Equal(t, *c.Routing.Rules[0].Match.MinPriority, 5)
+		assert.DeepEqual(t, c.Routing.Rules[0].Rooms, []string{"!alerts"})
+		assert.DeepEqual(t, c.Routing.Rules[1].Rooms, []string{"!ops"})
+		assert.Equal(t, c.Routing.DefaultQuietHours.Start, "22:00")
+		assert.Assert(t, c.Space.Enabled)
+
+		assert.Equal(t, sources["matrix.roomID"], SourceEnv)
+		assert.Equal(t, sources["matrix.username"], SourceFile)
+		assert.Equal(t, sources["routing.rules.0.match.minPriority"], SourceEnv)
+	})
+
+	t.Run("Unknown keys are skipped", func(t *testing.T) {
+		c := &Config{}
+		sources := map[string]Source{}
+		err := applyEnvironment(c, []string{
+			"GMB_MATRIX_ROOM=!room",
+			"GMB_SERVICE_HOST=10.0.0.1",
+			"GMB_PORT=tcp://10.0.0.1:80",
+			"GMB_MATRIX_ROOMID=!env",
+		}, sources)
+		assert.NilError(t, err)
+		assert.Equal(t, c.Matrix.RoomID, "!env")
+		assert.DeepEqual(t, sources, map[string]Source{"matrix.roomID": SourceEnv})
+	})
+
+	t.Run("Unknown key in a section leaves no section behind", func(t *testing.T) {
+		c := &Config{}
+		err := applyEnvironment(c, []string{"GMB_ROUTING_DEFAULTRETENTION_FOO=1"}, map[string]Source{})
+		assert.NilError(t, err)
+		assert.Assert(t, c.Routing.DefaultRetention == nil)
+	})
+
+	t.Run("Unknown key in a list of sections leaves no entries behind", func(t *testing.T) {
+		c := &Config{Routing: RoutingType{Rules: []RouteType{{Rooms: []string{"!ops"}}}}}
+		err := applyEnvironment(c, []string{"GMB_ROUTING_RULES_2_BAR=x"}, map[string]Source{})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, c.Routing.Rules, []RouteType{{Rooms: []string{"!ops"}}})
+	})
+
+	testCases := []struct {
+		name     string
+		variable string
+		err      string
+	}{
+		{"Invalid number", "GMB_DIGEST_THRESHOLD=many", "environment variable GMB_DIGEST_THRESHOLD: strconv.ParseInt: parsing \"many\": invalid syntax"},
+		{"Invalid duration", "GMB_DIGEST_WINDOW=5", "environment variable GMB_DIGEST_WINDOW: time: missing unit in duration \"5\""},
+		{"Section", "GMB_MATRIX=!room", "environment variable GMB_MATRIX: a section needs a key"},
+		{"List of sections without index", "GMB_ROUTING_RULES=!room", "environment variable GMB_ROUTING_RULES: list of sections needs an index"},
+		{"Invalid index", "GMB_ROUTING_RULES_FIRST_ROOMS=!room", "environment variable GMB_ROUTING_RULES_FIRST_ROOMS: invalid list index FIRST"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := applyEnvironment(&Config{}, []string{tc.variable}, map[string]Source{})
+			assert.Error(t, err, tc.err)
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	t.Run("Config from the environment only", func(t *testing.T) {
+		c, sources, err := loadConfig([]string{"GMB_GOTIFY_URL=gotify.example.com"})
+		assert.NilError(t, err)
+		assert.Equal(t, c.Gotify.URL, "gotify.example.com")
+		assert.Equal(t, sources["gotify.url"], SourceEnv)
+	})
+
+	t.Run("Environment overrides file", func(t *testing.T) {
+		assert.NilError(t, os.WriteFile("config.yaml", []byte(`
+gotify:
+  url: gotify.example.com
+matrix:
+  roomID: "!file"
+routing:
+  rules:
+    - rooms: ["!ops"]
+`), 0600))
+		c, sources, err := loadConfig([]string{"GMB_MATRIX_ROOMID=!env"})
+		assert.NilError(t, err)
+		assert.Equal(t, c.Gotify.URL, "gotify.example.com")
+		assert.Equal(t, c.Matrix.RoomID, "!env")
+		assert.DeepEqual(t, sources, map[string]Source{
+			"gotify.url":            SourceFile,
+			"matrix.roomID":         SourceEnv,
+			"routing.rules":         SourceFile,
+			"routing.rules.0.rooms": SourceFile,
+		})
+	})
+}
+
+func TestPrintConfig(t *testing.T) {
+	c := &Config{
+		Gotify:  GotifyType{URL: "wss://gotify.example.com", ApiToken: "secret"},
+		Logging: LoggingType{Level: "info"},
+		Routing: RoutingType{Rules: []RouteType{{Rooms: []string{"!a", "!b"}}}},
+	}
+	sources := map[string]Source{"gotify.url": SourceFile, "gotify.apiToken": SourceEnv}
+
+	var out strings.Builder
+	assert.NilError(t, PrintConfig(c, sources, &out))
+	lines := strings.Split(out.String(), "\n")
+
+	assert.Assert(t, strings.Fields(lines[0])[0] == "KEY")
+	contains := func(fields ...string) bool {
+		for _, line := range lines {
+			if strings.Join(strings.Fields(line), " ") == strings.Join(fields, " ") {
+				return true
+			}
+		}
+		return false
+	}
+	assert.Assert(t, contains("gotify.url", "GMB_GOTIFY_URL", "file", "wss://gotify.example.com"))
+	assert.Assert(t, contains("gotify.apiToken", "GMB_GOTIFY_APITOKEN", "env", "***"))
+	assert.Assert(t, contains("logging.level", "GMB_LOGGING_LEVEL", "default", "info"))
+	assert.Assert(t, contains("routing.rules.0.rooms", "GMB_ROUTING_RULES_0_ROOMS", "default", "!a,!b"))
+	assert.Assert(t, contains("routing.rules.0.match.minPriority", "GMB_ROUTING_RULES_0_MATCH_MINPRIORITY", "default"))
+	assert.Assert(t, contains("shutdown.gracePeriod", "GMB_SHUTDOWN_GRACEPERIOD", "default", "0s"))
+}
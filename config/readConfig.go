@@ -1,9 +1,13 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"reflect"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
@@ -29,29 +33,257 @@ type LoggingType struct {
 	Format string `yaml:"format,omitempty"`
 }
 
+type ImageProcessingType struct {
+	MaxDimension  int    `yaml:"maxDimension,omitempty"`
+	Format        string `yaml:"format,omitempty"`
+	Quality       int    `yaml:"quality,omitempty"`
+	StripMetadata bool   `yaml:"stripMetadata,omitempty"`
+}
+
 type DownloaderType struct {
-	AllowedHosts []string `yaml:"allowedHosts,omitempty"`
+	AllowedHosts    []string            `yaml:"allowedHosts,omitempty"`
+	ImageProcessing ImageProcessingType `yaml:"imageProcessing,omitempty"`
+	Workers         int                 `yaml:"workers,omitempty"`
+	Timeout         time.Duration       `yaml:"timeout,omitempty"`
+}
+type RouteMatchType struct {
+	AppIDs      []int64 `yaml:"appIDs,omitempty"`
+	AppName     string  `yaml:"appName,omitempty"`
+	MinPriority *int    `yaml:"minPriority,omitempty"`
+	MaxPriority *int    `yaml:"maxPriority,omitempty"`
+	Title       string  `yaml:"title,omitempty"`
+	Message     string  `yaml:"message,omitempty"`
+}
+
+type QuietHoursType struct {
+	Start          string   `yaml:"start,omitempty"`
+	End            string   `yaml:"end,omitempty"`
+	Timezone       string   `yaml:"timezone,omitempty"`
+	Days           []string `yaml:"days,omitempty"`
+	BypassPriority int      `yaml:"bypassPriority,omitempty"`
+}
+
+type RetentionType struct {
+	MaxAge       time.Duration `yaml:"maxAge,omitempty"`
+	SetRoomState bool          `yaml:"setRoomState,omitempty"`
+}
+
+type RouteType struct {
+	Name       string          `yaml:"name,omitempty"`
+	Match      RouteMatchType  `yaml:"match,omitempty"`
+	Rooms      []string        `yaml:"rooms,omitempty"`
+	Continue   bool            `yaml:"continue,omitempty"`
+	QuietHours *QuietHoursType `yaml:"quietHours,omitempty"`
+	Retention  *RetentionType  `yaml:"retention,omitempty"`
+}
+
+type RoutingType struct {
+	DefaultRooms      []string        `yaml:"defaultRooms,omitempty"`
+	DefaultQuietHours *QuietHoursType `yaml:"defaultQuietHours,omitempty"`
+	DefaultRetention  *RetentionType  `yaml:"defaultRetention,omitempty"`
+	Rules             []RouteType     `yaml:"rules,omitempty"`
+}
+
+type FilterRuleType struct {
+	Name   string         `yaml:"name,omitempty"`
+	Action string         `yaml:"action,omitempty"`
+	Match  RouteMatchType `yaml:"match,omitempty"`
+}
+
+type FilteringType struct {
+	DefaultAction string           `yaml:"defaultAction,omitempty"`
+	Rules         []FilterRuleType `yaml:"rules,omitempty"`
+	StatsInterval time.Duration    `yaml:"statsInterval,omitempty"`
+}
+
+type DeduplicationType struct {
+	Window time.Duration `yaml:"window,omitempty"`
+}
+
+type DigestType struct {
+	Threshold int           `yaml:"threshold,omitempty"`
+	Window    time.Duration `yaml:"window,omitempty"`
+}
+
+type RoomPerAppType struct {
+	Enabled           bool     `yaml:"enabled,omitempty"`
+	NamePrefix        string   `yaml:"namePrefix,omitempty"`
+	Invite            []string `yaml:"invite,omitempty"`
+	DisableEncryption bool     `yaml:"disableEncryption,omitempty"`
+}
+
+type SpaceType struct {
+	Enabled bool     `yaml:"enabled,omitempty"`
+	Name    string   `yaml:"name,omitempty"`
+	Invite  []string `yaml:"invite,omitempty"`
+}
+
+type ThreadsType struct {
+	Enabled bool   `yaml:"enabled,omitempty"`
+	Period  string `yaml:"period,omitempty"`
+}
+
+type ReplaceRuleType struct {
+	Name     string         `yaml:"name,omitempty"`
+	Match    RouteMatchType `yaml:"match,omitempty"`
+	TitleKey string         `yaml:"titleKey,omitempty"`
 }
+
+type ReplaceType struct {
+	ExtrasKey string            `yaml:"extrasKey,omitempty"`
+	Rules     []ReplaceRuleType `yaml:"rules,omitempty"`
+}
+
+type CorrelationRuleType struct {
+	Name     string         `yaml:"name,omitempty"`
+	Match    RouteMatchType `yaml:"match,omitempty"`
+	Pattern  string         `yaml:"pattern,omitempty"`
+	Problem  string         `yaml:"problem,omitempty"`
+	Recovery string         `yaml:"recovery,omitempty"`
+}
+
+type CorrelationType struct {
+	Mode  string                `yaml:"mode,omitempty"`
+	Rules []CorrelationRuleType `yaml:"rules,omitempty"`
+}
+
+type AcknowledgementType struct {
+	MinPriority int           `yaml:"minPriority,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+	Reaction    string        `yaml:"reaction,omitempty"`
+	Reminders   int           `yaml:"reminders,omitempty"`
+	Escalate    []string      `yaml:"escalate,omitempty"`
+}
+
+type CommandsType struct {
+	Enabled      bool     `yaml:"enabled,omitempty"`
+	AllowedUsers []string `yaml:"allowedUsers,omitempty"`
+}
+
+type GotifySendAppType struct {
+	Name  string `yaml:"name,omitempty"`
+	Token string `yaml:"token,omitempty"`
+}
+
+type GotifySendRoomType struct {
+	Room        string `yaml:"room,omitempty"`
+	Application string `yaml:"application,omitempty"`
+	Priority    *int   `yaml:"priority,omitempty"`
+}
+
+type GotifySendType struct {
+	Applications []GotifySendAppType  `yaml:"applications,omitempty"`
+	WatchRooms   []GotifySendRoomType `yaml:"watchRooms,omitempty"`
+}
+
+type GotifyDeleteType struct {
+	Reaction string `yaml:"reaction,omitempty"`
+}
+
+type ReconcileType struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Lookback time.Duration `yaml:"lookback,omitempty"`
+}
+
+type PipelineType struct {
+	QueueSize        int           `yaml:"queueSize,omitempty"`
+	TransformWorkers int           `yaml:"transformWorkers,omitempty"`
+	MediaWorkers     int           `yaml:"mediaWorkers,omitempty"`
+	DeliverWorkers   int           `yaml:"deliverWorkers,omitempty"`
+	StatsInterval    time.Duration `yaml:"statsInterval,omitempty"`
+}
+
+type ShutdownType struct {
+	GracePeriod time.Duration `yaml:"gracePeriod,omitempty"`
+}
+
 type Config struct {
 	Gotify  GotifyType  `yaml:"gotify,omitempty"`
 	Matrix  MatrixType  `yaml:"matrix,omitempty"`
 	Logging LoggingType `yaml:"logging,omitempty"`
 	// Deprecated: Use Logging instead
-	Debug      bool           `yaml:"debug,omitempty"`
-	Downloader DownloaderType `yaml:"downloader,omitempty"`
+	Debug         bool                `yaml:"debug,omitempty"`
+	Downloader    DownloaderType      `yaml:"downloader,omitempty"`
+	Routing       RoutingType         `yaml:"routing,omitempty"`
+	RoomPerApp    RoomPerAppType      `yaml:"roomPerApp,omitempty"`
+	Space         SpaceType           `yaml:"space,omitempty"`
+	Filtering     FilteringType       `yaml:"filtering,omitempty"`
+	Deduplication DeduplicationType   `yaml:"deduplication,omitempty"`
+	Digest        DigestType          `yaml:"digest,omitempty"`
+	Threads       ThreadsType         `yaml:"threads,omitempty"`
+	Replace       ReplaceType         `yaml:"replace,omitempty"`
+	Correlation   CorrelationType     `yaml:"correlation,omitempty"`
+	Acknowledge   AcknowledgementType `yaml:"acknowledge,omitempty"`
+	Commands      CommandsType        `yaml:"commands,omitempty"`
+	GotifySend    GotifySendType      `yaml:"gotifySend,omitempty"`
+	GotifyDelete  GotifyDeleteType    `yaml:"gotifyDelete,omitempty"`
+	Reconcile     ReconcileType       `yaml:"reconcile,omitempty"`
+	Pipeline      PipelineType        `yaml:"pipeline,omitempty"`
+	Shutdown      ShutdownType        `yaml:"shutdown,omitempty"`
 }
 
 var Configuration *Config = nil
 
 func InitConfig() {
-
-	buf, err := os.ReadFile("./config.yaml")
+	c, sources, err := loadConfig(os.Environ())
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not load config.")
 	}
+	Configuration = fixConfig(c)
+	Sources = sources
+}
 
-	Configuration = fixConfig(parseConfig(buf))
+// ReadConfig reads, completes and checks the config like InitConfig and
+// ValidateConfig, but returns errors instead of exiting, and does not change
+// Configuration. Also returns the warning of the checks, if any.
+func ReadConfig() (*Config, string, error) {
+	c, _, err := loadConfig(os.Environ())
+	if err != nil {
+		return nil, "", err
+	}
+	c = fixConfig(c)
+	fatal, warn := checkValues(c)
+	if fatal != "" {
+		return nil, "", errors.New(fatal)
+	}
+	return c, warn, nil
+}
 
+// loadConfig reads config.yaml and overrides it with the environment. The
+// file is optional, if the config is given by the environment. Also returns
+// the keys set by each.
+func loadConfig(environ []string) (*Config, map[string]Source, error) {
+	c := &Config{}
+	sources := make(map[string]Source)
+	buf, err := os.ReadFile("./config.yaml")
+	switch {
+	case errors.Is(err, os.ErrNotExist) && hasEnvironment(environ):
+	case err != nil:
+		return nil, nil, err
+	default:
+		if c, err = parseConfig(buf, sources); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := applyEnvironment(c, environ, sources); err != nil {
+		return nil, nil, err
+	}
+	return c, sources, nil
+}
+
+// ChangedSections returns the names of the top-level sections which differ
+// between two configs, as used in config.yaml.
+func ChangedSections(old *Config, new *Config) []string {
+	var changed []string
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(new).Elem()
+	configType := oldValue.Type()
+	for idx := range configType.NumField() {
+		if !reflect.DeepEqual(oldValue.Field(idx).Interface(), newValue.Field(idx).Interface()) {
+			changed = append(changed, yamlName(configType.Field(idx)))
+		}
+	}
+	return changed
 }
 
 func ValidateConfig() {
@@ -64,21 +296,27 @@ func ValidateConfig() {
 	}
 }
 
-func parseConfig(buf []byte) *Config {
-
+// parseConfig parses the contents of config.yaml, and records the keys it
+// sets in sources.
+func parseConfig(buf []byte, sources map[string]Source) (*Config, error) {
 	c := &Config{}
-	err := yaml.Unmarshal(buf, c)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Could not parse config.")
+	if err := yaml.Unmarshal(buf, c); err != nil {
+		return nil, err
 	}
-
-	return c
+	var document yaml.Node
+	if err := yaml.Unmarshal(buf, &document); err != nil {
+		return nil, err
+	}
+	fileSources(&document, "", sources)
+	return c, nil
 }
 
 func fixConfig(c *Config) *Config {
 	fixMatrixDomain(c)
 	fixGotifyURL(c)
 	fixLoggingLevel(c)
+	fixSpaceName(c)
+	fixAcknowledgement(c)
 	return c
 }
 
@@ -99,6 +337,24 @@ func fixGotifyURL(c *Config) {
 	}
 }
 
+func fixSpaceName(c *Config) {
+	if c.Space.Enabled && c.Space.Name == "" {
+		c.Space.Name = "Gotify Notifications"
+	}
+}
+
+func fixAcknowledgement(c *Config) {
+	if c.Acknowledge.MinPriority <= 0 {
+		return
+	}
+	if c.Acknowledge.Reaction == "" {
+		c.Acknowledge.Reaction = "✅"
+	}
+	if c.Acknowledge.Reminders == 0 {
+		c.Acknowledge.Reminders = 1
+	}
+}
+
 func fixLoggingLevel(c *Config) {
 	if c.Debug {
 		c.Logging.Level = "debug"
@@ -138,15 +394,153 @@ func checkValues(config *Config) (fatal string, warn string) {
 		}
 	}
 
-	if config.Matrix.RoomID == "" {
+	if config.Matrix.RoomID == "" && len(config.Routing.DefaultRooms) == 0 && !config.RoomPerApp.Enabled {
 		return "No matrix room id specified.", ""
 	}
+
+	if config.Filtering.DefaultAction != "" && !isFilterAction(config.Filtering.DefaultAction) {
+		return "Unknown filter default action " + config.Filtering.DefaultAction + ". Use allow or drop.", ""
+	}
+
+	for idx, rule := range config.Filtering.Rules {
+		// Unlike the default action, a forgotten action would silently drop messages.
+		if rule.Action == "" {
+			return fmt.Sprintf("Filter rule %d (%s) has no action. Use allow or drop.", idx+1, rule.Name), ""
+		}
+		if !isFilterAction(rule.Action) {
+			return fmt.Sprintf("Filter rule %d (%s) has unknown action %s. Use allow or drop.", idx+1, rule.Name, rule.Action), ""
+		}
+	}
+
+	for _, user := range config.RoomPerApp.Invite {
+		if !strings.HasPrefix(user, "@") {
+			return "Invalid matrix user id " + user + " in roomPerApp invite list.", ""
+		}
+	}
+
+	for _, user := range config.Space.Invite {
+		if !strings.HasPrefix(user, "@") {
+			return "Invalid matrix user id " + user + " in space invite list.", ""
+		}
+	}
+
+	for idx, rule := range config.Routing.Rules {
+		if len(rule.Rooms) == 0 {
+			return fmt.Sprintf("Routing rule %d (%s) has no rooms.", idx+1, rule.Name), ""
+		}
+		if rule.Retention != nil && rule.Retention.MaxAge <= 0 {
+			return fmt.Sprintf("Routing rule %d (%s) needs a positive retention maxAge.", idx+1, rule.Name), ""
+		}
+	}
+	if config.Routing.DefaultRetention != nil && config.Routing.DefaultRetention.MaxAge <= 0 {
+		return "Default retention needs a positive maxAge.", ""
+	}
+	if config.Downloader.ImageProcessing.MaxDimension < 0 {
+		return "Image processing maxDimension must not be negative.", ""
+	}
+
+	switch strings.ToLower(config.Downloader.ImageProcessing.Format) {
+	case "", "jpeg", "png":
+	default:
+		return "Unknown image processing format " + config.Downloader.ImageProcessing.Format + ". Use jpeg or png.", ""
+	}
+
+	if config.Downloader.ImageProcessing.Quality < 0 || config.Downloader.ImageProcessing.Quality > 100 {
+		return "Image processing quality must be between 0 and 100 (0 = default).", ""
+	}
+
+	if config.Downloader.Workers < 0 {
+		return "Downloader workers must not be negative.", ""
+	}
+
+	if config.Downloader.Timeout < 0 {
+		return "Downloader timeout must not be negative.", ""
+	}
+
+	for idx, rule := range config.Replace.Rules {
+		if rule.TitleKey == "" {
+			return fmt.Sprintf("Replace rule %d (%s) has no titleKey.", idx+1, rule.Name), ""
+		}
+	}
+
+	switch config.Correlation.Mode {
+	case "", "thread", "reply":
+	default:
+		return "Unknown correlation mode " + config.Correlation.Mode + ". Use thread or reply.", ""
+	}
+	for idx, rule := range config.Correlation.Rules {
+		if rule.Pattern == "" || rule.Problem == "" || rule.Recovery == "" {
+			return fmt.Sprintf("Correlation rule %d (%s) needs pattern, problem and recovery.", idx+1, rule.Name), ""
+		}
+	}
+
+	if config.Acknowledge.MinPriority > 0 && config.Acknowledge.Timeout <= 0 {
+		return "Acknowledge needs a timeout.", ""
+	}
+	for _, user := range config.Acknowledge.Escalate {
+		if !strings.HasPrefix(user, "@") {
+			return "Invalid matrix user id " + user + " in acknowledge escalate list.", ""
+		}
+	}
+
+	if config.Commands.Enabled && len(config.Commands.AllowedUsers) == 0 {
+		return "Commands need at least one allowed user.", ""
+	}
+	for _, user := range config.Commands.AllowedUsers {
+		if !strings.HasPrefix(user, "@") {
+			return "Invalid matrix user id " + user + " in commands allowedUsers list.", ""
+		}
+	}
+
+	if len(config.GotifySend.Applications) > 0 && !config.Commands.Enabled {
+		return "gotifySend needs commands to be enabled, as only their allowed users may send.", ""
+	}
+	if config.GotifyDelete.Reaction != "" && !config.Commands.Enabled {
+		return "gotifyDelete needs commands to be enabled, as only their allowed users may delete.", ""
+	}
+	sendApps := make(map[string]bool)
+	for idx, app := range config.GotifySend.Applications {
+		if app.Name == "" || app.Token == "" {
+			return fmt.Sprintf("gotifySend application %d needs a name and a token.", idx+1), ""
+		}
+		sendApps[strings.ToLower(app.Name)] = true
+	}
+	for _, room := range config.GotifySend.WatchRooms {
+		if !sendApps[strings.ToLower(room.Application)] {
+			return "gotifySend watch room " + room.Room + " uses unknown application " + room.Application + ".", ""
+		}
+	}
+
+	if config.Reconcile.Interval < 0 || config.Reconcile.Lookback < 0 {
+		return "Reconcile interval and lookback must not be negative.", ""
+	}
+
+	if config.Pipeline.QueueSize < 0 || config.Pipeline.TransformWorkers < 0 ||
+		config.Pipeline.MediaWorkers < 0 || config.Pipeline.DeliverWorkers < 0 ||
+		config.Pipeline.StatsInterval < 0 {
+		return "Pipeline queue size, workers and stats interval must not be negative.", ""
+	}
+
+	if config.Shutdown.GracePeriod < 0 {
+		return "Shutdown grace period must not be negative.", ""
+	}
+
+	switch config.Threads.Period {
+	case "", "permanent", "day":
+	default:
+		return "Unknown threads period " + config.Threads.Period + ". Use permanent or day.", ""
+	}
+
 	if config.Debug {
 		return "", "Using deprecated keyword 'debug' in config. Please use logging/level instead"
 	}
 	return "", ""
 }
 
+func isFilterAction(action string) bool {
+	return strings.EqualFold(action, "allow") || strings.EqualFold(action, "drop")
+}
+
 func DownloadAllowListAsRegexps(config *Config) ([]*regexp.Regexp, error) {
 	filters := make([]*regexp.Regexp, len(config.Downloader.AllowedHosts))
 	var err error
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"os"
 	"regexp"
 	"testing"
+	"time"
 
 	"gotest.tools/v3/assert"
 )
@@ -160,11 +162,90 @@ downloader:
 			},
 			expectedError: false,
 		},
+		{
+			name: "downloader workers and timeout",
+			config: []byte(`
+downloader:
+  workers: 8
+  timeout: 30s
+`),
+			expected: &Config{
+				Gotify: GotifyType{
+					URL: "wss://",
+				},
+				Logging: LoggingType{
+					Level: "info",
+				},
+				Downloader: DownloaderType{
+					Workers: 8,
+					Timeout: 30 * time.Second,
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name: "space name defaults if enabled",
+			config: []byte(`
+space:
+  enabled: true
+`),
+			expected: &Config{
+				Gotify: GotifyType{
+					URL: "wss://",
+				},
+				Logging: LoggingType{
+					Level: "info",
+				},
+				Space: SpaceType{
+					Enabled: true,
+					Name:    "Gotify Notifications",
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name: "image processing settings",
+			config: []byte(`
+downloader:
+  imageProcessing:
+    maxDimension: 1024
+    format: jpeg
+    quality: 80
+    stripMetadata: true
+`),
+			expected: &Config{
+				Gotify: GotifyType{
+					URL: "wss://",
+				},
+				Logging: LoggingType{
+					Level: "info",
+				},
+				Downloader: DownloaderType{
+					ImageProcessing: ImageProcessingType{
+						MaxDimension:  1024,
+						Format:        "jpeg",
+						Quality:       80,
+						StripMetadata: true,
+					},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name:          "Invalid YAML",
+			config:        []byte("gotify: [url"),
+			expectedError: true,
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := fixConfig(parseConfig(tc.config))
-			assert.DeepEqual(t, result, tc.expected)
+			parsed, err := parseConfig(tc.config, map[string]Source{})
+			if tc.expectedError {
+				assert.Assert(t, err != nil)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, fixConfig(parsed), tc.expected)
 		})
 	}
 }
@@ -242,6 +323,320 @@ func TestCheckValues(t *testing.T) {
 			expectedError: "Matrix token specified along with username/password. Please only specify one authentication method.",
 			ExpectedWarn:  "",
 		},
+		{
+			name: "Default rooms instead of room id",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+				},
+				Routing: RoutingType{
+					DefaultRooms: []string{"!roomid"},
+				},
+			},
+			expectedError: "",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Routing rule without rooms",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Routing: RoutingType{
+					Rules: []RouteType{{Name: "ci"}},
+				},
+			},
+			expectedError: "Routing rule 1 (ci) has no rooms.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Room per app without room id",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+				},
+				RoomPerApp: RoomPerAppType{
+					Enabled: true,
+					Invite:  []string{"@user:example.com"},
+				},
+			},
+			expectedError: "",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Room per app with invalid invite",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+				},
+				RoomPerApp: RoomPerAppType{
+					Enabled: true,
+					Invite:  []string{"user"},
+				},
+			},
+			expectedError: "Invalid matrix user id user in roomPerApp invite list.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Unknown filter action",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Filtering: FilteringType{
+					Rules: []FilterRuleType{{Name: "noisy", Action: "ignore"}},
+				},
+			},
+			expectedError: "Filter rule 1 (noisy) has unknown action ignore. Use allow or drop.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Filter rule without action",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Filtering: FilteringType{
+					Rules: []FilterRuleType{{Name: "noisy"}},
+				},
+			},
+			expectedError: "Filter rule 1 (noisy) has no action. Use allow or drop.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Unknown image format",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Downloader: DownloaderType{
+					ImageProcessing: ImageProcessingType{
+						Format: "bmp",
+					},
+				},
+			},
+			expectedError: "Unknown image processing format bmp. Use jpeg or png.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Invalid image quality",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Downloader: DownloaderType{
+					ImageProcessing: ImageProcessingType{
+						Format:  "jpeg",
+						Quality: 101,
+					},
+				},
+			},
+			expectedError: "Image processing quality must be between 0 and 100 (0 = default).",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Unknown threads period",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Threads: ThreadsType{
+					Enabled: true,
+					Period:  "week",
+				},
+			},
+			expectedError: "Unknown threads period week. Use permanent or day.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Replace rule without title key",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Replace: ReplaceType{
+					Rules: []ReplaceRuleType{{Name: "deploy"}},
+				},
+			},
+			expectedError: "Replace rule 1 (deploy) has no titleKey.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Correlation rule without recovery state",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Correlation: CorrelationType{
+					Rules: []CorrelationRuleType{{Name: "uptime", Pattern: "(?P<resource>.+) is (?P<state>.+)", Problem: "DOWN"}},
+				},
+			},
+			expectedError: "Correlation rule 1 (uptime) needs pattern, problem and recovery.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Acknowledge without timeout",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Acknowledge: AcknowledgementType{
+					MinPriority: 8,
+				},
+			},
+			expectedError: "Acknowledge needs a timeout.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Commands without allowed users",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Commands: CommandsType{
+					Enabled: true,
+				},
+			},
+			expectedError: "Commands need at least one allowed user.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Watch room with unknown gotify application",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Commands: CommandsType{
+					Enabled:      true,
+					AllowedUsers: []string{"@admin:example.com"},
+				},
+				GotifySend: GotifySendType{
+					Applications: []GotifySendAppType{{Name: "Matrix", Token: "appToken"}},
+					WatchRooms:   []GotifySendRoomType{{Room: "!watched", Application: "Other"}},
+				},
+			},
+			expectedError: "gotifySend watch room !watched uses unknown application Other.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Negative pipeline workers",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Pipeline: PipelineType{
+					MediaWorkers: -1,
+				},
+			},
+			expectedError: "Pipeline queue size, workers and stats interval must not be negative.",
+			ExpectedWarn:  "",
+		},
+		{
+			name: "Negative shutdown grace period",
+			config: &Config{
+				Gotify: GotifyType{
+					URL:      "https://gotify.example.com",
+					ApiToken: "testToken",
+				},
+				Matrix: MatrixType{
+					HomeServerURL: "https://matrix.example.com",
+					Token:         "testToken",
+					RoomID:        "!roomid",
+				},
+				Shutdown: ShutdownType{
+					GracePeriod: -time.Second,
+				},
+			},
+			expectedError: "Shutdown grace period must not be negative.",
+			ExpectedWarn:  "",
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -318,3 +713,60 @@ func TestDownloadAllowListAsRegexps(t *testing.T) {
 		})
 	}
 }
+
+func TestReadConfig(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, _, err := ReadConfig()
+		assert.ErrorContains(t, err, "config.yaml")
+	})
+
+	t.Run("Invalid config is rejected", func(t *testing.T) {
+		assert.NilError(t, os.WriteFile("config.yaml", []byte(`
+gotify:
+  url: gotify.example.com
+`), 0600))
+		_, _, err := ReadConfig()
+		assert.Error(t, err, "No gotify api token specified.")
+	})
+
+	t.Run("Valid config is completed", func(t *testing.T) {
+		assert.NilError(t, os.WriteFile("config.yaml", []byte(`
+gotify:
+  url: gotify.example.com
+  apiToken: token
+matrix:
+  homeserverURL: https://matrix.example.com
+  token: token
+  roomID: "!room"
+debug: true
+`), 0600))
+		c, warn, err := ReadConfig()
+		assert.NilError(t, err)
+		assert.Equal(t, c.Gotify.URL, "wss://gotify.example.com")
+		assert.Equal(t, warn, "Using deprecated keyword 'debug' in config. Please use logging/level instead")
+	})
+}
+
+func TestChangedSections(t *testing.T) {
+	old := &Config{
+		Matrix:  MatrixType{RoomID: "!room"},
+		Logging: LoggingType{Level: "info"},
+		Routing: RoutingType{DefaultRooms: []string{"!a"}},
+	}
+	same := &Config{
+		Matrix:  MatrixType{RoomID: "!room"},
+		Logging: LoggingType{Level: "info"},
+		Routing: RoutingType{DefaultRooms: []string{"!a"}},
+	}
+	assert.Assert(t, len(ChangedSections(old, same)) == 0)
+
+	changed := &Config{
+		Matrix:    MatrixType{RoomID: "!room"},
+		Logging:   LoggingType{Level: "debug"},
+		Routing:   RoutingType{DefaultRooms: []string{"!a", "!b"}},
+		Filtering: FilteringType{DefaultAction: "drop"},
+	}
+	assert.DeepEqual(t, ChangedSections(old, changed), []string{"logging", "routing", "filtering"})
+}
@@ -3,10 +3,12 @@ module gotify_matrix_bot
 go 1.25.0
 
 require (
+	github.com/google/go-cmp v0.6.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/mattn/go-sqlite3 v1.14.44
 	github.com/petergtz/pegomock/v4 v4.1.0
 	github.com/rs/zerolog v1.35.1
+	golang.org/x/image v0.25.0
 	gopkg.in/yaml.v3 v3.0.1
 	gotest.tools/v3 v3.5.2
 	maunium.net/go/mautrix v0.28.0
@@ -14,7 +16,6 @@ require (
 
 require (
 	filippo.io/edwards25519 v1.2.0 // indirect
-	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.22 // indirect
 	github.com/onsi/gomega v1.27.6 // indirect
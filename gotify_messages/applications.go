@@ -0,0 +1,115 @@
+package gotify_messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"gotify_matrix_bot/config"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+type Application struct {
+	Id          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Image       string `json:"image"`
+	Token       string `json:"token"`
+}
+
+// RestURL returns the http(s) base URL of the gotify server. The configured
+// URL has been rewritten to a websocket scheme, so this reverses it.
+func RestURL() string {
+	restURL := config.Configuration.Gotify.URL
+	restURL = strings.Replace(restURL, "ws://", "http://", 1)
+	restURL = strings.Replace(restURL, "wss://", "https://", 1)
+	return strings.TrimSuffix(restURL, "/")
+}
+
+func GetApplications() ([]Application, error) {
+	request, err := http.NewRequest(http.MethodGet, RestURL()+"/application", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Gotify-Key", config.Configuration.Gotify.ApiToken)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gotify returned status %s", response.Status)
+	}
+
+	var applications []Application
+	err = json.NewDecoder(response.Body).Decode(&applications)
+	if err != nil {
+		return nil, err
+	}
+	return applications, nil
+}
+
+// ApplicationCache resolves application ids to applications. It reloads the
+// list from gotify whenever an unknown id is requested.
+type ApplicationCache struct {
+	mutex        sync.Mutex
+	applications map[int64]Application
+	load         func() ([]Application, error)
+}
+
+func NewApplicationCache() *ApplicationCache {
+	return NewApplicationCacheFrom(GetApplications)
+}
+
+// NewApplicationCacheFrom creates a cache which loads the applications with
+// the given function instead of from gotify.
+func NewApplicationCacheFrom(load func() ([]Application, error)) *ApplicationCache {
+	return &ApplicationCache{load: load}
+}
+
+func (c *ApplicationCache) Get(appId int64) (Application, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if app, ok := c.applications[appId]; ok {
+		return app, true
+	}
+
+	applications, err := c.load()
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not load applications from gotify")
+		return Application{}, false
+	}
+	c.applications = make(map[int64]Application, len(applications))
+	for _, app := range applications {
+		c.applications[app.Id] = app
+	}
+
+	app, ok := c.applications[appId]
+	return app, ok
+}
+
+// All reloads and returns all applications.
+func (c *ApplicationCache) All() ([]Application, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	applications, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.applications = make(map[int64]Application, len(applications))
+	for _, app := range applications {
+		c.applications[app.Id] = app
+	}
+	return applications, nil
+}
+
+func (c *ApplicationCache) Name(appId int64) string {
+	app, _ := c.Get(appId)
+	return app.Name
+}
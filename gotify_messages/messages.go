@@ -0,0 +1,111 @@
+package gotify_messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gotify_matrix_bot/config"
+	"net/http"
+)
+
+type outgoingMessage struct {
+	Title    string `json:"title,omitempty"`
+	Message  string `json:"message"`
+	Priority *int   `json:"priority,omitempty"`
+}
+
+// SendMessage creates a gotify message with the token of an application.
+// Without a priority, gotify uses the default priority of the application.
+func SendMessage(appToken string, title string, message string, priority *int) error {
+	body, err := json.Marshal(outgoingMessage{Title: title, Message: message, Priority: priority})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, RestURL()+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Gotify-Key", appToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("gotify returned status %s", response.Status)
+	}
+	return nil
+}
+
+// DeleteMessage deletes a gotify message with the client token.
+func DeleteMessage(messageId int64) error {
+	request, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/message/%d", RestURL(), messageId), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Gotify-Key", config.Configuration.Gotify.ApiToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("gotify returned status %s", response.Status)
+	}
+	return nil
+}
+
+const messagePageSize = 200
+
+type pagedMessages struct {
+	Paging struct {
+		Since int64 `json:"since"`
+	} `json:"paging"`
+	Messages []struct {
+		Id int64 `json:"id"`
+	} `json:"messages"`
+}
+
+// GetMessageIDs returns the ids of all gotify messages with an id of at
+// least minId. Messages are listed newest first, one page at a time.
+func GetMessageIDs(minId int64) (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	var since int64
+	for {
+		listURL := fmt.Sprintf("%s/message?limit=%d", RestURL(), messagePageSize)
+		if since > 0 {
+			listURL += fmt.Sprintf("&since=%d", since)
+		}
+		request, err := http.NewRequest(http.MethodGet, listURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("X-Gotify-Key", config.Configuration.Gotify.ApiToken)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		var page pagedMessages
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("gotify returned status %s", response.Status)
+		} else {
+			err = json.NewDecoder(response.Body).Decode(&page)
+		}
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range page.Messages {
+			if message.Id < minId {
+				return ids, nil
+			}
+			ids[message.Id] = true
+		}
+		if len(page.Messages) < messagePageSize || page.Paging.Since <= 0 {
+			return ids, nil
+		}
+		since = page.Paging.Since
+	}
+}
@@ -0,0 +1,113 @@
+package gotify_messages_test
+
+import (
+	"encoding/json"
+	"gotify_matrix_bot/config"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	. "gotify_matrix_bot/gotify_messages"
+
+	"gotest.tools/v3/assert"
+)
+
+// setupGotify starts a gotify server with the messages 1 to count, which
+// lists them newest first like gotify does. Returns the number of requests.
+func setupGotify(t *testing.T, count int64, status int) *int {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, r.URL.Path, "/message")
+		assert.Equal(t, r.Header.Get("X-Gotify-Key"), "clientToken")
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+		assert.NilError(t, err)
+		since := count + 1
+		if r.URL.Query().Has("since") {
+			since, err = strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+			assert.NilError(t, err)
+		}
+
+		type message struct {
+			Id int64 `json:"id"`
+		}
+		messages := []message{}
+		for id := since - 1; id > 0 && int64(len(messages)) < limit; id-- {
+			messages = append(messages, message{Id: id})
+		}
+		page := map[string]any{"messages": messages, "paging": map[string]any{"since": 0}}
+		if len(messages) > 0 {
+			page["paging"] = map[string]any{"since": messages[len(messages)-1].Id}
+		}
+		assert.NilError(t, json.NewEncoder(w).Encode(page))
+	}))
+	t.Cleanup(server.Close)
+
+	previous := config.Configuration
+	config.Configuration = &config.Config{Gotify: config.GotifyType{URL: server.URL, ApiToken: "clientToken"}}
+	t.Cleanup(func() { config.Configuration = previous })
+	return &requests
+}
+
+func expectedIDs(from int64, to int64) map[int64]bool {
+	ids := make(map[int64]bool)
+	for id := from; id <= to; id++ {
+		ids[id] = true
+	}
+	return ids
+}
+
+func TestGetMessageIDs(t *testing.T) {
+	t.Run("All pages are read", func(t *testing.T) {
+		requests := setupGotify(t, 450, http.StatusOK)
+
+		ids, err := GetMessageIDs(1)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids, expectedIDs(1, 450))
+		assert.Equal(t, *requests, 3)
+	})
+
+	t.Run("Full last page", func(t *testing.T) {
+		requests := setupGotify(t, 200, http.StatusOK)
+
+		ids, err := GetMessageIDs(1)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids, expectedIDs(1, 200))
+		assert.Equal(t, *requests, 2)
+	})
+
+	t.Run("Older messages are not listed", func(t *testing.T) {
+		requests := setupGotify(t, 450, http.StatusOK)
+
+		ids, err := GetMessageIDs(300)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids, expectedIDs(300, 450))
+		assert.Equal(t, *requests, 1)
+	})
+
+	t.Run("No messages", func(t *testing.T) {
+		setupGotify(t, 0, http.StatusOK)
+
+		ids, err := GetMessageIDs(1)
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids, map[int64]bool{})
+	})
+
+	t.Run("HTTP error", func(t *testing.T) {
+		setupGotify(t, 450, http.StatusUnauthorized)
+
+		ids, err := GetMessageIDs(1)
+
+		assert.Error(t, err, "gotify returned status 401 Unauthorized")
+		assert.Assert(t, ids == nil)
+	})
+}
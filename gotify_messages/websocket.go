@@ -1,8 +1,11 @@
 package gotify_messages
 
 import (
+	"context"
 	"gotify_matrix_bot/config"
 	"net/url"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
@@ -11,7 +14,24 @@ import (
 
 type callbackFunction func([]byte)
 
-func OnNewMessage(callback callbackFunction) {
+var connectedAt atomic.Pointer[time.Time]
+
+// ConnectedSince returns when the connection to gotify was established, or
+// the zero time if it was not yet.
+func ConnectedSince() time.Time {
+	if t := connectedAt.Load(); t != nil {
+		return *t
+	}
+	return time.Time{}
+}
+
+// closeTimeout is how long to wait for gotify to answer the close frame.
+const closeTimeout = 5 * time.Second
+
+// OnNewMessage reads messages from gotify and passes them to the callback,
+// until the context is cancelled. The returned channel is closed once the
+// connection is closed and the last callback has returned.
+func OnNewMessage(ctx context.Context, callback callbackFunction) <-chan struct{} {
 
 	websocketURL, urlError := url.Parse(config.Configuration.Gotify.URL + "/stream?token=" + config.Configuration.Gotify.ApiToken)
 
@@ -29,10 +49,17 @@ func OnNewMessage(callback callbackFunction) {
 
 	go func() {
 		defer close(done)
+		defer c.Close()
+		now := time.Now()
+		connectedAt.Store(&now)
 		log.Info().Msg("Connected to Gotify server.")
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
+				if ctx.Err() != nil {
+					log.Info().Msg("Disconnected from Gotify server.")
+					return
+				}
 				log.Fatal().Err(err).Msg("The websocket connection to gotify returned an error.")
 			}
 			log.Debug().Msgf("Received message from gotify: %s", string(message))
@@ -40,4 +67,25 @@ func OnNewMessage(callback callbackFunction) {
 		}
 	}()
 
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		if err := c.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(closeTimeout)); err != nil {
+			log.Warn().Err(err).Msg("Could not send close frame to gotify")
+			c.Close()
+			return
+		}
+		// Reading ends when gotify answers the close frame.
+		select {
+		case <-done:
+		case <-time.After(closeTimeout):
+			c.Close()
+		}
+	}()
+
+	return done
 }
@@ -1,23 +1,51 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"gotify_matrix_bot/bot"
 	"gotify_matrix_bot/config"
 	"os"
+	"os/signal"
 	"runtime/debug"
 	"strings"
+	"syscall"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "deadletters" {
+		if err := bot.DeadLettersCommand(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	config.InitConfig()
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		// Shows the effective config, so it is not validated
+		if err := config.PrintConfig(config.Configuration, config.Sources, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	setupLoggerFromConfig()
 	config.ValidateConfig()
 
 	logVersion()
-	bot.MainLoop()
+
+	ctx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGABRT,
+		syscall.SIGINT,
+		syscall.SIGQUIT,
+		syscall.SIGTERM,
+	)
+	defer stop()
+	bot.MainLoop(ctx)
 }
 
 func logVersion() {
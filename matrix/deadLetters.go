@@ -0,0 +1,159 @@
+package matrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/id"
+)
+
+// DeadLetter is a message which the homeserver refused permanently, for
+// example because the room was deleted or the event was too large.
+type DeadLetter struct {
+	ID         string
+	RoomID     id.RoomID
+	EventType  string
+	Content    json.RawMessage
+	Attempts   int
+	EnqueuedAt time.Time
+	FailedAt   time.Time
+	Error      string
+}
+
+// Body returns the plain text body of the message.
+func (d DeadLetter) Body() string {
+	var content struct {
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal(d.Content, &content); err != nil {
+		return ""
+	}
+	return content.Body
+}
+
+// bury moves an entry from the outbox to the dead letters.
+func (o *Outbox) bury(entry *outboxEntry) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	delete(o.inFlight, entry.TransactionID)
+	delete(o.sending, entry.TransactionID)
+
+	entry.FailedAt = o.now()
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = o.store.Set(deadLettersNamespace, entry.TransactionID, string(data))
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not store dead letter %s", entry.TransactionID)
+	}
+	if err := o.store.Delete(outboxNamespace, entry.TransactionID); err != nil {
+		log.Error().Err(err).Msgf("Could not remove message %s from outbox", entry.TransactionID)
+	}
+}
+
+// DeadLetters returns all dead letters, oldest failure first.
+func (o *Outbox) DeadLetters() ([]DeadLetter, error) {
+	values, err := o.store.List(deadLettersNamespace)
+	if err != nil {
+		return nil, err
+	}
+	var result []DeadLetter
+	for key, value := range values {
+		var entry outboxEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			return nil, fmt.Errorf("dead letter %s: %w", key, err)
+		}
+		result = append(result, deadLetterFrom(&entry))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].FailedAt.Before(result[j].FailedAt)
+	})
+	return result, nil
+}
+
+// DeadLetter returns a dead letter by its ID, and whether it was found.
+func (o *Outbox) DeadLetter(letterID string) (DeadLetter, bool, error) {
+	entry, found, err := o.deadEntry(letterID)
+	if err != nil || !found {
+		return DeadLetter{}, found, err
+	}
+	return deadLetterFrom(entry), true, nil
+}
+
+// Replay moves a dead letter back to the outbox, optionally sending it to a
+// different room. It is sent with a new transaction ID, by the running bot
+// or on the next start.
+func (o *Outbox) Replay(letterID string, roomID id.RoomID) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entry, found, err := o.deadEntry(letterID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no dead letter %s", letterID)
+	}
+	replay := *entry
+	if roomID != "" {
+		replay.RoomID = roomID
+	}
+	replay.TransactionID, err = newTransactionID()
+	if err != nil {
+		return err
+	}
+	replay.EnqueuedAt = o.now()
+	replay.Attempts = 0
+	replay.NextAttempt = time.Time{}
+	replay.LastError = ""
+	replay.FailedAt = time.Time{}
+
+	data, err := json.Marshal(&replay)
+	if err != nil {
+		return err
+	}
+	if err := o.store.Set(outboxNamespace, replay.TransactionID, string(data)); err != nil {
+		return err
+	}
+	return o.store.Delete(deadLettersNamespace, letterID)
+}
+
+// Purge deletes a dead letter.
+func (o *Outbox) Purge(letterID string) error {
+	_, found, err := o.deadEntry(letterID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no dead letter %s", letterID)
+	}
+	return o.store.Delete(deadLettersNamespace, letterID)
+}
+
+func (o *Outbox) deadEntry(letterID string) (*outboxEntry, bool, error) {
+	value, found, err := o.store.Get(deadLettersNamespace, letterID)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	var entry outboxEntry
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		return nil, false, fmt.Errorf("dead letter %s: %w", letterID, err)
+	}
+	return &entry, true, nil
+}
+
+func deadLetterFrom(entry *outboxEntry) DeadLetter {
+	return DeadLetter{
+		ID:         entry.TransactionID,
+		RoomID:     entry.RoomID,
+		EventType:  entry.EventType,
+		Content:    entry.Content,
+		Attempts:   entry.Attempts,
+		EnqueuedAt: entry.EnqueuedAt,
+		FailedAt:   entry.FailedAt,
+		Error:      entry.LastError,
+	}
+}
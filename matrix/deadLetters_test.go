@@ -0,0 +1,69 @@
+package matrix_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "gotify_matrix_bot/matrix"
+
+	"github.com/petergtz/pegomock/v4"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDeadLetters(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	mockClient, matrixState := setupOutbox(t)
+	pegomock.When(mockClient.SendMessageEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Any[id.RoomID](),
+		pegomock.Any[event.Type](),
+		pegomock.Any[any](),
+		pegomock.Any[mautrix.ReqSendEvent]())).
+		ThenReturn(nil, httpError(http.StatusForbidden, "M_FORBIDDEN", nil)).
+		ThenReturn(&mautrix.RespSendEvent{EventID: "$event"}, nil)
+	outbox := matrixState.Outbox
+
+	SendMessage(matrixState, "!gone:example.com", "Lost message")
+
+	letters, err := outbox.DeadLetters()
+	assert.NilError(t, err)
+	assert.Equal(t, len(letters), 1)
+	letter := letters[0]
+	assert.Equal(t, letter.RoomID, id.RoomID("!gone:example.com"))
+	assert.Equal(t, letter.Body(), "Lost message")
+	assert.Equal(t, letter.Attempts, 1)
+	assert.Equal(t, letter.Error, httpError(http.StatusForbidden, "M_FORBIDDEN", nil).Error())
+	assert.Assert(t, !letter.FailedAt.IsZero())
+
+	found, ok, err := outbox.DeadLetter(letter.ID)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, found.ID, letter.ID)
+
+	// Replayed messages are sent by the outbox, with a new transaction ID.
+	assert.NilError(t, outbox.Replay(letter.ID, "!other:example.com"))
+	letters, err = outbox.DeadLetters()
+	assert.NilError(t, err)
+	assert.Equal(t, len(letters), 0)
+	outbox.Flush(matrixState)
+
+	_, rooms, _, _, extras := mockClient.VerifyWasCalled(pegomock.Times(2)).SendMessageEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Any[id.RoomID](),
+		pegomock.Eq(event.EventMessage),
+		pegomock.Any[any](),
+		pegomock.Any[mautrix.ReqSendEvent]()).GetAllCapturedArguments()
+	assert.Equal(t, rooms[1], id.RoomID("!other:example.com"))
+	assert.Assert(t, extras[1][0].TransactionID != letter.ID)
+	pending, err := outbox.Pending()
+	assert.NilError(t, err)
+	assert.Equal(t, pending, 0)
+
+	assert.ErrorContains(t, outbox.Replay(letter.ID, ""), "no dead letter")
+	assert.ErrorContains(t, outbox.Purge(letter.ID), "no dead letter")
+}
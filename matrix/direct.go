@@ -0,0 +1,84 @@
+package matrix
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// GetDirectRoom returns the direct chat with a user. It uses the rooms listed
+// in the m.direct account data which the bot is still joined to, and creates a
+// new encrypted chat if there is none, recording it in m.direct. The result
+// is cached until the bot leaves the room.
+func GetDirectRoom(state *MatrixState, userID id.UserID) (id.RoomID, error) {
+	state.directMutex.Lock()
+	defer state.directMutex.Unlock()
+
+	if roomID, ok := state.directRooms[userID]; ok {
+		return roomID, nil
+	}
+
+	directChats := event.DirectChatsEventContent{}
+	err := state.MautrixClient.GetAccountData(state.MatrixContext, event.AccountDataDirectChats.Type, &directChats)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return "", err
+	}
+
+	for _, roomID := range directChats[userID] {
+		if isJoined(state, roomID) {
+			cacheDirectRoom(state, userID, roomID)
+			return roomID, nil
+		}
+	}
+
+	log.Info().Str("user_id", userID.String()).Msg("Creating direct chat")
+	roomID, err := CreateRoom(state, RoomOptions{
+		Invite:    []id.UserID{userID},
+		Encrypted: true,
+		IsDirect:  true,
+	})
+	if err != nil {
+		return "", err
+	}
+	cacheDirectRoom(state, userID, roomID)
+
+	directChats[userID] = append(directChats[userID], roomID)
+	err = state.MautrixClient.SetAccountData(state.MatrixContext, event.AccountDataDirectChats.Type, &directChats)
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not update m.direct account data")
+	}
+	return roomID, nil
+}
+
+// isJoined tells if the bot is a member of the room. It is not after it left
+// or was kicked, and then cannot read the members.
+func isJoined(state *MatrixState, roomID id.RoomID) bool {
+	members, err := state.MautrixClient.JoinedMembers(state.MatrixContext, roomID)
+	if err != nil || members == nil {
+		log.Debug().Err(err).Str("room_id", roomID.String()).Msg("Skipping direct chat")
+		return false
+	}
+	_, joined := members.Joined[state.UserID]
+	return joined
+}
+
+func cacheDirectRoom(state *MatrixState, userID id.UserID, roomID id.RoomID) {
+	if state.directRooms == nil {
+		state.directRooms = make(map[id.UserID]id.RoomID)
+	}
+	state.directRooms[userID] = roomID
+}
+
+// forgetDirectRoom removes a room the bot left from the cache of direct chats.
+func forgetDirectRoom(state *MatrixState, roomID id.RoomID) {
+	state.directMutex.Lock()
+	defer state.directMutex.Unlock()
+	for userID, cached := range state.directRooms {
+		if cached == roomID {
+			delete(state.directRooms, userID)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package matrix_test
+
+import (
+	"context"
+	"testing"
+
+	. "gotify_matrix_bot/matrix"
+
+	"github.com/petergtz/pegomock/v4"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestGetDirectRoom(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	setupDirectChats := func(mockClient *MockMautrixClientType, rooms ...id.RoomID) {
+		pegomock.When(mockClient.GetAccountData(
+			pegomock.Any[context.Context](),
+			pegomock.Eq("m.direct"),
+			pegomock.Any[interface{}]())).
+			Then(func(params []pegomock.Param) pegomock.ReturnValues {
+				directChats := params[2].(*event.DirectChatsEventContent)
+				(*directChats)["@user:example.com"] = rooms
+				return []pegomock.ReturnValue{nil}
+			})
+	}
+	joined := &mautrix.RespJoinedMembers{Joined: map[id.UserID]mautrix.JoinedMember{"@bot:example.com": {}}}
+
+	t.Run("Existing direct chat is reused and cached", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+		state.UserID = "@bot:example.com"
+		setupDirectChats(mockClient, "!dm:example.com")
+		pegomock.When(mockClient.JoinedMembers(pegomock.Any[context.Context](), pegomock.Eq(id.RoomID("!dm:example.com")))).
+			ThenReturn(joined, nil)
+
+		roomID, err := GetDirectRoom(state, "@user:example.com")
+		assert.NilError(t, err)
+		assert.Equal(t, roomID, id.RoomID("!dm:example.com"))
+		roomID, err = GetDirectRoom(state, "@user:example.com")
+		assert.NilError(t, err)
+		assert.Equal(t, roomID, id.RoomID("!dm:example.com"))
+
+		mockClient.VerifyWasCalledOnce().GetAccountData(
+			pegomock.Any[context.Context](),
+			pegomock.Eq("m.direct"),
+			pegomock.Any[interface{}]())
+		mockClient.VerifyWasCalled(pegomock.Never()).CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]())
+	})
+
+	t.Run("Rooms the bot left are skipped", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+		state.UserID = "@bot:example.com"
+		setupDirectChats(mockClient, "!left:example.com", "!kicked:example.com", "!dm:example.com")
+		pegomock.When(mockClient.JoinedMembers(pegomock.Any[context.Context](), pegomock.Eq(id.RoomID("!left:example.com")))).
+			ThenReturn(nil, mautrix.MForbidden)
+		pegomock.When(mockClient.JoinedMembers(pegomock.Any[context.Context](), pegomock.Eq(id.RoomID("!kicked:example.com")))).
+			ThenReturn(&mautrix.RespJoinedMembers{Joined: map[id.UserID]mautrix.JoinedMember{"@user:example.com": {}}}, nil)
+		pegomock.When(mockClient.JoinedMembers(pegomock.Any[context.Context](), pegomock.Eq(id.RoomID("!dm:example.com")))).
+			ThenReturn(joined, nil)
+
+		roomID, err := GetDirectRoom(state, "@user:example.com")
+
+		assert.NilError(t, err)
+		assert.Equal(t, roomID, id.RoomID("!dm:example.com"))
+	})
+
+	t.Run("Missing direct chat is created and recorded", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+		pegomock.When(mockClient.GetAccountData(
+			pegomock.Any[context.Context](),
+			pegomock.Eq("m.direct"),
+			pegomock.Any[interface{}]())).
+			ThenReturn(mautrix.MNotFound)
+		pegomock.When(mockClient.CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]())).
+			ThenReturn(&mautrix.RespCreateRoom{RoomID: "!new:example.com"}, nil)
+
+		roomID, err := GetDirectRoom(state, "@user:example.com")
+
+		assert.NilError(t, err)
+		assert.Equal(t, roomID, id.RoomID("!new:example.com"))
+		_, req := mockClient.VerifyWasCalledOnce().CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]()).GetCapturedArguments()
+		assert.Assert(t, req.IsDirect)
+		assert.DeepEqual(t, req.Invite, []id.UserID{"@user:example.com"})
+		assert.Equal(t, req.InitialState[0].Type, event.StateEncryption)
+		mockClient.VerifyWasCalledOnce().SetAccountData(
+			pegomock.Any[context.Context](),
+			pegomock.Eq("m.direct"),
+			pegomock.Eq[interface{}](&event.DirectChatsEventContent{
+				"@user:example.com": []id.RoomID{"!new:example.com"},
+			}))
+	})
+}
@@ -0,0 +1,64 @@
+package matrix
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix/event"
+)
+
+// Events waiting for the handlers. Further events are dropped, so that slow
+// handlers cannot stall the sync.
+const roomEventQueueSize = 100
+
+type queuedRoomEvent struct {
+	ctx context.Context
+	evt *event.Event
+}
+
+// RoomEventHandler handles messages and reactions sent by other users in
+// rooms the bot is in. Encrypted events are passed on after decryption.
+type RoomEventHandler func(ctx context.Context, evt *event.Event)
+
+// OnRoomEvent registers a handler for room events. Handlers are called one
+// event at a time, in the order of the events, outside of the sync loop.
+func OnRoomEvent(state *MatrixState, handler RoomEventHandler) {
+	state.eventHandlersMutex.Lock()
+	defer state.eventHandlersMutex.Unlock()
+	state.eventHandlers = append(state.eventHandlers, handler)
+}
+
+// DispatchRoomEvent queues an event for the registered handlers, without
+// waiting for them. The bot's own events, and events from before the bot
+// connected, are ignored.
+func DispatchRoomEvent(ctx context.Context, state *MatrixState, evt *event.Event) {
+	switch evt.Type {
+	case event.EventMessage, event.EventReaction, event.EventRedaction:
+	default:
+		return
+	}
+	if evt.Sender == state.UserID || evt.Timestamp < state.ConnectedAt.UnixMilli() {
+		return
+	}
+
+	state.roomEventsOnce.Do(func() {
+		state.roomEvents = make(chan queuedRoomEvent, roomEventQueueSize)
+		go handleRoomEvents(state)
+	})
+	select {
+	case state.roomEvents <- queuedRoomEvent{ctx: ctx, evt: evt}:
+	default:
+		log.Warn().Str("room_id", evt.RoomID.String()).Msgf("Too many events waiting to be handled, dropping event %s", evt.ID)
+	}
+}
+
+func handleRoomEvents(state *MatrixState) {
+	for queued := range state.roomEvents {
+		state.eventHandlersMutex.RLock()
+		handlers := state.eventHandlers
+		state.eventHandlersMutex.RUnlock()
+		for _, handler := range handlers {
+			handler(queued.ctx, queued.evt)
+		}
+	}
+}
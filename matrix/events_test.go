@@ -0,0 +1,77 @@
+package matrix_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "gotify_matrix_bot/matrix"
+
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDispatchRoomEvent(t *testing.T) {
+	connectedAt := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	state := &MatrixState{UserID: "@bot:example.com", ConnectedAt: connectedAt}
+	received := make(chan id.EventID, 10)
+	OnRoomEvent(state, func(_ context.Context, evt *event.Event) {
+		received <- evt.ID
+	})
+
+	later := connectedAt.Add(time.Minute).UnixMilli()
+	DispatchRoomEvent(context.Background(), state, &event.Event{
+		ID: "$message", Type: event.EventMessage, Sender: "@user:example.com", Timestamp: later,
+	})
+	DispatchRoomEvent(context.Background(), state, &event.Event{
+		ID: "$reaction", Type: event.EventReaction, Sender: "@user:example.com", Timestamp: later,
+	})
+	DispatchRoomEvent(context.Background(), state, &event.Event{
+		ID: "$own", Type: event.EventMessage, Sender: "@bot:example.com", Timestamp: later,
+	})
+	DispatchRoomEvent(context.Background(), state, &event.Event{
+		ID: "$old", Type: event.EventMessage, Sender: "@user:example.com", Timestamp: connectedAt.Add(-time.Minute).UnixMilli(),
+	})
+	DispatchRoomEvent(context.Background(), state, &event.Event{
+		ID: "$state", Type: event.StateMember, Sender: "@user:example.com", Timestamp: later,
+	})
+
+	DispatchRoomEvent(context.Background(), state, &event.Event{
+		ID: "$last", Type: event.EventMessage, Sender: "@user:example.com", Timestamp: later,
+	})
+
+	var handled []id.EventID
+	for evtID := range received {
+		handled = append(handled, evtID)
+		if evtID == "$last" {
+			break
+		}
+	}
+	assert.DeepEqual(t, handled, []id.EventID{"$message", "$reaction", "$last"})
+}
+
+func TestDispatchRoomEventDoesNotBlock(t *testing.T) {
+	state := &MatrixState{UserID: "@bot:example.com"}
+	release := make(chan struct{})
+	defer close(release)
+	OnRoomEvent(state, func(_ context.Context, _ *event.Event) {
+		<-release
+	})
+
+	done := make(chan struct{})
+	go func() {
+		// More events than fit in the queue, while the handler is stuck.
+		for range 200 {
+			DispatchRoomEvent(context.Background(), state, &event.Event{
+				Type: event.EventMessage, Sender: "@user:example.com", Timestamp: time.Now().UnixMilli(),
+			})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DispatchRoomEvent blocked")
+	}
+}
@@ -0,0 +1,231 @@
+package matrix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/image/draw"
+
+	// Register additional decoders so that image.Decode can read them.
+	_ "image/gif"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	defaultJpegQuality = 85
+	// Larger images are not decoded, as the decoded pixels need about 4
+	// bytes each.
+	maxImagePixels = 50_000_000
+)
+
+// ImageProcessingOptions controls how downloaded images are transformed
+// before they are uploaded to the Matrix media repository.
+type ImageProcessingOptions struct {
+	// Images larger than this in either dimension are downscaled. 0 disables resizing.
+	MaxDimension int
+	// Target format, "jpeg" or "png". Empty keeps the original format where
+	// possible. WebP images cannot be encoded, so they are left unchanged
+	// then unless they need downscaling, which converts them to PNG.
+	Format string
+	// JPEG quality (1-100). 0 uses the default.
+	Quality int
+	// Re-encode images even if nothing else changes, dropping EXIF and other metadata.
+	StripMetadata bool
+}
+
+func (o ImageProcessingOptions) IsEnabled() bool {
+	return o.MaxDimension > 0 || o.Format != "" || o.StripMetadata
+}
+
+// ProcessImage decodes the given image, optionally downscales it and re-encodes
+// it according to the options. Re-encoding drops all metadata, as the standard
+// encoders only write pixel data. Returns the new data and content type.
+// If no processing is needed, the original data is returned unchanged.
+func ProcessImage(data []byte, contentType string, options ImageProcessingOptions) ([]byte, string, error) {
+	if !options.IsEnabled() {
+		return data, contentType, nil
+	}
+
+	imageConfig, inputFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if imageConfig.Width*imageConfig.Height > maxImagePixels {
+		return nil, "", fmt.Errorf("image of %dx%d pixels is too large to process", imageConfig.Width, imageConfig.Height)
+	}
+
+	if inputFormat == "gif" {
+		// Re-encoding would lose animation frames, so leave GIFs alone.
+		log.Debug().Msg("Not processing GIF image")
+		return data, contentType, nil
+	}
+	tooLarge := options.MaxDimension > 0 &&
+		(imageConfig.Width > options.MaxDimension || imageConfig.Height > options.MaxDimension)
+	if inputFormat == "webp" && options.Format == "" && !tooLarge {
+		log.Debug().Msg("Not processing WebP image")
+		return data, contentType, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	// Re-encoding drops the EXIF orientation, so it is applied to the pixels.
+	if inputFormat == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	resized := false
+	bounds := img.Bounds()
+	if options.MaxDimension > 0 && (bounds.Dx() > options.MaxDimension || bounds.Dy() > options.MaxDimension) {
+		img = downscale(img, options.MaxDimension)
+		resized = true
+		log.Debug().Msgf("Resized image from %dx%d to %dx%d",
+			bounds.Dx(), bounds.Dy(), img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	outputFormat := strings.ToLower(options.Format)
+	if outputFormat == "" {
+		outputFormat = inputFormat
+	}
+	if outputFormat != "jpeg" && outputFormat != "png" {
+		outputFormat = "png"
+	}
+
+	if !resized && outputFormat == inputFormat && !options.StripMetadata {
+		return data, contentType, nil
+	}
+
+	var buf bytes.Buffer
+	switch outputFormat {
+	case "jpeg":
+		quality := options.Quality
+		if quality <= 0 {
+			quality = defaultJpegQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	log.Debug().Msgf("Re-encoded image as %s, size %d -> %d bytes", outputFormat, len(data), buf.Len())
+	return buf.Bytes(), "image/" + outputFormat, nil
+}
+
+func downscale(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width >= height {
+		height = max(1, height*maxDimension/width)
+		width = maxDimension
+	} else {
+		width = max(1, width*maxDimension/height)
+		height = maxDimension
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG image, or 1 if it
+// has none.
+func jpegOrientation(data []byte) int {
+	// Segments follow the SOI marker, up to the start of the image data.
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF && data[pos+1] != 0xDA; {
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : end]
+		if data[pos+1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos = end
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of TIFF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for idx := range entries {
+		entry := ifd + 2 + idx*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips img so that it displays upright without
+// its EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	// Orientations from 5 on swap width and height
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := range dstHeight {
+		for x := range dstWidth {
+			var srcX, srcY int
+			switch orientation {
+			case 2:
+				srcX, srcY = width-1-x, y
+			case 3:
+				srcX, srcY = width-1-x, height-1-y
+			case 4:
+				srcX, srcY = x, height-1-y
+			case 5:
+				srcX, srcY = y, x
+			case 6:
+				srcX, srcY = y, height-1-x
+			case 7:
+				srcX, srcY = width-1-y, height-1-x
+			case 8:
+				srcX, srcY = width-1-y, x
+			}
+			dst.Set(x, y, img.At(bounds.Min.X+srcX, bounds.Min.Y+srcY))
+		}
+	}
+	return dst
+}
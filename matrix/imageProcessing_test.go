@@ -0,0 +1,185 @@
+package matrix_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	. "gotify_matrix_bot/matrix"
+
+	"gotest.tools/v3/assert"
+)
+
+func createTestImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func encodePng(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	assert.NilError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func encodeJpegWithExif(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	assert.NilError(t, jpeg.Encode(&buf, img, nil))
+	data := buf.Bytes()
+	// Insert an APP1 (EXIF) segment directly after the SOI marker.
+	payload := []byte("Exif\x00\x00GPS-LOCATION")
+	segment := append([]byte{0xFF, 0xE1, 0, byte(len(payload) + 2)}, payload...)
+	result := append([]byte{}, data[:2]...)
+	result = append(result, segment...)
+	return append(result, data[2:]...)
+}
+
+func encodeJpegWithOrientation(t *testing.T, img image.Image, orientation uint16) []byte {
+	var buf bytes.Buffer
+	assert.NilError(t, jpeg.Encode(&buf, img, nil))
+	data := buf.Bytes()
+	// Big endian TIFF header with one IFD holding the orientation tag.
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, 0, 0, 0, 0}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := append([]byte{0xFF, 0xE1, 0, byte(len(payload) + 2)}, payload...)
+	result := append([]byte{}, data[:2]...)
+	result = append(result, segment...)
+	return append(result, data[2:]...)
+}
+
+// pngHeader returns the start of a PNG image of the given size, which is
+// enough for image.DecodeConfig.
+func pngHeader(width, height uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)-4))
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestProcessImage(t *testing.T) {
+	t.Run("Disabled processing returns original", func(t *testing.T) {
+		data := encodePng(t, createTestImage(400, 200))
+
+		result, contentType, err := ProcessImage(data, "image/png", ImageProcessingOptions{})
+
+		assert.NilError(t, err)
+		assert.Equal(t, contentType, "image/png")
+		assert.DeepEqual(t, result, data)
+	})
+
+	t.Run("Large image is downscaled keeping aspect ratio", func(t *testing.T) {
+		data := encodePng(t, createTestImage(400, 200))
+
+		result, contentType, err := ProcessImage(data, "image/png", ImageProcessingOptions{MaxDimension: 100})
+
+		assert.NilError(t, err)
+		assert.Equal(t, contentType, "image/png")
+		config, format, err := image.DecodeConfig(bytes.NewReader(result))
+		assert.NilError(t, err)
+		assert.Equal(t, format, "png")
+		assert.Equal(t, config.Width, 100)
+		assert.Equal(t, config.Height, 50)
+	})
+
+	t.Run("Small image is not changed", func(t *testing.T) {
+		data := encodePng(t, createTestImage(50, 20))
+
+		result, _, err := ProcessImage(data, "image/png", ImageProcessingOptions{MaxDimension: 100})
+
+		assert.NilError(t, err)
+		assert.DeepEqual(t, result, data)
+	})
+
+	t.Run("Image is re-encoded to target format", func(t *testing.T) {
+		data := encodePng(t, createTestImage(50, 20))
+
+		result, contentType, err := ProcessImage(data, "image/png", ImageProcessingOptions{Format: "jpeg", Quality: 50})
+
+		assert.NilError(t, err)
+		assert.Equal(t, contentType, "image/jpeg")
+		_, format, err := image.DecodeConfig(bytes.NewReader(result))
+		assert.NilError(t, err)
+		assert.Equal(t, format, "jpeg")
+	})
+
+	t.Run("Metadata is stripped", func(t *testing.T) {
+		data := encodeJpegWithExif(t, createTestImage(50, 20))
+		assert.Assert(t, bytes.Contains(data, []byte("GPS-LOCATION")))
+
+		result, contentType, err := ProcessImage(data, "image/jpeg", ImageProcessingOptions{StripMetadata: true})
+
+		assert.NilError(t, err)
+		assert.Equal(t, contentType, "image/jpeg")
+		assert.Assert(t, !bytes.Contains(result, []byte("GPS-LOCATION")))
+	})
+
+	t.Run("Invalid image returns error", func(t *testing.T) {
+		_, _, err := ProcessImage([]byte{0, 1, 2, 3}, "image/png", ImageProcessingOptions{StripMetadata: true})
+
+		assert.ErrorContains(t, err, "unknown format")
+	})
+
+	t.Run("Oversized image is not decoded", func(t *testing.T) {
+		_, _, err := ProcessImage(pngHeader(20000, 20000), "image/png", ImageProcessingOptions{StripMetadata: true})
+
+		assert.Error(t, err, "image of 20000x20000 pixels is too large to process")
+	})
+
+	t.Run("EXIF orientation is applied", func(t *testing.T) {
+		img := createTestImage(40, 20)
+		data := encodeJpegWithOrientation(t, img, 6)
+
+		result, _, err := ProcessImage(data, "image/jpeg", ImageProcessingOptions{StripMetadata: true})
+
+		assert.NilError(t, err)
+		config, _, err := image.DecodeConfig(bytes.NewReader(result))
+		assert.NilError(t, err)
+		assert.Equal(t, config.Width, 20)
+		assert.Equal(t, config.Height, 40)
+	})
+
+	t.Run("WebP keeps its format", func(t *testing.T) {
+		// 1x1 lossless WebP
+		data, err := base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+		assert.NilError(t, err)
+		_, format, err := image.DecodeConfig(bytes.NewReader(data))
+		assert.NilError(t, err)
+		assert.Equal(t, format, "webp")
+
+		result, contentType, err := ProcessImage(data, "image/webp", ImageProcessingOptions{StripMetadata: true})
+
+		assert.NilError(t, err)
+		assert.Equal(t, contentType, "image/webp")
+		assert.DeepEqual(t, result, data)
+	})
+
+	t.Run("Oversized WebP is downscaled to PNG", func(t *testing.T) {
+		// 40x20 lossless WebP
+		data, err := base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvJ8AEEAcQERGIiP4HAA==")
+		assert.NilError(t, err)
+
+		result, contentType, err := ProcessImage(data, "image/webp", ImageProcessingOptions{MaxDimension: 10})
+
+		assert.NilError(t, err)
+		assert.Equal(t, contentType, "image/png")
+		config, format, err := image.DecodeConfig(bytes.NewReader(result))
+		assert.NilError(t, err)
+		assert.Equal(t, format, "png")
+		assert.Equal(t, config.Width, 10)
+		assert.Equal(t, config.Height, 5)
+	})
+}
@@ -3,14 +3,16 @@ package matrix
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"html"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"os/signal"
 	"regexp"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"maunium.net/go/mautrix"
@@ -28,15 +30,44 @@ type MautrixClientType interface {
 	SendMessageEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, content interface{}, extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error)
 	JoinedMembers(ctx context.Context, roomID id.RoomID) (resp *mautrix.RespJoinedMembers, err error)
 	UploadMedia(ctx context.Context, data mautrix.ReqUploadMedia) (*mautrix.RespMediaUpload, error)
+	CreateRoom(ctx context.Context, req *mautrix.ReqCreateRoom) (*mautrix.RespCreateRoom, error)
+	SendStateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, contentJSON any, extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error)
+	GetAccountData(ctx context.Context, name string, output interface{}) error
+	SetAccountData(ctx context.Context, name string, data interface{}) error
+	RedactEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID, extra ...mautrix.ReqRedact) (*mautrix.RespSendEvent, error)
 	Sync() error
 }
 
 type MatrixState struct {
+	UserID                    id.UserID
 	IsEncrypted               bool
 	MatrixContext             context.Context
 	MautrixClient             MautrixClientType
 	OlmMachine                *crypto.OlmMachine
 	DownloadFromHostAllowlist []*regexp.Regexp
+	ImageProcessing           ImageProcessingOptions
+	DownloadWorkers           int
+	DownloadTimeout           time.Duration
+	ConnectedAt               time.Time
+	// Outbox keeps messages which could not be sent yet. Without it, such
+	// messages are dropped.
+	Outbox *Outbox
+
+	eventHandlersMutex sync.RWMutex
+	eventHandlers      []RoomEventHandler
+	roomEventsOnce     sync.Once
+	roomEvents         chan queuedRoomEvent
+	// Guards DownloadFromHostAllowlist, which may be replaced while running.
+	allowlistMutex sync.RWMutex
+	// Serializes direct chat lookups, so that concurrent messages to the same
+	// user do not create multiple direct chats. Also guards directRooms.
+	directMutex sync.Mutex
+	// Direct chats by user
+	directRooms map[id.UserID]id.RoomID
+
+	cryptoHelper *cryptohelper.CryptoHelper
+	stopSync     context.CancelFunc
+	syncDone     chan struct{}
 }
 
 func Connect(
@@ -46,6 +77,9 @@ func Connect(
 	password string,
 	token string,
 	downloadFromHostAllowlist []*regexp.Regexp,
+	imageProcessing ImageProcessingOptions,
+	downloadWorkers int,
+	downloadTimeout time.Duration,
 ) *MatrixState {
 	ctx := context.Background()
 	cli, err := mautrix.NewClient(homeServerURL, "", "")
@@ -62,8 +96,21 @@ func Connect(
 	}
 	cli.Client.Transport = &signatureInterceptorRoundTripper{underlying: transport}
 
+	state := &MatrixState{
+		MatrixContext:             ctx,
+		MautrixClient:             cli,
+		DownloadFromHostAllowlist: downloadFromHostAllowlist,
+		ImageProcessing:           imageProcessing,
+		DownloadWorkers:           downloadWorkers,
+		DownloadTimeout:           downloadTimeout,
+		ConnectedAt:               time.Now(),
+	}
+
 	syncer := cli.Syncer.(*mautrix.DefaultSyncer)
 	syncer.OnEventType(event.StateMember, func(ctx context.Context, evt *event.Event) {
+		if evt.GetStateKey() == cli.UserID.String() && evt.Content.AsMember().Membership.IsLeaveOrBan() {
+			forgetDirectRoom(state, evt.RoomID)
+		}
 		if evt.GetStateKey() == cli.UserID.String() && evt.Content.AsMember().Membership == event.MembershipInvite {
 			_, err := cli.JoinRoomByID(ctx, evt.RoomID)
 			if err == nil {
@@ -85,6 +132,7 @@ func Connect(
 			return
 		}
 		RewriteInRoomVerificationEventID(evt)
+		DispatchRoomEvent(ctx, state, evt)
 	})
 
 	var login *mautrix.ReqLogin
@@ -115,6 +163,7 @@ func Connect(
 		log.Fatal().Err(err).Msg("Login failed.")
 	}
 	cli.Crypto = cryptoHelper
+	state.UserID = cli.UserID
 
 	// Load or bootstrap cross-signing keys.
 	// The private cross-signing keys are required for the SAS verification
@@ -143,110 +192,308 @@ func Connect(
 
 	// Start long polling in the background
 	syncCtx, cancelSync := context.WithCancel(ctx)
+	state.cryptoHelper = cryptoHelper
+	state.stopSync = cancelSync
+	state.syncDone = make(chan struct{})
 	go func() {
-		err = cli.SyncWithContext(syncCtx)
-		if err != nil {
+		defer close(state.syncDone)
+		err := cli.SyncWithContext(syncCtx)
+		if err != nil && syncCtx.Err() == nil {
 			log.Fatal().Err(err).Msg("Error during Sync with Matrix server")
 		}
 	}()
-	c := make(chan os.Signal, 1)
-	signal.Notify(c,
-		syscall.SIGABRT,
-		syscall.SIGHUP,
-		syscall.SIGINT,
-		syscall.SIGQUIT,
-		syscall.SIGTERM,
-	)
-	go func() {
-		for range c { // when the process is killed
-			log.Info().Msg("Cleaning up...")
-			cryptoHelper.Close()
-			cancelSync()
-			os.Exit(0)
-		}
-	}()
 
 	log.Info().Msgf("Connected to Matrix.")
 
-	return &MatrixState{
-		MatrixContext:             ctx,
-		MautrixClient:             cli,
-		DownloadFromHostAllowlist: downloadFromHostAllowlist,
+	return state
+}
+
+// Disconnect stops the sync loop and closes the crypto store.
+func Disconnect(state *MatrixState) {
+	if state.stopSync != nil {
+		state.stopSync()
+		<-state.syncDone
+	}
+	if state.cryptoHelper != nil {
+		if err := state.cryptoHelper.Close(); err != nil {
+			log.Error().Err(err).Msg("Could not close crypto store")
+		}
 	}
+	log.Info().Msg("Disconnected from Matrix.")
 }
 
-func SendMessage(state *MatrixState, roomID string, markDownMessage string) {
-	matrixRoomId := id.RoomID(roomID)
+// SendMessage sends a markdown message. The returned event ID is empty if
+// the message could not be sent right away; it is then retried by the
+// outbox, if there is one.
+func SendMessage(state *MatrixState, roomID string, markDownMessage string) id.EventID {
+	log.Debug().Msgf("Message as Markdown: %s", markDownMessage)
 
-	log.Debug().Msg("Sending message to matrix...")
+	content := format.RenderMarkdown(
+		markDownMessage,
+		/*allowMarkdown = */ true,
+		/*allowHTML = */ false)
+
+	return sendContent(state, roomID, content)
+}
+
+// SendThreadMessage sends a markdown message as a reply in the thread of
+// threadRoot. Clients without thread support show it as a reply.
+func SendThreadMessage(state *MatrixState, roomID string, threadRoot id.EventID, markDownMessage string) id.EventID {
+	log.Debug().Msgf("Message as Markdown in thread %s: %s", threadRoot, markDownMessage)
+
+	content := format.RenderMarkdown(
+		markDownMessage,
+		/*allowMarkdown = */ true,
+		/*allowHTML = */ false)
+	content.RelatesTo = (&event.RelatesTo{}).SetThread(threadRoot, threadRoot)
+
+	return sendContent(state, roomID, content)
+}
+
+// SendTrackedMessage sends a markdown message, in the thread of threadRoot
+// unless it is empty. If the message is left to the outbox, the event ID is
+// empty and the transaction ID is returned instead, which the outbox passes
+// to its OnDelivered function once the message is sent.
+func SendTrackedMessage(state *MatrixState, roomID string, threadRoot id.EventID, markDownMessage string) (id.EventID, string) {
 	log.Debug().Msgf("Message as Markdown: %s", markDownMessage)
-	log.Debug().Msgf("Room ID: %s", matrixRoomId)
 
 	content := format.RenderMarkdown(
 		markDownMessage,
 		/*allowMarkdown = */ true,
 		/*allowHTML = */ false)
+	if threadRoot != "" {
+		content.RelatesTo = (&event.RelatesTo{}).SetThread(threadRoot, threadRoot)
+	}
+
+	entry, err := newOutboxEntry(id.RoomID(roomID), event.EventMessage, content)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not prepare message for matrix.")
+		return "", ""
+	}
+	eventID, queued := deliver(state, entry)
+	if queued {
+		return "", entry.TransactionID
+	}
+	return eventID, ""
+}
+
+// SendNotice sends a markdown message as m.notice, which clients show less
+// prominently and bots do not respond to.
+func SendNotice(state *MatrixState, roomID string, markDownMessage string) id.EventID {
+	content := format.RenderMarkdown(
+		markDownMessage,
+		/*allowMarkdown = */ true,
+		/*allowHTML = */ false)
+	content.MsgType = event.MsgNotice
 
+	return sendContent(state, roomID, content)
+}
+
+// SendReaction reacts to an event with the given key, usually an emoji.
+func SendReaction(state *MatrixState, roomID string, eventID id.EventID, key string) error {
 	_, err := state.MautrixClient.SendMessageEvent(
 		state.MatrixContext,
-		matrixRoomId,
-		event.EventMessage,
-		content)
+		id.RoomID(roomID),
+		event.EventReaction,
+		&event.ReactionEventContent{
+			RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: eventID, Key: key},
+		})
+	return err
+}
+
+// RedactEvent removes an event from a room.
+func RedactEvent(state *MatrixState, roomID string, eventID id.EventID, reason string) error {
+	_, err := state.MautrixClient.RedactEvent(state.MatrixContext, id.RoomID(roomID), eventID, mautrix.ReqRedact{Reason: reason})
+	return err
+}
+
+// SendReplyMessage sends a markdown message as a reply to another event.
+func SendReplyMessage(state *MatrixState, roomID string, replyTo id.EventID, markDownMessage string) id.EventID {
+	log.Debug().Msgf("Message as Markdown in reply to %s: %s", replyTo, markDownMessage)
+
+	content := format.RenderMarkdown(
+		markDownMessage,
+		/*allowMarkdown = */ true,
+		/*allowHTML = */ false)
+	content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(replyTo)
+
+	return sendContent(state, roomID, content)
+}
+
+// SendHTMLMessage sends a message with the given HTML body. The HTML must
+// already be safe; use MarkdownToHTML to render untrusted content.
+func SendHTMLMessage(state *MatrixState, roomID string, htmlMessage string) id.EventID {
+	log.Debug().Msgf("Message as HTML: %s", htmlMessage)
+
+	return sendContent(state, roomID, format.HTMLToContent(htmlMessage))
+}
+
+func sendContent(state *MatrixState, roomID string, content event.MessageEventContent) id.EventID {
+	matrixRoomId := id.RoomID(roomID)
+
+	log.Debug().Msg("Sending message to matrix...")
+	log.Debug().Msgf("Room ID: %s", matrixRoomId)
 
+	entry, err := newOutboxEntry(matrixRoomId, event.EventMessage, content)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Could not send message to matrix.")
+		log.Error().Err(err).Msg("Could not prepare message for matrix.")
+		return ""
 	}
+	eventID, _ := deliver(state, entry)
+	return eventID
+}
+
+// MarkdownToHTML renders markdown to HTML the same way as SendMessage does.
+func MarkdownToHTML(markDownMessage string) string {
+	content := format.RenderMarkdown(
+		markDownMessage,
+		/*allowMarkdown = */ true,
+		/*allowHTML = */ false)
+	if content.Format == event.FormatHTML {
+		return content.FormattedBody
+	}
+	return html.EscapeString(content.Body)
+}
+
+// EditMessage replaces the content of a previously sent message.
+func EditMessage(state *MatrixState, roomID string, eventID id.EventID, markDownMessage string) error {
+	log.Debug().Msgf("Editing message %s in room %s", eventID, roomID)
 
+	content := format.RenderMarkdown(
+		markDownMessage,
+		/*allowMarkdown = */ true,
+		/*allowHTML = */ false)
+	content.SetEdit(eventID)
+
+	_, err := state.MautrixClient.SendMessageEvent(
+		state.MatrixContext,
+		id.RoomID(roomID),
+		event.EventMessage,
+		&content)
+	return err
 }
 
 var imageRegexp *regexp.Regexp = regexp.MustCompile(`\!\[\]\(http.*?\)`)
 
+const (
+	defaultDownloadWorkers = 4
+	defaultDownloadTimeout = 60 * time.Second
+	// Larger images are not downloaded.
+	maxImageSize = 50 << 20
+)
+
+type imageReference struct {
+	start  int
+	end    int
+	rawUrl string
+	newUrl string
+}
+
+// SetDownloadAllowlist replaces the hosts images may be downloaded from.
+func SetDownloadAllowlist(state *MatrixState, allowlist []*regexp.Regexp) {
+	state.allowlistMutex.Lock()
+	defer state.allowlistMutex.Unlock()
+	state.DownloadFromHostAllowlist = allowlist
+}
+
 func UploadImages(state *MatrixState, markDownMessage string) string {
-	if len(state.DownloadFromHostAllowlist) == 0 {
+	state.allowlistMutex.RLock()
+	allowlist := state.DownloadFromHostAllowlist
+	state.allowlistMutex.RUnlock()
+	if len(allowlist) == 0 {
 		return markDownMessage
 	}
-	leftMost := 0
-	for loc := imageRegexp.FindStringIndex(markDownMessage[leftMost:]); loc != nil && leftMost < len(markDownMessage); loc = imageRegexp.FindStringIndex(markDownMessage[leftMost:]) {
-		index := loc[0] + leftMost
-		end := loc[1] + leftMost
-		leftMost = index + 1
-		rawUrl := markDownMessage[index+4 : end-1]
 
-		parsed, err := url.Parse(rawUrl)
-		if err != nil {
-			log.Warn().Err(err).Msgf("Failed to parse url %s", rawUrl)
-			continue
-		}
-		allowed := false
-		for _, allow := range state.DownloadFromHostAllowlist {
-			if allow.MatchString(parsed.Host) {
-				allowed = true
-				break
-			}
+	var images []*imageReference
+	for _, loc := range imageRegexp.FindAllStringIndex(markDownMessage, -1) {
+		rawUrl := markDownMessage[loc[0]+4 : loc[1]-1]
+		if isDownloadAllowed(allowlist, rawUrl) {
+			images = append(images, &imageReference{start: loc[0], end: loc[1], rawUrl: rawUrl, newUrl: rawUrl})
 		}
+	}
+	if len(images) == 0 {
+		return markDownMessage
+	}
 
-		if !allowed {
-			log.Info().Msgf("Host is not on allowlist: %s; not downloading %s", parsed.Host, rawUrl)
-			continue
-		}
+	workers := state.DownloadWorkers
+	if workers <= 0 {
+		workers = defaultDownloadWorkers
+	}
+	timeout := state.DownloadTimeout
+	if timeout <= 0 {
+		timeout = defaultDownloadTimeout
+	}
 
-		newUrl := downloadAndUploadImage(rawUrl, state)
-		log.Debug().Msgf("Image was stored as %s", newUrl)
+	ctx, cancel := context.WithTimeout(state.MatrixContext, timeout)
+	defer cancel()
+
+	semaphore := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, image := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			image.newUrl = downloadAndUploadImage(ctx, image.rawUrl, state)
+			log.Debug().Msgf("Image was stored as %s", image.newUrl)
+		}()
+	}
+	wg.Wait()
+
+	var result strings.Builder
+	previousEnd := 0
+	for _, image := range images {
+		result.WriteString(markDownMessage[previousEnd:image.start])
+		result.WriteString("![](" + image.newUrl + ")")
+		previousEnd = image.end
+	}
+	result.WriteString(markDownMessage[previousEnd:])
+	return result.String()
+}
 
-		replacement := "![](" + newUrl + ")"
-		markDownMessage = markDownMessage[:index] + string(replacement) + markDownMessage[end:]
+func isDownloadAllowed(allowlist []*regexp.Regexp, rawUrl string) bool {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to parse url %s", rawUrl)
+		return false
 	}
-	return markDownMessage
+	for _, allow := range allowlist {
+		if allow.MatchString(parsed.Host) {
+			return true
+		}
+	}
+	log.Info().Msgf("Host is not on allowlist: %s; not downloading %s", parsed.Host, rawUrl)
+	return false
 }
 
-func downloadAndUploadImage(url string, state *MatrixState) string {
+func downloadAndUploadImage(ctx context.Context, url string, state *MatrixState) string {
+	newUrl, err := uploadImageFromURL(ctx, url, state)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to transfer image %s", url)
+		return url
+	}
+	return string(newUrl)
+}
+
+// UploadImageFromURL downloads an image and uploads it to the Matrix media
+// repository, applying the configured image processing.
+func UploadImageFromURL(state *MatrixState, url string) (id.ContentURIString, error) {
+	return uploadImageFromURL(state.MatrixContext, url, state)
+}
+
+func uploadImageFromURL(ctx context.Context, url string, state *MatrixState) (id.ContentURIString, error) {
 	log.Debug().Msgf("Downloading image from %s", url)
-	downloadRespose, err := http.Get(url)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	downloadRespose, err := http.DefaultClient.Do(request)
 
 	if err != nil {
-		log.Warn().Err(err).Msgf("Failed to download %s", url)
-		return url
+		return "", err
 	}
+	defer downloadRespose.Body.Close()
 
 	contentType := downloadRespose.Header.Get("Content-Type")
 	contentLength := downloadRespose.ContentLength
@@ -254,21 +501,51 @@ func downloadAndUploadImage(url string, state *MatrixState) string {
 	log.Debug().Msgf("Found image of type %s with length %d", contentType, contentLength)
 
 	if !strings.HasPrefix(contentType, "image/") {
-		log.Warn().Err(err).Msgf("Invalid image content type: %s", contentType)
-		return url
+		return "", fmt.Errorf("invalid image content type: %s", contentType)
+	}
+	if contentLength > maxImageSize {
+		return "", fmt.Errorf("image of %d bytes is too large", contentLength)
 	}
 
-	resp, err := state.MautrixClient.UploadMedia(state.MatrixContext, mautrix.ReqUploadMedia{
+	uploadRequest := mautrix.ReqUploadMedia{
 		Content:       downloadRespose.Body,
 		ContentLength: contentLength,
 		ContentType:   contentType,
-	})
+	}
+
+	if state.ImageProcessing.IsEnabled() || contentLength < 0 {
+		// Reads one byte more than allowed, to tell if the image is too large.
+		data, err := io.ReadAll(io.LimitReader(downloadRespose.Body, maxImageSize+1))
+		if err != nil {
+			return "", err
+		}
+		if len(data) > maxImageSize {
+			return "", fmt.Errorf("image is larger than %d bytes", maxImageSize)
+		}
+		uploadRequest = mautrix.ReqUploadMedia{
+			ContentBytes: data,
+			ContentType:  contentType,
+		}
+	}
+
+	if state.ImageProcessing.IsEnabled() {
+		data := uploadRequest.ContentBytes
+		processed, processedType, err := ProcessImage(data, contentType, state.ImageProcessing)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to process image, uploading original")
+			processed, processedType = data, contentType
+		}
+		uploadRequest = mautrix.ReqUploadMedia{
+			ContentBytes: processed,
+			ContentType:  processedType,
+		}
+	}
+
+	resp, err := state.MautrixClient.UploadMedia(ctx, uploadRequest)
 	if err != nil {
-		log.Warn().Err(err).Msg("Failed to upload image")
-		return url
+		return "", err
 	}
-	newUrl := resp.ContentURI.CUString()
-	return string(newUrl)
+	return resp.ContentURI.CUString(), nil
 }
 
 func RewriteInRoomVerificationEventID(evt *event.Event) {
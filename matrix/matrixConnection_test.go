@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"regexp"
 	"testing"
+	"time"
 
 	. "gotify_matrix_bot/matrix"
 
@@ -51,13 +52,123 @@ func TestSendMessage(t *testing.T) {
 			/*allowMarkdown = */ true,
 			/*allowHTML = */ false)
 
-		SendMessage(state, roomID, message)
+		pegomock.When(mockClient.SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]())).
+			ThenReturn(&mautrix.RespSendEvent{EventID: "$event"}, nil)
 
+		eventID := SendMessage(state, roomID, message)
+
+		assert.Equal(t, eventID, id.EventID("$event"))
 		mockClient.VerifyWasCalledOnce().SendMessageEvent(
 			pegomock.Any[context.Context](),
 			pegomock.Eq(id.RoomID(roomID)),
 			pegomock.Eq(event.EventMessage),
-			pegomock.Eq(content))
+			pegomock.Eq(content),
+			pegomock.Any[mautrix.ReqSendEvent]())
+	})
+
+	t.Run("Edit message", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+
+		err := EditMessage(state, "!room:example.com", "$original", "New text")
+
+		assert.NilError(t, err)
+		_, roomID, _, content, _ := mockClient.VerifyWasCalledOnce().SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Eq(event.EventMessage),
+			pegomock.Any[any]()).GetCapturedArguments()
+		assert.Equal(t, roomID, id.RoomID("!room:example.com"))
+		edit := content.(*event.MessageEventContent)
+		assert.Equal(t, edit.RelatesTo.Type, event.RelReplace)
+		assert.Equal(t, edit.RelatesTo.EventID, id.EventID("$original"))
+		assert.Equal(t, edit.NewContent.Body, "New text")
+		assert.Equal(t, edit.Body, "* New text")
+	})
+
+	t.Run("Send message in thread", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+
+		pegomock.When(mockClient.SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]())).
+			ThenReturn(&mautrix.RespSendEvent{EventID: "$reply"}, nil)
+
+		eventID := SendThreadMessage(state, "!room:example.com", "$root", "Reply")
+
+		assert.Equal(t, eventID, id.EventID("$reply"))
+		_, _, _, content, _ := mockClient.VerifyWasCalledOnce().SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Eq(id.RoomID("!room:example.com")),
+			pegomock.Eq(event.EventMessage),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]()).GetCapturedArguments()
+		reply := content.(event.MessageEventContent)
+		assert.Equal(t, reply.Body, "Reply")
+		assert.Equal(t, reply.RelatesTo.Type, event.RelThread)
+		assert.Equal(t, reply.RelatesTo.EventID, id.EventID("$root"))
+		assert.Equal(t, reply.RelatesTo.GetReplyTo(), id.EventID("$root"))
+	})
+
+	t.Run("Send reply", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+
+		pegomock.When(mockClient.SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]())).
+			ThenReturn(&mautrix.RespSendEvent{EventID: "$reply"}, nil)
+
+		eventID := SendReplyMessage(state, "!room:example.com", "$original", "Reply")
+
+		assert.Equal(t, eventID, id.EventID("$reply"))
+		_, _, _, content, _ := mockClient.VerifyWasCalledOnce().SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Eq(id.RoomID("!room:example.com")),
+			pegomock.Eq(event.EventMessage),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]()).GetCapturedArguments()
+		reply := content.(event.MessageEventContent)
+		assert.Equal(t, reply.RelatesTo.Type, event.RelationType(""))
+		assert.Equal(t, reply.RelatesTo.GetReplyTo(), id.EventID("$original"))
+	})
+
+	t.Run("Send reaction", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+
+		err := SendReaction(state, "!room:example.com", "$original", "✅")
+
+		assert.NilError(t, err)
+		_, _, _, content, _ := mockClient.VerifyWasCalledOnce().SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Eq(id.RoomID("!room:example.com")),
+			pegomock.Eq(event.EventReaction),
+			pegomock.Any[any]()).GetCapturedArguments()
+		reaction := content.(*event.ReactionEventContent)
+		assert.Equal(t, reaction.RelatesTo.GetAnnotationID(), id.EventID("$original"))
+		assert.Equal(t, reaction.RelatesTo.GetAnnotationKey(), "✅")
+	})
+
+	t.Run("Redact event", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+
+		err := RedactEvent(state, "!room:example.com", "$original", "Deleted")
+
+		assert.NilError(t, err)
+		mockClient.VerifyWasCalledOnce().RedactEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Eq(id.RoomID("!room:example.com")),
+			pegomock.Eq(id.EventID("$original")),
+			pegomock.Eq(mautrix.ReqRedact{Reason: "Deleted"}))
 	})
 
 }
@@ -105,6 +216,53 @@ func TestUploadImages(t *testing.T) {
 			pegomock.Any[event.Type](),
 			pegomock.Any[any]())
 	})
+	t.Run("Multiple images are replaced in their original positions", func(t *testing.T) {
+		server, serverUrl := setupHttpServer("image/png")
+		mockClient, state := setupMock(t, []*regexp.Regexp{
+			regexp.MustCompile(".*"),
+		})
+		state.DownloadWorkers = 2
+		defer server.Close()
+
+		pegomock.When(mockClient.UploadMedia(
+			pegomock.Any[context.Context](),
+			pegomock.Any[mautrix.ReqUploadMedia]())).
+			ThenReturn(
+				&mautrix.RespMediaUpload{
+					ContentURI: id.MustParseContentURI("mxc://example.com/uploaded"),
+				},
+				nil,
+			)
+
+		message := "A ![](" + serverUrl + "/1.png) B ![](http://blocked.invalid/2.png) C ![](" + serverUrl + "/3.png) D"
+		state.DownloadFromHostAllowlist = []*regexp.Regexp{regexp.MustCompile("127\\.0\\.0\\.1")}
+		result := UploadImages(state, message)
+		assert.Equal(t, result, "A ![](mxc://example.com/uploaded) B ![](http://blocked.invalid/2.png) C ![](mxc://example.com/uploaded) D")
+
+		mockClient.VerifyWasCalled(pegomock.Times(2)).UploadMedia(
+			pegomock.Any[context.Context](),
+			pegomock.Any[mautrix.ReqUploadMedia]())
+	})
+
+	t.Run("Slow downloads are abandoned after the timeout", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		mockClient, state := setupMock(t, []*regexp.Regexp{
+			regexp.MustCompile(".*"),
+		})
+		state.DownloadTimeout = 50 * time.Millisecond
+		defer server.Close()
+
+		message := "Before\n![](" + server.URL + "/image.png)\nAfter"
+		result := UploadImages(state, message)
+		assert.Equal(t, result, message)
+
+		mockClient.VerifyWasCalled(pegomock.Never()).UploadMedia(
+			pegomock.Any[context.Context](),
+			pegomock.Any[mautrix.ReqUploadMedia]())
+	})
+
 	t.Run("Non-Images are passed through", func(t *testing.T) {
 		server, serverUrl := setupHttpServer("text/plain")
 		mockClient, state := setupMock(t, []*regexp.Regexp{
@@ -165,6 +323,26 @@ func TestUploadImages(t *testing.T) {
 			pegomock.Any[mautrix.ReqUploadMedia]())
 	})
 
+	t.Run("Allowlist can be replaced", func(t *testing.T) {
+		server, serverUrl := setupHttpServer("image/png")
+		mockClient, state := setupMock(t, nil)
+		defer server.Close()
+
+		pegomock.When(mockClient.UploadMedia(
+			pegomock.Any[context.Context](),
+			pegomock.Any[mautrix.ReqUploadMedia]())).
+			ThenReturn(
+				&mautrix.RespMediaUpload{
+					ContentURI: id.MustParseContentURI("mxc://example.com/uploaded"),
+				},
+				nil,
+			)
+
+		SetDownloadAllowlist(state, []*regexp.Regexp{regexp.MustCompile(".*")})
+		result := UploadImages(state, "![]("+serverUrl+"/image.png)")
+		assert.Equal(t, result, "![](mxc://example.com/uploaded)")
+	})
+
 }
 
 func TestRewriteInRoomVerificationEventID(t *testing.T) {
@@ -28,6 +28,40 @@ func NewMockMautrixClientType(options ...pegomock.Option) *MockMautrixClientType
 func (mock *MockMautrixClientType) SetFailHandler(fh pegomock.FailHandler) { mock.fail = fh }
 func (mock *MockMautrixClientType) FailHandler() pegomock.FailHandler      { return mock.fail }
 
+func (mock *MockMautrixClientType) CreateRoom(ctx context.Context, req *mautrix.ReqCreateRoom) (*mautrix.RespCreateRoom, error) {
+	if mock == nil {
+		panic("mock must not be nil. Use myMock := NewMockMautrixClientType().")
+	}
+	_params := []pegomock.Param{ctx, req}
+	_result := pegomock.GetGenericMockFrom(mock).Invoke("CreateRoom", _params, []reflect.Type{reflect.TypeOf((**mautrix.RespCreateRoom)(nil)).Elem(), reflect.TypeOf((*error)(nil)).Elem()})
+	var _ret0 *mautrix.RespCreateRoom
+	var _ret1 error
+	if len(_result) != 0 {
+		if _result[0] != nil {
+			_ret0 = _result[0].(*mautrix.RespCreateRoom)
+		}
+		if _result[1] != nil {
+			_ret1 = _result[1].(error)
+		}
+	}
+	return _ret0, _ret1
+}
+
+func (mock *MockMautrixClientType) GetAccountData(ctx context.Context, name string, output interface{}) error {
+	if mock == nil {
+		panic("mock must not be nil. Use myMock := NewMockMautrixClientType().")
+	}
+	_params := []pegomock.Param{ctx, name, output}
+	_result := pegomock.GetGenericMockFrom(mock).Invoke("GetAccountData", _params, []reflect.Type{reflect.TypeOf((*error)(nil)).Elem()})
+	var _ret0 error
+	if len(_result) != 0 {
+		if _result[0] != nil {
+			_ret0 = _result[0].(error)
+		}
+	}
+	return _ret0
+}
+
 func (mock *MockMautrixClientType) JoinedMembers(ctx context.Context, roomID id.RoomID) (*mautrix.RespJoinedMembers, error) {
 	if mock == nil {
 		panic("mock must not be nil. Use myMock := NewMockMautrixClientType().")
@@ -47,6 +81,28 @@ func (mock *MockMautrixClientType) JoinedMembers(ctx context.Context, roomID id.
 	return _ret0, _ret1
 }
 
+func (mock *MockMautrixClientType) RedactEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID, extra ...mautrix.ReqRedact) (*mautrix.RespSendEvent, error) {
+	if mock == nil {
+		panic("mock must not be nil. Use myMock := NewMockMautrixClientType().")
+	}
+	_params := []pegomock.Param{ctx, roomID, eventID}
+	for _, param := range extra {
+		_params = append(_params, param)
+	}
+	_result := pegomock.GetGenericMockFrom(mock).Invoke("RedactEvent", _params, []reflect.Type{reflect.TypeOf((**mautrix.RespSendEvent)(nil)).Elem(), reflect.TypeOf((*error)(nil)).Elem()})
+	var _ret0 *mautrix.RespSendEvent
+	var _ret1 error
+	if len(_result) != 0 {
+		if _result[0] != nil {
+			_ret0 = _result[0].(*mautrix.RespSendEvent)
+		}
+		if _result[1] != nil {
+			_ret1 = _result[1].(error)
+		}
+	}
+	return _ret0, _ret1
+}
+
 func (mock *MockMautrixClientType) SendMessageEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, content interface{}, extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
 	if mock == nil {
 		panic("mock must not be nil. Use myMock := NewMockMautrixClientType().")
@@ -69,6 +125,43 @@ func (mock *MockMautrixClientType) SendMessageEvent(ctx context.Context, roomID
 	return _ret0, _ret1
 }
 
+func (mock *MockMautrixClientType) SendStateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, contentJSON any, extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+	if mock == nil {
+		panic("mock must not be nil. Use myMock := NewMockMautrixClientType().")
+	}
+	_params := []pegomock.Param{ctx, roomID, eventType, stateKey, contentJSON}
+	for _, param := range extra {
+		_params = append(_params, param)
+	}
+	_result := pegomock.GetGenericMockFrom(mock).Invoke("SendStateEvent", _params, []reflect.Type{reflect.TypeOf((**mautrix.RespSendEvent)(nil)).Elem(), reflect.TypeOf((*error)(nil)).Elem()})
+	var _ret0 *mautrix.RespSendEvent
+	var _ret1 error
+	if len(_result) != 0 {
+		if _result[0] != nil {
+			_ret0 = _result[0].(*mautrix.RespSendEvent)
+		}
+		if _result[1] != nil {
+			_ret1 = _result[1].(error)
+		}
+	}
+	return _ret0, _ret1
+}
+
+func (mock *MockMautrixClientType) SetAccountData(ctx context.Context, name string, data interface{}) error {
+	if mock == nil {
+		panic("mock must not be nil. Use myMock := NewMockMautrixClientType().")
+	}
+	_params := []pegomock.Param{ctx, name, data}
+	_result := pegomock.GetGenericMockFrom(mock).Invoke("SetAccountData", _params, []reflect.Type{reflect.TypeOf((*error)(nil)).Elem()})
+	var _ret0 error
+	if len(_result) != 0 {
+		if _result[0] != nil {
+			_ret0 = _result[0].(error)
+		}
+	}
+	return _ret0
+}
+
 func (mock *MockMautrixClientType) Sync() error {
 	if mock == nil {
 		panic("mock must not be nil. Use myMock := NewMockMautrixClientType().")
@@ -140,6 +233,82 @@ type VerifierMockMautrixClientType struct {
 	timeout                time.Duration
 }
 
+func (verifier *VerifierMockMautrixClientType) CreateRoom(ctx context.Context, req *mautrix.ReqCreateRoom) *MockMautrixClientType_CreateRoom_OngoingVerification {
+	_params := []pegomock.Param{ctx, req}
+	methodInvocations := pegomock.GetGenericMockFrom(verifier.mock).Verify(verifier.inOrderContext, verifier.invocationCountMatcher, "CreateRoom", _params, verifier.timeout)
+	return &MockMautrixClientType_CreateRoom_OngoingVerification{mock: verifier.mock, methodInvocations: methodInvocations}
+}
+
+type MockMautrixClientType_CreateRoom_OngoingVerification struct {
+	mock              *MockMautrixClientType
+	methodInvocations []pegomock.MethodInvocation
+}
+
+func (c *MockMautrixClientType_CreateRoom_OngoingVerification) GetCapturedArguments() (context.Context, *mautrix.ReqCreateRoom) {
+	ctx, req := c.GetAllCapturedArguments()
+	return ctx[len(ctx)-1], req[len(req)-1]
+}
+
+func (c *MockMautrixClientType_CreateRoom_OngoingVerification) GetAllCapturedArguments() (_param0 []context.Context, _param1 []*mautrix.ReqCreateRoom) {
+	_params := pegomock.GetGenericMockFrom(c.mock).GetInvocationParams(c.methodInvocations)
+	if len(_params) > 0 {
+		if len(_params) > 0 {
+			_param0 = make([]context.Context, len(c.methodInvocations))
+			for u, param := range _params[0] {
+				_param0[u] = param.(context.Context)
+			}
+		}
+		if len(_params) > 1 {
+			_param1 = make([]*mautrix.ReqCreateRoom, len(c.methodInvocations))
+			for u, param := range _params[1] {
+				_param1[u] = param.(*mautrix.ReqCreateRoom)
+			}
+		}
+	}
+	return
+}
+
+func (verifier *VerifierMockMautrixClientType) GetAccountData(ctx context.Context, name string, output interface{}) *MockMautrixClientType_GetAccountData_OngoingVerification {
+	_params := []pegomock.Param{ctx, name, output}
+	methodInvocations := pegomock.GetGenericMockFrom(verifier.mock).Verify(verifier.inOrderContext, verifier.invocationCountMatcher, "GetAccountData", _params, verifier.timeout)
+	return &MockMautrixClientType_GetAccountData_OngoingVerification{mock: verifier.mock, methodInvocations: methodInvocations}
+}
+
+type MockMautrixClientType_GetAccountData_OngoingVerification struct {
+	mock              *MockMautrixClientType
+	methodInvocations []pegomock.MethodInvocation
+}
+
+func (c *MockMautrixClientType_GetAccountData_OngoingVerification) GetCapturedArguments() (context.Context, string, interface{}) {
+	ctx, name, output := c.GetAllCapturedArguments()
+	return ctx[len(ctx)-1], name[len(name)-1], output[len(output)-1]
+}
+
+func (c *MockMautrixClientType_GetAccountData_OngoingVerification) GetAllCapturedArguments() (_param0 []context.Context, _param1 []string, _param2 []interface{}) {
+	_params := pegomock.GetGenericMockFrom(c.mock).GetInvocationParams(c.methodInvocations)
+	if len(_params) > 0 {
+		if len(_params) > 0 {
+			_param0 = make([]context.Context, len(c.methodInvocations))
+			for u, param := range _params[0] {
+				_param0[u] = param.(context.Context)
+			}
+		}
+		if len(_params) > 1 {
+			_param1 = make([]string, len(c.methodInvocations))
+			for u, param := range _params[1] {
+				_param1[u] = param.(string)
+			}
+		}
+		if len(_params) > 2 {
+			_param2 = make([]interface{}, len(c.methodInvocations))
+			for u, param := range _params[2] {
+				_param2[u] = param.(interface{})
+			}
+		}
+	}
+	return
+}
+
 func (verifier *VerifierMockMautrixClientType) JoinedMembers(ctx context.Context, roomID id.RoomID) *MockMautrixClientType_JoinedMembers_OngoingVerification {
 	_params := []pegomock.Param{ctx, roomID}
 	methodInvocations := pegomock.GetGenericMockFrom(verifier.mock).Verify(verifier.inOrderContext, verifier.invocationCountMatcher, "JoinedMembers", _params, verifier.timeout)
@@ -175,6 +344,59 @@ func (c *MockMautrixClientType_JoinedMembers_OngoingVerification) GetAllCaptured
 	return
 }
 
+func (verifier *VerifierMockMautrixClientType) RedactEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID, extra ...mautrix.ReqRedact) *MockMautrixClientType_RedactEvent_OngoingVerification {
+	_params := []pegomock.Param{ctx, roomID, eventID}
+	for _, param := range extra {
+		_params = append(_params, param)
+	}
+	methodInvocations := pegomock.GetGenericMockFrom(verifier.mock).Verify(verifier.inOrderContext, verifier.invocationCountMatcher, "RedactEvent", _params, verifier.timeout)
+	return &MockMautrixClientType_RedactEvent_OngoingVerification{mock: verifier.mock, methodInvocations: methodInvocations}
+}
+
+type MockMautrixClientType_RedactEvent_OngoingVerification struct {
+	mock              *MockMautrixClientType
+	methodInvocations []pegomock.MethodInvocation
+}
+
+func (c *MockMautrixClientType_RedactEvent_OngoingVerification) GetCapturedArguments() (context.Context, id.RoomID, id.EventID, []mautrix.ReqRedact) {
+	ctx, roomID, eventID, extra := c.GetAllCapturedArguments()
+	return ctx[len(ctx)-1], roomID[len(roomID)-1], eventID[len(eventID)-1], extra[len(extra)-1]
+}
+
+func (c *MockMautrixClientType_RedactEvent_OngoingVerification) GetAllCapturedArguments() (_param0 []context.Context, _param1 []id.RoomID, _param2 []id.EventID, _param3 [][]mautrix.ReqRedact) {
+	_params := pegomock.GetGenericMockFrom(c.mock).GetInvocationParams(c.methodInvocations)
+	if len(_params) > 0 {
+		if len(_params) > 0 {
+			_param0 = make([]context.Context, len(c.methodInvocations))
+			for u, param := range _params[0] {
+				_param0[u] = param.(context.Context)
+			}
+		}
+		if len(_params) > 1 {
+			_param1 = make([]id.RoomID, len(c.methodInvocations))
+			for u, param := range _params[1] {
+				_param1[u] = param.(id.RoomID)
+			}
+		}
+		if len(_params) > 2 {
+			_param2 = make([]id.EventID, len(c.methodInvocations))
+			for u, param := range _params[2] {
+				_param2[u] = param.(id.EventID)
+			}
+		}
+		_param3 = make([][]mautrix.ReqRedact, len(c.methodInvocations))
+		for u := 0; u < len(c.methodInvocations); u++ {
+			_param3[u] = make([]mautrix.ReqRedact, len(_params)-3)
+			for x := 3; x < len(_params); x++ {
+				if _params[x][u] != nil {
+					_param3[u][x-3] = _params[x][u].(mautrix.ReqRedact)
+				}
+			}
+		}
+	}
+	return
+}
+
 func (verifier *VerifierMockMautrixClientType) SendMessageEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, content interface{}, extra ...mautrix.ReqSendEvent) *MockMautrixClientType_SendMessageEvent_OngoingVerification {
 	_params := []pegomock.Param{ctx, roomID, eventType, content}
 	for _, param := range extra {
@@ -234,6 +456,112 @@ func (c *MockMautrixClientType_SendMessageEvent_OngoingVerification) GetAllCaptu
 	return
 }
 
+func (verifier *VerifierMockMautrixClientType) SendStateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, contentJSON any, extra ...mautrix.ReqSendEvent) *MockMautrixClientType_SendStateEvent_OngoingVerification {
+	_params := []pegomock.Param{ctx, roomID, eventType, stateKey, contentJSON}
+	for _, param := range extra {
+		_params = append(_params, param)
+	}
+	methodInvocations := pegomock.GetGenericMockFrom(verifier.mock).Verify(verifier.inOrderContext, verifier.invocationCountMatcher, "SendStateEvent", _params, verifier.timeout)
+	return &MockMautrixClientType_SendStateEvent_OngoingVerification{mock: verifier.mock, methodInvocations: methodInvocations}
+}
+
+type MockMautrixClientType_SendStateEvent_OngoingVerification struct {
+	mock              *MockMautrixClientType
+	methodInvocations []pegomock.MethodInvocation
+}
+
+func (c *MockMautrixClientType_SendStateEvent_OngoingVerification) GetCapturedArguments() (context.Context, id.RoomID, event.Type, string, any, []mautrix.ReqSendEvent) {
+	ctx, roomID, eventType, stateKey, contentJSON, extra := c.GetAllCapturedArguments()
+	return ctx[len(ctx)-1], roomID[len(roomID)-1], eventType[len(eventType)-1], stateKey[len(stateKey)-1], contentJSON[len(contentJSON)-1], extra[len(extra)-1]
+}
+
+func (c *MockMautrixClientType_SendStateEvent_OngoingVerification) GetAllCapturedArguments() (_param0 []context.Context, _param1 []id.RoomID, _param2 []event.Type, _param3 []string, _param4 []any, _param5 [][]mautrix.ReqSendEvent) {
+	_params := pegomock.GetGenericMockFrom(c.mock).GetInvocationParams(c.methodInvocations)
+	if len(_params) > 0 {
+		if len(_params) > 0 {
+			_param0 = make([]context.Context, len(c.methodInvocations))
+			for u, param := range _params[0] {
+				_param0[u] = param.(context.Context)
+			}
+		}
+		if len(_params) > 1 {
+			_param1 = make([]id.RoomID, len(c.methodInvocations))
+			for u, param := range _params[1] {
+				_param1[u] = param.(id.RoomID)
+			}
+		}
+		if len(_params) > 2 {
+			_param2 = make([]event.Type, len(c.methodInvocations))
+			for u, param := range _params[2] {
+				_param2[u] = param.(event.Type)
+			}
+		}
+		if len(_params) > 3 {
+			_param3 = make([]string, len(c.methodInvocations))
+			for u, param := range _params[3] {
+				_param3[u] = param.(string)
+			}
+		}
+		if len(_params) > 4 {
+			_param4 = make([]any, len(c.methodInvocations))
+			for u, param := range _params[4] {
+				_param4[u] = param.(any)
+			}
+		}
+		_param5 = make([][]mautrix.ReqSendEvent, len(c.methodInvocations))
+		for u := 0; u < len(c.methodInvocations); u++ {
+			_param5[u] = make([]mautrix.ReqSendEvent, len(_params)-5)
+			for x := 5; x < len(_params); x++ {
+				if _params[x][u] != nil {
+					_param5[u][x-5] = _params[x][u].(mautrix.ReqSendEvent)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (verifier *VerifierMockMautrixClientType) SetAccountData(ctx context.Context, name string, data interface{}) *MockMautrixClientType_SetAccountData_OngoingVerification {
+	_params := []pegomock.Param{ctx, name, data}
+	methodInvocations := pegomock.GetGenericMockFrom(verifier.mock).Verify(verifier.inOrderContext, verifier.invocationCountMatcher, "SetAccountData", _params, verifier.timeout)
+	return &MockMautrixClientType_SetAccountData_OngoingVerification{mock: verifier.mock, methodInvocations: methodInvocations}
+}
+
+type MockMautrixClientType_SetAccountData_OngoingVerification struct {
+	mock              *MockMautrixClientType
+	methodInvocations []pegomock.MethodInvocation
+}
+
+func (c *MockMautrixClientType_SetAccountData_OngoingVerification) GetCapturedArguments() (context.Context, string, interface{}) {
+	ctx, name, data := c.GetAllCapturedArguments()
+	return ctx[len(ctx)-1], name[len(name)-1], data[len(data)-1]
+}
+
+func (c *MockMautrixClientType_SetAccountData_OngoingVerification) GetAllCapturedArguments() (_param0 []context.Context, _param1 []string, _param2 []interface{}) {
+	_params := pegomock.GetGenericMockFrom(c.mock).GetInvocationParams(c.methodInvocations)
+	if len(_params) > 0 {
+		if len(_params) > 0 {
+			_param0 = make([]context.Context, len(c.methodInvocations))
+			for u, param := range _params[0] {
+				_param0[u] = param.(context.Context)
+			}
+		}
+		if len(_params) > 1 {
+			_param1 = make([]string, len(c.methodInvocations))
+			for u, param := range _params[1] {
+				_param1[u] = param.(string)
+			}
+		}
+		if len(_params) > 2 {
+			_param2 = make([]interface{}, len(c.methodInvocations))
+			for u, param := range _params[2] {
+				_param2[u] = param.(interface{})
+			}
+		}
+	}
+	return
+}
+
 func (verifier *VerifierMockMautrixClientType) Sync() *MockMautrixClientType_Sync_OngoingVerification {
 	_params := []pegomock.Param{}
 	methodInvocations := pegomock.GetGenericMockFrom(verifier.mock).Verify(verifier.inOrderContext, verifier.invocationCountMatcher, "Sync", _params, verifier.timeout)
@@ -0,0 +1,384 @@
+package matrix
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	outboxNamespace      = "outbox"
+	deadLettersNamespace = "deadLetters"
+	outboxInterval       = 5 * time.Second
+
+	// Attempts made before a message is left to the outbox.
+	immediateAttempts = 3
+	// Longer waits are left to the outbox instead of blocking the caller.
+	maxImmediateDelay = 10 * time.Second
+
+	initialBackoff = time.Second
+	maxBackoff     = 5 * time.Minute
+
+	// Messages are moved to the dead letters after this many attempts, or
+	// once they were queued for this long.
+	maxAttempts = 100
+	maxQueueAge = 24 * time.Hour
+)
+
+// OutboxStore persists the messages of an Outbox. It is implemented by
+// state.Store.
+type OutboxStore interface {
+	Get(namespace string, key string) (string, bool, error)
+	Set(namespace string, key string, value string) error
+	Delete(namespace string, key string) error
+	List(namespace string) (map[string]string, error)
+}
+
+type outboxEntry struct {
+	RoomID        id.RoomID       `json:"roomID"`
+	EventType     string          `json:"eventType"`
+	Content       json.RawMessage `json:"content"`
+	TransactionID string          `json:"transactionID"`
+	EnqueuedAt    time.Time       `json:"enqueuedAt"`
+	Attempts      int             `json:"attempts"`
+	NextAttempt   time.Time       `json:"nextAttempt,omitzero"`
+	LastError     string          `json:"lastError,omitempty"`
+	FailedAt      time.Time       `json:"failedAt,omitzero"`
+
+	// The original content, which is sent while the entry is in memory.
+	content any
+}
+
+// Outbox keeps outgoing messages until the homeserver has accepted them.
+// Messages which cannot be sent right away because of a temporary error
+// are retried in the background with exponential backoff, until they are
+// moved to the dead letters after maxAttempts or maxQueueAge. Every message
+// keeps its transaction ID across retries, so the homeserver does not
+// store it twice if an earlier attempt did arrive. While a room has queued
+// messages, later messages to it are queued behind them, so they arrive in
+// order.
+type Outbox struct {
+	mutex    sync.Mutex
+	store    OutboxStore
+	inFlight map[string]bool
+	// Entries which deliver is still trying to send, before they are queued.
+	sending map[string]bool
+	now     func() time.Time
+
+	// OnDelivered is called when a queued message was sent, with the
+	// transaction ID returned by SendTrackedMessage. The event ID is empty
+	// if the message was moved to the dead letters instead.
+	OnDelivered func(transactionID string, eventID id.EventID)
+}
+
+func NewOutbox(store OutboxStore) *Outbox {
+	return &Outbox{
+		store:    store,
+		inFlight: make(map[string]bool),
+		sending:  make(map[string]bool),
+		now:      time.Now,
+	}
+}
+
+// Run retries queued messages until ctx is cancelled.
+func (o *Outbox) Run(ctx context.Context, state *MatrixState) {
+	o.Flush(state)
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.Flush(state)
+		}
+	}
+}
+
+// Flush makes one attempt to send every queued message which is due. Once
+// a message to a room fails, the later messages to the room wait.
+func (o *Outbox) Flush(state *MatrixState) {
+	failed := make(map[id.RoomID]bool)
+	for _, entry := range o.due() {
+		if failed[entry.RoomID] {
+			o.release(entry)
+			continue
+		}
+		eventID, err := sendEntry(state, entry)
+		if err == nil {
+			log.Info().Msgf("Delivered queued message to %s as %s after %d failed attempts", entry.RoomID, eventID, entry.Attempts)
+			o.remove(entry)
+			o.delivered(entry.TransactionID, eventID)
+			continue
+		}
+		entry.Attempts++
+		entry.LastError = err.Error()
+		delay, temporary := retryDelay(err, entry.Attempts)
+		if !temporary || entry.Attempts >= maxAttempts || o.now().Sub(entry.EnqueuedAt) >= maxQueueAge {
+			giveUp(o, entry, err)
+			o.delivered(entry.TransactionID, "")
+			continue
+		}
+		log.Warn().Err(err).Msgf("Could not send queued message to %s, retrying in %s", entry.RoomID, delay)
+		entry.NextAttempt = o.now().Add(delay)
+		failed[entry.RoomID] = true
+		o.release(entry)
+	}
+}
+
+func (o *Outbox) delivered(transactionID string, eventID id.EventID) {
+	if o.OnDelivered != nil {
+		o.OnDelivered(transactionID, eventID)
+	}
+}
+
+// Pending returns the number of queued messages.
+func (o *Outbox) Pending() (int, error) {
+	entries, err := o.store.List(outboxNamespace)
+	return len(entries), err
+}
+
+// due returns the queued messages which are due for another attempt, oldest
+// first, and marks them as in flight. Messages to a room wait while an
+// earlier message to the room is not due or in flight.
+func (o *Outbox) due() []*outboxEntry {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entries := o.entries()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].EnqueuedAt.Before(entries[j].EnqueuedAt)
+	})
+	now := o.now()
+	waiting := make(map[id.RoomID]bool)
+	var result []*outboxEntry
+	for _, entry := range entries {
+		if waiting[entry.RoomID] {
+			continue
+		}
+		if o.inFlight[entry.TransactionID] || entry.NextAttempt.After(now) {
+			waiting[entry.RoomID] = true
+			continue
+		}
+		o.inFlight[entry.TransactionID] = true
+		result = append(result, entry)
+	}
+	return result
+}
+
+// entries reads all queued messages. The mutex must be held.
+func (o *Outbox) entries() []*outboxEntry {
+	values, err := o.store.List(outboxNamespace)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read outbox")
+		return nil
+	}
+	var entries []*outboxEntry
+	for key, value := range values {
+		var entry outboxEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			log.Error().Err(err).Msgf("Dropping unreadable outbox entry %s", key)
+			if err := o.store.Delete(outboxNamespace, key); err != nil {
+				log.Error().Err(err).Msgf("Could not delete outbox entry %s", key)
+			}
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	return entries
+}
+
+// enqueue persists an entry before its first attempt, so it survives a
+// crash during delivery. Returns false if earlier messages to the room are
+// queued; the entry is then queued behind them instead of being sent.
+func (o *Outbox) enqueue(entry *outboxEntry) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	queued := slices.ContainsFunc(o.entries(), func(queued *outboxEntry) bool {
+		return queued.RoomID == entry.RoomID && !o.sending[queued.TransactionID]
+	})
+	if !queued {
+		o.inFlight[entry.TransactionID] = true
+		o.sending[entry.TransactionID] = true
+	}
+	o.save(entry)
+	return !queued
+}
+
+// release stores the state of an entry after a failed attempt and hands it
+// to the background retries.
+func (o *Outbox) release(entry *outboxEntry) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	delete(o.inFlight, entry.TransactionID)
+	delete(o.sending, entry.TransactionID)
+	o.save(entry)
+}
+
+func (o *Outbox) remove(entry *outboxEntry) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	delete(o.inFlight, entry.TransactionID)
+	delete(o.sending, entry.TransactionID)
+	if err := o.store.Delete(outboxNamespace, entry.TransactionID); err != nil {
+		log.Error().Err(err).Msgf("Could not remove message %s from outbox", entry.TransactionID)
+	}
+}
+
+func (o *Outbox) save(entry *outboxEntry) {
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = o.store.Set(outboxNamespace, entry.TransactionID, string(data))
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not store message %s in outbox", entry.TransactionID)
+	}
+}
+
+func newOutboxEntry(roomID id.RoomID, eventType event.Type, content any) (*outboxEntry, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	transactionID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	return &outboxEntry{
+		RoomID:        roomID,
+		EventType:     eventType.Type,
+		Content:       data,
+		TransactionID: transactionID,
+		EnqueuedAt:    time.Now(),
+		content:       content,
+	}, nil
+}
+
+func newTransactionID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return "gmb-" + hex.EncodeToString(random), nil
+}
+
+// deliver sends an entry, retrying briefly on temporary errors. If it still
+// fails, or earlier messages to the room are queued, the entry is left to
+// the outbox, and an empty event ID and true are returned. Without an
+// outbox, the message is dropped.
+func deliver(state *MatrixState, entry *outboxEntry) (id.EventID, bool) {
+	outbox := state.Outbox
+	if outbox != nil && !outbox.enqueue(entry) {
+		log.Info().Msgf("Earlier messages to %s are queued, queueing the message behind them", entry.RoomID)
+		return "", true
+	}
+	for {
+		eventID, err := sendEntry(state, entry)
+		if err == nil {
+			if outbox != nil {
+				outbox.remove(entry)
+			}
+			return eventID, false
+		}
+		entry.Attempts++
+		entry.LastError = err.Error()
+		delay, temporary := retryDelay(err, entry.Attempts)
+		if !temporary {
+			giveUp(outbox, entry, err)
+			return "", false
+		}
+		if entry.Attempts >= immediateAttempts || delay > maxImmediateDelay {
+			if outbox == nil {
+				log.Error().Err(err).Msgf("Could not send message to %s after %d attempts", entry.RoomID, entry.Attempts)
+				return "", false
+			}
+			log.Warn().Err(err).Msgf("Could not send message to %s, retrying in the background", entry.RoomID)
+			entry.NextAttempt = outbox.now().Add(delay)
+			outbox.release(entry)
+			return "", true
+		}
+		log.Warn().Err(err).Msgf("Could not send message to %s, retrying in %s", entry.RoomID, delay)
+		time.Sleep(delay)
+	}
+}
+
+// giveUp moves a message which the homeserver refused permanently to the
+// dead letters. Without an outbox, it is dropped.
+func giveUp(outbox *Outbox, entry *outboxEntry, err error) {
+	log.Error().Err(err).Msgf("Could not send message to %s, giving up after %d attempts", entry.RoomID, entry.Attempts)
+	if outbox != nil {
+		outbox.bury(entry)
+	}
+}
+
+func sendEntry(state *MatrixState, entry *outboxEntry) (id.EventID, error) {
+	var content any = entry.Content
+	if entry.content != nil {
+		content = entry.content
+	}
+	resp, err := state.MautrixClient.SendMessageEvent(
+		state.MatrixContext,
+		entry.RoomID,
+		event.Type{Type: entry.EventType, Class: event.MessageEventType},
+		content,
+		mautrix.ReqSendEvent{TransactionID: entry.TransactionID})
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// retryDelay returns how long to wait before the next attempt, and false if
+// the error is permanent. Rate limits are honoured. Network errors, timeouts
+// and server errors are temporary; other errors, such as a missing room, an
+// event which is too large or a failure to encrypt, are permanent.
+func retryDelay(err error, attempts int) (time.Duration, bool) {
+	var httpErr mautrix.HTTPError
+	if errors.As(err, &httpErr) {
+		if httpErr.RespError != nil && httpErr.RespError.ErrCode == mautrix.MLimitExceeded.ErrCode {
+			if retryAfter, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok {
+				return time.Duration(retryAfter) * time.Millisecond, true
+			}
+			return backoff(attempts), true
+		}
+		status := 0
+		if httpErr.Response != nil {
+			status = httpErr.Response.StatusCode
+		} else if httpErr.RespError != nil {
+			status = httpErr.RespError.StatusCode
+		}
+		if status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests {
+			return backoff(attempts), true
+		}
+		if status != 0 {
+			return 0, false
+		}
+	}
+	// Also matches *url.Error, which the HTTP client returns
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return backoff(attempts), true
+	}
+	return 0, false
+}
+
+func backoff(attempts int) time.Duration {
+	delay := initialBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
@@ -0,0 +1,232 @@
+package matrix_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gotify_matrix_bot/matrix"
+	"gotify_matrix_bot/state"
+
+	"github.com/petergtz/pegomock/v4"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func setupOutbox(t *testing.T) (*MockMautrixClientType, *MatrixState) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+	mockClient, matrixState := setupMock(t, nil)
+	matrixState.Outbox = NewOutbox(store)
+	return mockClient, matrixState
+}
+
+func httpError(status int, errCode string, extra map[string]any) error {
+	respError := &mautrix.RespError{ErrCode: errCode, StatusCode: status, ExtraData: extra}
+	return mautrix.HTTPError{Response: &http.Response{StatusCode: status}, RespError: respError}
+}
+
+func rateLimited(retryAfter time.Duration) error {
+	return httpError(http.StatusTooManyRequests, "M_LIMIT_EXCEEDED", map[string]any{"retry_after_ms": float64(retryAfter.Milliseconds())})
+}
+
+func transactionIDs(mockClient *MockMautrixClientType, times int) []string {
+	_, _, _, _, extras := mockClient.VerifyWasCalled(pegomock.Times(times)).SendMessageEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Any[id.RoomID](),
+		pegomock.Eq(event.EventMessage),
+		pegomock.Any[any](),
+		pegomock.Any[mautrix.ReqSendEvent]()).GetAllCapturedArguments()
+	var result []string
+	for _, extra := range extras {
+		result = append(result, extra[0].TransactionID)
+	}
+	return result
+}
+
+func TestOutbox(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	t.Run("Rate limited message is retried with the same transaction ID", func(t *testing.T) {
+		mockClient, matrixState := setupOutbox(t)
+		pegomock.When(mockClient.SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]())).
+			ThenReturn(nil, rateLimited(time.Millisecond)).
+			ThenReturn(&mautrix.RespSendEvent{EventID: "$event"}, nil)
+
+		eventID := SendMessage(matrixState, "!room:example.com", "Test")
+
+		assert.Equal(t, eventID, id.EventID("$event"))
+		ids := transactionIDs(mockClient, 2)
+		assert.Assert(t, ids[0] != "")
+		assert.Equal(t, ids[0], ids[1])
+		pending, err := matrixState.Outbox.Pending()
+		assert.NilError(t, err)
+		assert.Equal(t, pending, 0)
+	})
+
+	t.Run("Permanent error is not retried", func(t *testing.T) {
+		mockClient, matrixState := setupOutbox(t)
+		pegomock.When(mockClient.SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]())).
+			ThenReturn(nil, httpError(http.StatusForbidden, "M_FORBIDDEN", nil))
+
+		eventID := SendMessage(matrixState, "!room:example.com", "Test")
+
+		assert.Equal(t, eventID, id.EventID(""))
+		transactionIDs(mockClient, 1)
+		pending, err := matrixState.Outbox.Pending()
+		assert.NilError(t, err)
+		assert.Equal(t, pending, 0)
+	})
+
+	t.Run("Undelivered message is retried by the outbox", func(t *testing.T) {
+		mockClient, matrixState := setupOutbox(t)
+		pegomock.When(mockClient.SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]())).
+			ThenReturn(nil, rateLimited(time.Millisecond)).
+			ThenReturn(nil, rateLimited(time.Millisecond)).
+			ThenReturn(nil, rateLimited(time.Millisecond)).
+			ThenReturn(&mautrix.RespSendEvent{EventID: "$event"}, nil)
+
+		eventID := SendMessage(matrixState, "!room:example.com", "Test")
+
+		assert.Equal(t, eventID, id.EventID(""))
+		pending, err := matrixState.Outbox.Pending()
+		assert.NilError(t, err)
+		assert.Equal(t, pending, 1)
+
+		time.Sleep(10 * time.Millisecond)
+		matrixState.Outbox.Flush(matrixState)
+
+		ids := transactionIDs(mockClient, 4)
+		assert.Equal(t, ids[3], ids[0])
+		pending, err = matrixState.Outbox.Pending()
+		assert.NilError(t, err)
+		assert.Equal(t, pending, 0)
+	})
+
+	t.Run("Later messages are queued behind undelivered ones", func(t *testing.T) {
+		mockClient, matrixState := setupOutbox(t)
+		pegomock.When(mockClient.SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]())).
+			ThenReturn(nil, rateLimited(time.Millisecond)).
+			ThenReturn(nil, rateLimited(time.Millisecond)).
+			ThenReturn(nil, rateLimited(time.Millisecond)).
+			ThenReturn(&mautrix.RespSendEvent{EventID: "$first"}, nil).
+			ThenReturn(&mautrix.RespSendEvent{EventID: "$second"}, nil)
+		delivered := make(map[string]id.EventID)
+		matrixState.Outbox.OnDelivered = func(transactionID string, eventID id.EventID) {
+			delivered[transactionID] = eventID
+		}
+
+		eventID, first := SendTrackedMessage(matrixState, "!room:example.com", "", "First")
+		assert.Equal(t, eventID, id.EventID(""))
+		assert.Assert(t, first != "")
+		// Not attempted, as the first message is still queued.
+		eventID, second := SendTrackedMessage(matrixState, "!room:example.com", "", "Second")
+		assert.Equal(t, eventID, id.EventID(""))
+		assert.Assert(t, second != "")
+		transactionIDs(mockClient, 3)
+
+		time.Sleep(10 * time.Millisecond)
+		matrixState.Outbox.Flush(matrixState)
+
+		ids := transactionIDs(mockClient, 5)
+		assert.DeepEqual(t, ids[3:], []string{first, second})
+		assert.DeepEqual(t, delivered, map[string]id.EventID{first: "$first", second: "$second"})
+	})
+
+	t.Run("Only network and server errors are temporary", func(t *testing.T) {
+		mockClient, matrixState := setupOutbox(t)
+		pegomock.When(mockClient.SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]())).
+			ThenReturn(nil, errors.New("failed to encrypt event")).
+			ThenReturn(nil, &url.Error{Op: "Put", URL: "https://matrix.example.com", Err: errors.New("connection refused")})
+
+		SendMessage(matrixState, "!room:example.com", "Not encrypted")
+		letters, err := matrixState.Outbox.DeadLetters()
+		assert.NilError(t, err)
+		assert.Equal(t, len(letters), 1)
+		pending, err := matrixState.Outbox.Pending()
+		assert.NilError(t, err)
+		assert.Equal(t, pending, 0)
+
+		SendMessage(matrixState, "!room:example.com", "Network down")
+		pending, err = matrixState.Outbox.Pending()
+		assert.NilError(t, err)
+		assert.Equal(t, pending, 1)
+	})
+
+	t.Run("Message is given up after too many attempts", func(t *testing.T) {
+		mockClient, matrixState := setupOutbox(t)
+		pegomock.When(mockClient.SendMessageEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Any[id.RoomID](),
+			pegomock.Any[event.Type](),
+			pegomock.Any[any](),
+			pegomock.Any[mautrix.ReqSendEvent]())).
+			ThenReturn(nil, rateLimited(0))
+
+		// Three immediate attempts, then one per flush.
+		SendMessage(matrixState, "!room:example.com", "Test")
+		for range 96 {
+			matrixState.Outbox.Flush(matrixState)
+		}
+		pending, err := matrixState.Outbox.Pending()
+		assert.NilError(t, err)
+		assert.Equal(t, pending, 1)
+
+		matrixState.Outbox.Flush(matrixState)
+		pending, err = matrixState.Outbox.Pending()
+		assert.NilError(t, err)
+		assert.Equal(t, pending, 0)
+		letters, err := matrixState.Outbox.DeadLetters()
+		assert.NilError(t, err)
+		assert.Equal(t, len(letters), 1)
+		assert.Equal(t, letters[0].Attempts, 100)
+	})
+	t.Run("Run stops when the context is cancelled", func(t *testing.T) {
+		_, matrixState := setupOutbox(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			matrixState.Outbox.Run(ctx, matrixState)
+			close(done)
+		}()
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Run did not stop")
+		}
+	})
+}
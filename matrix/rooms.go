@@ -0,0 +1,112 @@
+package matrix
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type RoomOptions struct {
+	Name      string
+	Topic     string
+	Avatar    id.ContentURIString
+	Invite    []id.UserID
+	Encrypted bool
+	IsSpace   bool
+	IsDirect  bool
+}
+
+// CreateRoom creates a new private room with the bot as its only member,
+// inviting the given users.
+func CreateRoom(state *MatrixState, options RoomOptions) (id.RoomID, error) {
+	var initialState []*event.Event
+	if options.Encrypted {
+		initialState = append(initialState, &event.Event{
+			Type: event.StateEncryption,
+			Content: event.Content{
+				Parsed: &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1},
+			},
+		})
+	}
+	if options.Avatar != "" {
+		initialState = append(initialState, &event.Event{
+			Type: event.StateRoomAvatar,
+			Content: event.Content{
+				Parsed: &event.RoomAvatarEventContent{URL: options.Avatar},
+			},
+		})
+	}
+
+	req := &mautrix.ReqCreateRoom{
+		Name:         options.Name,
+		Topic:        options.Topic,
+		Invite:       options.Invite,
+		Preset:       "private_chat",
+		InitialState: initialState,
+	}
+	if options.IsDirect {
+		req.IsDirect = true
+		req.Preset = "trusted_private_chat"
+	}
+	if options.IsSpace {
+		req.CreationContent = map[string]interface{}{"type": event.RoomTypeSpace}
+	}
+
+	resp, err := state.MautrixClient.CreateRoom(state.MatrixContext, req)
+	if err != nil {
+		return "", err
+	}
+	log.Info().Str("room_id", resp.RoomID.String()).Msgf("Created room %s", options.Name)
+	return resp.RoomID, nil
+}
+
+// AddToSpace links a room into a space, by setting m.space.child in the space
+// and m.space.parent in the room. The latter is optional, as the bot may lack
+// the permission to set it.
+func AddToSpace(state *MatrixState, spaceID id.RoomID, roomID id.RoomID) error {
+	via := []string{state.UserID.Homeserver()}
+	_, err := state.MautrixClient.SendStateEvent(state.MatrixContext, spaceID, event.StateSpaceChild, roomID.String(),
+		&event.SpaceChildEventContent{Via: via})
+	if err != nil {
+		return err
+	}
+	_, err = state.MautrixClient.SendStateEvent(state.MatrixContext, roomID, event.StateSpaceParent, spaceID.String(),
+		&event.SpaceParentEventContent{Via: via, Canonical: true})
+	if err != nil {
+		log.Warn().Err(err).Str("room_id", roomID.String()).Msg("Could not set space parent")
+	}
+	return nil
+}
+
+var stateRoomRetention = event.Type{Type: "m.room.retention", Class: event.StateEventType}
+
+type roomRetentionContent struct {
+	MaxLifetime int64 `json:"max_lifetime"`
+}
+
+// SetRoomRetention sets the m.room.retention state of a room, so that
+// servers which support it purge events older than maxAge.
+func SetRoomRetention(state *MatrixState, roomID id.RoomID, maxAge time.Duration) error {
+	_, err := state.MautrixClient.SendStateEvent(state.MatrixContext, roomID, stateRoomRetention, "",
+		&roomRetentionContent{MaxLifetime: maxAge.Milliseconds()})
+	return err
+}
+
+// RemoveFromSpace unlinks a room from a space. State events cannot be deleted,
+// so they are replaced with empty content.
+func RemoveFromSpace(state *MatrixState, spaceID id.RoomID, roomID id.RoomID) error {
+	_, err := state.MautrixClient.SendStateEvent(state.MatrixContext, spaceID, event.StateSpaceChild, roomID.String(),
+		struct{}{})
+	if err != nil {
+		return err
+	}
+	_, err = state.MautrixClient.SendStateEvent(state.MatrixContext, roomID, event.StateSpaceParent, spaceID.String(),
+		struct{}{})
+	if err != nil {
+		log.Warn().Err(err).Str("room_id", roomID.String()).Msg("Could not remove space parent")
+	}
+	return nil
+}
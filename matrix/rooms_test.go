@@ -0,0 +1,153 @@
+package matrix_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	. "gotify_matrix_bot/matrix"
+
+	"github.com/petergtz/pegomock/v4"
+	"gotest.tools/v3/assert"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCreateRoom(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	t.Run("Encrypted room with avatar", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+		pegomock.When(mockClient.CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]())).
+			ThenReturn(&mautrix.RespCreateRoom{RoomID: "!new:example.com"}, nil)
+
+		roomID, err := CreateRoom(state, RoomOptions{
+			Name:      "Gotify: Backup",
+			Topic:     "Backup jobs",
+			Avatar:    "mxc://example.com/avatar",
+			Invite:    []id.UserID{"@user:example.com"},
+			Encrypted: true,
+		})
+
+		assert.NilError(t, err)
+		assert.Equal(t, roomID, id.RoomID("!new:example.com"))
+		_, req := mockClient.VerifyWasCalledOnce().CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]()).GetCapturedArguments()
+		assert.Equal(t, req.Name, "Gotify: Backup")
+		assert.Equal(t, req.Topic, "Backup jobs")
+		assert.DeepEqual(t, req.Invite, []id.UserID{"@user:example.com"})
+		assert.Equal(t, len(req.InitialState), 2)
+		assert.Equal(t, req.InitialState[0].Type, event.StateEncryption)
+		assert.Equal(t, req.InitialState[1].Type, event.StateRoomAvatar)
+	})
+
+	t.Run("Unencrypted room without avatar", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+		pegomock.When(mockClient.CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]())).
+			ThenReturn(&mautrix.RespCreateRoom{RoomID: "!new:example.com"}, nil)
+
+		_, err := CreateRoom(state, RoomOptions{Name: "Room"})
+
+		assert.NilError(t, err)
+		_, req := mockClient.VerifyWasCalledOnce().CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]()).GetCapturedArguments()
+		assert.Equal(t, len(req.InitialState), 0)
+	})
+
+	t.Run("Error is returned", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+		pegomock.When(mockClient.CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]())).
+			ThenReturn(nil, errors.New("forbidden"))
+
+		_, err := CreateRoom(state, RoomOptions{Name: "Room"})
+
+		assert.ErrorContains(t, err, "forbidden")
+	})
+}
+
+func TestSpaces(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	t.Run("Space is created with space type", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+		pegomock.When(mockClient.CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]())).
+			ThenReturn(&mautrix.RespCreateRoom{RoomID: "!space:example.com"}, nil)
+
+		_, err := CreateRoom(state, RoomOptions{Name: "Space", IsSpace: true})
+
+		assert.NilError(t, err)
+		_, req := mockClient.VerifyWasCalledOnce().CreateRoom(
+			pegomock.Any[context.Context](),
+			pegomock.Any[*mautrix.ReqCreateRoom]()).GetCapturedArguments()
+		assert.Equal(t, req.CreationContent["type"], event.RoomTypeSpace)
+	})
+
+	t.Run("AddToSpace sets child and parent", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+		state.UserID = "@bot:example.com"
+
+		err := AddToSpace(state, "!space:example.com", "!room:example.com")
+
+		assert.NilError(t, err)
+		mockClient.VerifyWasCalledOnce().SendStateEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Eq(id.RoomID("!space:example.com")),
+			pegomock.Eq(event.StateSpaceChild),
+			pegomock.Eq("!room:example.com"),
+			pegomock.Eq[any](&event.SpaceChildEventContent{Via: []string{"example.com"}}))
+		mockClient.VerifyWasCalledOnce().SendStateEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Eq(id.RoomID("!room:example.com")),
+			pegomock.Eq(event.StateSpaceParent),
+			pegomock.Eq("!space:example.com"),
+			pegomock.Eq[any](&event.SpaceParentEventContent{Via: []string{"example.com"}, Canonical: true}))
+	})
+
+	t.Run("RemoveFromSpace clears child and parent", func(t *testing.T) {
+		mockClient, state := setupMock(t, nil)
+
+		err := RemoveFromSpace(state, "!space:example.com", "!room:example.com")
+
+		assert.NilError(t, err)
+		mockClient.VerifyWasCalledOnce().SendStateEvent(
+			pegomock.Any[context.Context](),
+			pegomock.Eq(id.RoomID("!space:example.com")),
+			pegomock.Eq(event.StateSpaceChild),
+			pegomock.Eq("!room:example.com"),
+			pegomock.Eq[any](struct{}{}))
+	})
+}
+
+func TestSetRoomRetention(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+	mockClient, state := setupMock(t, nil)
+
+	err := SetRoomRetention(state, "!room:example.com", 7*24*time.Hour)
+
+	assert.NilError(t, err)
+	_, roomID, eventType, stateKey, content, _ := mockClient.VerifyWasCalledOnce().SendStateEvent(
+		pegomock.Any[context.Context](),
+		pegomock.Any[id.RoomID](),
+		pegomock.Any[event.Type](),
+		pegomock.Any[string](),
+		pegomock.Any[any]()).GetCapturedArguments()
+	assert.Equal(t, roomID, id.RoomID("!room:example.com"))
+	assert.Equal(t, eventType.Type, "m.room.retention")
+	assert.Equal(t, stateKey, "")
+	data, err := json.Marshal(content)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), `{"max_lifetime":604800000}`)
+}
@@ -0,0 +1,95 @@
+package routing
+
+import (
+	"fmt"
+	"gotify_matrix_bot/config"
+	"regexp"
+	"strings"
+)
+
+type IncidentState int
+
+const (
+	IncidentNone IncidentState = iota
+	IncidentProblem
+	IncidentRecovery
+)
+
+type correlationRule struct {
+	matcher
+	name     string
+	pattern  *regexp.Regexp
+	problem  string
+	recovery string
+}
+
+// Correlator recognizes problem and recovery messages of the same resource,
+// such as "X is DOWN" and "X is UP".
+type Correlator struct {
+	rules []correlationRule
+}
+
+func NewCorrelator(correlation config.CorrelationType) (*Correlator, error) {
+	correlator := &Correlator{}
+	for idx, r := range correlation.Rules {
+		compiled := correlationRule{
+			name:     r.Name,
+			problem:  r.Problem,
+			recovery: r.Recovery,
+		}
+		if compiled.name == "" {
+			compiled.name = fmt.Sprintf("#%d", idx+1)
+		}
+		var err error
+		if compiled.matcher, err = newMatcher(r.Match); err != nil {
+			return nil, fmt.Errorf("correlation rule %s: %w", compiled.name, err)
+		}
+		if compiled.pattern, err = regexp.Compile(r.Pattern); err != nil {
+			return nil, fmt.Errorf("correlation rule %s: %w", compiled.name, err)
+		}
+		if compiled.pattern.SubexpIndex("resource") < 0 || compiled.pattern.SubexpIndex("state") < 0 {
+			return nil, fmt.Errorf("correlation rule %s: pattern needs the groups resource and state", compiled.name)
+		}
+		correlator.rules = append(correlator.rules, compiled)
+	}
+	return correlator, nil
+}
+
+// Enabled returns true if there are any correlation rules.
+func (c *Correlator) Enabled() bool {
+	return len(c.rules) > 0
+}
+
+// UsesAppName returns true if any rule matches on the application name.
+func (c *Correlator) UsesAppName() bool {
+	for _, rule := range c.rules {
+		if rule.appName != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Correlate matches the title of a message against the rules. It returns the
+// incident key, made of the rule name and the resource, and whether the
+// message reports a problem or a recovery. States are compared ignoring case.
+func (c *Correlator) Correlate(msg MessageInfo) (string, IncidentState) {
+	for _, rule := range c.rules {
+		if !rule.matches(msg) {
+			continue
+		}
+		match := rule.pattern.FindStringSubmatch(msg.Title)
+		if match == nil {
+			continue
+		}
+		key := rule.name + ":" + match[rule.pattern.SubexpIndex("resource")]
+		state := match[rule.pattern.SubexpIndex("state")]
+		switch {
+		case strings.EqualFold(state, rule.problem):
+			return key, IncidentProblem
+		case strings.EqualFold(state, rule.recovery):
+			return key, IncidentRecovery
+		}
+	}
+	return "", IncidentNone
+}
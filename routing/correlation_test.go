@@ -0,0 +1,68 @@
+package routing
+
+import (
+	"gotify_matrix_bot/config"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCorrelate(t *testing.T) {
+	correlator, err := NewCorrelator(config.CorrelationType{
+		Rules: []config.CorrelationRuleType{
+			{
+				Name:     "uptime",
+				Match:    config.RouteMatchType{AppIDs: []int64{2}},
+				Pattern:  `^(?P<resource>.+) is (?P<state>\w+)`,
+				Problem:  "down",
+				Recovery: "up",
+			},
+		},
+	})
+	assert.NilError(t, err)
+	assert.Assert(t, correlator.Enabled())
+
+	testCases := []struct {
+		name          string
+		msg           MessageInfo
+		expectedKey   string
+		expectedState IncidentState
+	}{
+		{
+			name:          "Problem",
+			msg:           MessageInfo{AppID: 2, Title: "web.example.com is DOWN"},
+			expectedKey:   "uptime:web.example.com",
+			expectedState: IncidentProblem,
+		},
+		{
+			name:          "Recovery",
+			msg:           MessageInfo{AppID: 2, Title: "web.example.com is UP"},
+			expectedKey:   "uptime:web.example.com",
+			expectedState: IncidentRecovery,
+		},
+		{
+			name:          "Unknown state",
+			msg:           MessageInfo{AppID: 2, Title: "web.example.com is SLOW"},
+			expectedState: IncidentNone,
+		},
+		{
+			name:          "Rule does not match",
+			msg:           MessageInfo{AppID: 3, Title: "web.example.com is DOWN"},
+			expectedState: IncidentNone,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, state := correlator.Correlate(tc.msg)
+			assert.Equal(t, key, tc.expectedKey)
+			assert.Equal(t, state, tc.expectedState)
+		})
+	}
+}
+
+func TestNewCorrelatorNeedsGroups(t *testing.T) {
+	_, err := NewCorrelator(config.CorrelationType{
+		Rules: []config.CorrelationRuleType{{Name: "bad", Pattern: `(.+) is (\w+)`}},
+	})
+	assert.ErrorContains(t, err, "pattern needs the groups resource and state")
+}
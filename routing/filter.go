@@ -0,0 +1,112 @@
+package routing
+
+import (
+	"fmt"
+	"gotify_matrix_bot/config"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDrop  = "drop"
+
+	// Name used in the drop counts for messages dropped by the default action.
+	defaultFilterName = "default"
+)
+
+type filterRule struct {
+	matcher
+	name string
+	drop bool
+}
+
+// Filter decides whether a message is forwarded at all. The first matching
+// rule decides; if none matches, the default action applies.
+type Filter struct {
+	rules       []filterRule
+	defaultDrop bool
+
+	mutex   sync.Mutex
+	dropped map[string]int
+}
+
+func NewFilter(filtering config.FilteringType) (*Filter, error) {
+	filter := &Filter{
+		defaultDrop: strings.EqualFold(filtering.DefaultAction, ActionDrop),
+		dropped:     make(map[string]int),
+	}
+	for idx, r := range filtering.Rules {
+		compiled := filterRule{
+			name: r.Name,
+			drop: strings.EqualFold(r.Action, ActionDrop),
+		}
+		if compiled.name == "" {
+			compiled.name = fmt.Sprintf("#%d", idx+1)
+		}
+		if !compiled.drop && !strings.EqualFold(r.Action, ActionAllow) {
+			return nil, fmt.Errorf("filter rule %s: unknown action %q", compiled.name, r.Action)
+		}
+		var err error
+		if compiled.matcher, err = newMatcher(r.Match); err != nil {
+			return nil, fmt.Errorf("filter rule %s: %w", compiled.name, err)
+		}
+		filter.rules = append(filter.rules, compiled)
+	}
+	return filter, nil
+}
+
+// UsesAppName returns true if any rule matches on the application name.
+func (f *Filter) UsesAppName() bool {
+	for _, rule := range f.rules {
+		if rule.appName != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow returns true if the message should be forwarded. Dropped messages are
+// counted per rule.
+func (f *Filter) Allow(msg MessageInfo) bool {
+	name := defaultFilterName
+	drop := f.defaultDrop
+	for _, rule := range f.rules {
+		if rule.matches(msg) {
+			name = rule.name
+			drop = rule.drop
+			break
+		}
+	}
+	if !drop {
+		return true
+	}
+
+	log.Debug().Msgf("Message %s dropped by filter rule %s", msg.Title, name)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.dropped[name]++
+	return false
+}
+
+// TakeDropCounts returns the number of dropped messages per rule since the
+// last call, and resets the counters.
+func (f *Filter) TakeDropCounts() map[string]int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	counts := f.dropped
+	f.dropped = make(map[string]int)
+	return counts
+}
+
+// AddDropCounts adds counts, as returned by TakeDropCounts, to the counters,
+// so that they carry over to a new filter.
+func (f *Filter) AddDropCounts(counts map[string]int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for name, count := range counts {
+		f.dropped[name] += count
+	}
+}
@@ -0,0 +1,71 @@
+package routing
+
+import (
+	"gotify_matrix_bot/config"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestFilter(t *testing.T) {
+	t.Run("Matching drop rule drops and counts", func(t *testing.T) {
+		filter, err := NewFilter(config.FilteringType{
+			Rules: []config.FilterRuleType{
+				{Name: "backup ok", Action: "drop", Match: config.RouteMatchType{AppIDs: []int64{2}, Title: "succeeded"}},
+			},
+		})
+		assert.NilError(t, err)
+
+		assert.Assert(t, !filter.Allow(MessageInfo{AppID: 2, Title: "Backup succeeded"}))
+		assert.Assert(t, !filter.Allow(MessageInfo{AppID: 2, Title: "Backup succeeded"}))
+		assert.Assert(t, filter.Allow(MessageInfo{AppID: 2, Title: "Backup failed"}))
+		assert.Assert(t, filter.Allow(MessageInfo{AppID: 3, Title: "Backup succeeded"}))
+
+		assert.DeepEqual(t, filter.TakeDropCounts(), map[string]int{"backup ok": 2})
+		assert.DeepEqual(t, filter.TakeDropCounts(), map[string]int{})
+	})
+
+	t.Run("Allow list with default drop", func(t *testing.T) {
+		filter, err := NewFilter(config.FilteringType{
+			DefaultAction: "drop",
+			Rules: []config.FilterRuleType{
+				{Action: "allow", Match: config.RouteMatchType{MinPriority: intPtr(5)}},
+			},
+		})
+		assert.NilError(t, err)
+
+		assert.Assert(t, filter.Allow(MessageInfo{Priority: 7}))
+		assert.Assert(t, !filter.Allow(MessageInfo{Priority: 2}))
+		assert.DeepEqual(t, filter.TakeDropCounts(), map[string]int{"default": 1})
+	})
+
+	t.Run("First matching rule decides", func(t *testing.T) {
+		filter, err := NewFilter(config.FilteringType{
+			Rules: []config.FilterRuleType{
+				{Action: "allow", Match: config.RouteMatchType{MinPriority: intPtr(8)}},
+				{Action: "drop", Match: config.RouteMatchType{AppIDs: []int64{1}}},
+			},
+		})
+		assert.NilError(t, err)
+
+		assert.Assert(t, filter.Allow(MessageInfo{AppID: 1, Priority: 9}))
+		assert.Assert(t, !filter.Allow(MessageInfo{AppID: 1, Priority: 1}))
+		assert.DeepEqual(t, filter.TakeDropCounts(), map[string]int{"#2": 1})
+	})
+
+	t.Run("Invalid regexp returns error", func(t *testing.T) {
+		_, err := NewFilter(config.FilteringType{
+			Rules: []config.FilterRuleType{
+				{Name: "broken", Action: "drop", Match: config.RouteMatchType{Message: "$$$^^("}},
+			},
+		})
+		assert.ErrorContains(t, err, "filter rule broken")
+	})
+
+	t.Run("Rule without action returns error", func(t *testing.T) {
+		_, err := NewFilter(config.FilteringType{
+			Rules: []config.FilterRuleType{{Name: "forgotten", Match: config.RouteMatchType{AppName: "^Backup$"}}},
+		})
+		assert.Error(t, err, `filter rule forgotten: unknown action ""`)
+	})
+}
@@ -0,0 +1,77 @@
+package routing
+
+import (
+	"gotify_matrix_bot/config"
+	"regexp"
+	"slices"
+)
+
+// MessageInfo contains the properties of a message that rules can match on.
+type MessageInfo struct {
+	AppID    int64
+	AppName  string
+	Priority int
+	Title    string
+	Message  string
+	// Extras with a string value, by key.
+	Extras map[string]string
+}
+
+// matcher is the compiled form of config.RouteMatchType. All conditions
+// which are set must match.
+type matcher struct {
+	appIDs      []int64
+	appName     *regexp.Regexp
+	minPriority *int
+	maxPriority *int
+	title       *regexp.Regexp
+	message     *regexp.Regexp
+}
+
+func newMatcher(match config.RouteMatchType) (matcher, error) {
+	m := matcher{
+		appIDs:      match.AppIDs,
+		minPriority: match.MinPriority,
+		maxPriority: match.MaxPriority,
+	}
+	var err error
+	if m.appName, err = compileOptional(match.AppName); err != nil {
+		return m, err
+	}
+	if m.title, err = compileOptional(match.Title); err != nil {
+		return m, err
+	}
+	if m.message, err = compileOptional(match.Message); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+func compileOptional(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+func (m *matcher) matches(msg MessageInfo) bool {
+	if len(m.appIDs) > 0 && !slices.Contains(m.appIDs, msg.AppID) {
+		return false
+	}
+	if m.appName != nil && !m.appName.MatchString(msg.AppName) {
+		return false
+	}
+	if m.minPriority != nil && msg.Priority < *m.minPriority {
+		return false
+	}
+	if m.maxPriority != nil && msg.Priority > *m.maxPriority {
+		return false
+	}
+	if m.title != nil && !m.title.MatchString(msg.Title) {
+		return false
+	}
+	if m.message != nil && !m.message.MatchString(msg.Message) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package routing
+
+import (
+	"fmt"
+	"gotify_matrix_bot/config"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// QuietHours is a daily time window during which messages below a priority
+// threshold are held back. The window may span midnight. Days are the days
+// on which the window starts.
+type QuietHours struct {
+	start          time.Duration
+	end            time.Duration
+	location       *time.Location
+	days           map[time.Weekday]bool
+	bypassPriority int
+}
+
+func newQuietHours(quietHours *config.QuietHoursType) (*QuietHours, error) {
+	if quietHours == nil {
+		return nil, nil
+	}
+	q := &QuietHours{
+		location:       time.Local,
+		days:           make(map[time.Weekday]bool),
+		bypassPriority: quietHours.BypassPriority,
+	}
+	var err error
+	if q.start, err = parseTimeOfDay(quietHours.Start); err != nil {
+		return nil, err
+	}
+	if q.end, err = parseTimeOfDay(quietHours.End); err != nil {
+		return nil, err
+	}
+	if q.start == q.end {
+		return nil, fmt.Errorf("quiet hours start and end are both %s", quietHours.Start)
+	}
+	if quietHours.Timezone != "" {
+		if q.location, err = time.LoadLocation(quietHours.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	for _, day := range quietHours.Days {
+		// By runes, as lower case may be shorter in bytes, e.g. for the Kelvin sign
+		prefix := []rune(strings.ToLower(day))
+		weekday, ok := weekdays[string(prefix[:min(3, len(prefix))])]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %s", day)
+		}
+		q.days[weekday] = true
+	}
+	if len(q.days) == 0 {
+		for _, weekday := range weekdays {
+			q.days[weekday] = true
+		}
+	}
+	return q, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Bypass returns true if a message of the given priority is delivered even
+// during quiet hours.
+func (q *QuietHours) Bypass(priority int) bool {
+	return q.bypassPriority > 0 && priority >= q.bypassPriority
+}
+
+// IsQuiet returns true if the given time is within quiet hours.
+func (q *QuietHours) IsQuiet(t time.Time) bool {
+	local := t.In(q.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, q.location)
+	// The time on the clock, which differs from the time elapsed since
+	// midnight on days when daylight saving time starts or ends.
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+
+	if q.start < q.end {
+		return q.days[local.Weekday()] && sinceMidnight >= q.start && sinceMidnight < q.end
+	}
+
+	// The window spans midnight.
+	if q.days[local.Weekday()] && sinceMidnight >= q.start {
+		return true
+	}
+	yesterday := midnight.AddDate(0, 0, -1)
+	return q.days[yesterday.Weekday()] && sinceMidnight < q.end
+}
@@ -0,0 +1,122 @@
+package routing
+
+import (
+	"gotify_matrix_bot/config"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestQuietHours(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NilError(t, err)
+
+	t.Run("Window spanning midnight", func(t *testing.T) {
+		q, err := newQuietHours(&config.QuietHoursType{
+			Start:    "22:00",
+			End:      "07:00",
+			Timezone: "Europe/Berlin",
+		})
+		assert.NilError(t, err)
+
+		assert.Assert(t, !q.IsQuiet(time.Date(2025, 3, 3, 21, 59, 0, 0, berlin)))
+		assert.Assert(t, q.IsQuiet(time.Date(2025, 3, 3, 22, 0, 0, 0, berlin)))
+		assert.Assert(t, q.IsQuiet(time.Date(2025, 3, 4, 3, 0, 0, 0, berlin)))
+		assert.Assert(t, !q.IsQuiet(time.Date(2025, 3, 4, 7, 0, 0, 0, berlin)))
+		// 02:00 UTC is 03:00 in Berlin.
+		assert.Assert(t, q.IsQuiet(time.Date(2025, 3, 4, 2, 0, 0, 0, time.UTC)))
+		// 06:30 UTC is 07:30 in Berlin.
+		assert.Assert(t, !q.IsQuiet(time.Date(2025, 3, 4, 6, 30, 0, 0, time.UTC)))
+	})
+
+	t.Run("Daylight saving time changes", func(t *testing.T) {
+		q, err := newQuietHours(&config.QuietHoursType{
+			Start:    "22:00",
+			End:      "07:00",
+			Timezone: "Europe/Berlin",
+		})
+		assert.NilError(t, err)
+
+		// Clocks go forward from 02:00 to 03:00 on 2026-03-29.
+		assert.Assert(t, q.IsQuiet(time.Date(2026, 3, 29, 6, 59, 0, 0, berlin)))
+		assert.Assert(t, !q.IsQuiet(time.Date(2026, 3, 29, 7, 0, 0, 0, berlin)))
+		assert.Assert(t, !q.IsQuiet(time.Date(2026, 3, 29, 7, 30, 0, 0, berlin)))
+		assert.Assert(t, !q.IsQuiet(time.Date(2026, 3, 29, 21, 59, 0, 0, berlin)))
+		assert.Assert(t, q.IsQuiet(time.Date(2026, 3, 29, 22, 0, 0, 0, berlin)))
+		// Clocks go back from 03:00 to 02:00 on 2026-10-25.
+		assert.Assert(t, q.IsQuiet(time.Date(2026, 10, 25, 6, 30, 0, 0, berlin)))
+		assert.Assert(t, !q.IsQuiet(time.Date(2026, 10, 25, 7, 0, 0, 0, berlin)))
+		assert.Assert(t, !q.IsQuiet(time.Date(2026, 10, 25, 21, 30, 0, 0, berlin)))
+		assert.Assert(t, q.IsQuiet(time.Date(2026, 10, 25, 22, 0, 0, 0, berlin)))
+	})
+
+	t.Run("Days are the days the window starts", func(t *testing.T) {
+		q, err := newQuietHours(&config.QuietHoursType{
+			Start:    "22:00",
+			End:      "07:00",
+			Timezone: "Europe/Berlin",
+			Days:     []string{"Fri", "saturday"},
+		})
+		assert.NilError(t, err)
+
+		// Thursday night is not quiet.
+		assert.Assert(t, !q.IsQuiet(time.Date(2025, 3, 6, 23, 0, 0, 0, berlin)))
+		// Friday night, continuing Saturday morning, is quiet.
+		assert.Assert(t, q.IsQuiet(time.Date(2025, 3, 7, 23, 0, 0, 0, berlin)))
+		assert.Assert(t, q.IsQuiet(time.Date(2025, 3, 8, 6, 0, 0, 0, berlin)))
+		// Sunday morning is quiet, Sunday night is not.
+		assert.Assert(t, q.IsQuiet(time.Date(2025, 3, 9, 6, 0, 0, 0, berlin)))
+		assert.Assert(t, !q.IsQuiet(time.Date(2025, 3, 9, 23, 0, 0, 0, berlin)))
+	})
+
+	t.Run("Window within a day", func(t *testing.T) {
+		q, err := newQuietHours(&config.QuietHoursType{
+			Start: "12:00",
+			End:   "13:30",
+		})
+		assert.NilError(t, err)
+
+		assert.Assert(t, q.IsQuiet(time.Date(2025, 3, 3, 13, 29, 0, 0, time.Local)))
+		assert.Assert(t, !q.IsQuiet(time.Date(2025, 3, 3, 13, 30, 0, 0, time.Local)))
+		assert.Assert(t, !q.IsQuiet(time.Date(2025, 3, 3, 11, 0, 0, 0, time.Local)))
+	})
+
+	t.Run("Bypass priority", func(t *testing.T) {
+		q, err := newQuietHours(&config.QuietHoursType{Start: "22:00", End: "07:00", BypassPriority: 8})
+		assert.NilError(t, err)
+
+		assert.Assert(t, q.Bypass(8))
+		assert.Assert(t, !q.Bypass(7))
+	})
+
+	t.Run("Invalid settings", func(t *testing.T) {
+		_, err := newQuietHours(&config.QuietHoursType{Start: "25:00", End: "07:00"})
+		assert.ErrorContains(t, err, "invalid time")
+		_, err = newQuietHours(&config.QuietHoursType{Start: "22:00", End: "07:00", Timezone: "Mars/Olympus"})
+		assert.ErrorContains(t, err, "unknown time zone")
+		_, err = newQuietHours(&config.QuietHoursType{Start: "22:00", End: "07:00", Days: []string{"someday"}})
+		assert.ErrorContains(t, err, "unknown day")
+		_, err = newQuietHours(&config.QuietHoursType{Start: "22:00", End: "07:00", Days: []string{"\u212a"}})
+		assert.ErrorContains(t, err, "unknown day")
+		_, err = newQuietHours(&config.QuietHoursType{Start: "22:00", End: "22:00"})
+		assert.Error(t, err, "quiet hours start and end are both 22:00")
+	})
+
+	t.Run("Routes carry their quiet hours", func(t *testing.T) {
+		router, err := NewRouter(config.RoutingType{
+			DefaultQuietHours: &config.QuietHoursType{Start: "22:00", End: "07:00"},
+			Rules: []config.RouteType{
+				{Match: config.RouteMatchType{AppIDs: []int64{1}}, Rooms: []string{"!ops"}},
+			},
+		}, "!default")
+		assert.NilError(t, err)
+
+		destinations, _ := router.Route(MessageInfo{AppID: 1})
+		assert.Assert(t, destinations[0].QuietHours == nil)
+		destinations, _ = router.Route(MessageInfo{AppID: 2})
+		assert.Assert(t, destinations[0].QuietHours != nil)
+		assert.Assert(t, router.QuietHoursFor("!default") == router.DefaultQuietHours())
+		assert.Assert(t, router.QuietHoursFor("!ops") == nil)
+	})
+}
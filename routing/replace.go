@@ -0,0 +1,79 @@
+package routing
+
+import (
+	"fmt"
+	"gotify_matrix_bot/config"
+	"regexp"
+)
+
+type replaceRule struct {
+	matcher
+	name     string
+	titleKey *regexp.Regexp
+}
+
+// Replacer computes the replace key of a message. Messages with the same
+// key update the previously sent message instead of being sent again.
+type Replacer struct {
+	extrasKey string
+	rules     []replaceRule
+}
+
+func NewReplacer(replace config.ReplaceType) (*Replacer, error) {
+	replacer := &Replacer{extrasKey: replace.ExtrasKey}
+	for idx, r := range replace.Rules {
+		compiled := replaceRule{name: r.Name}
+		if compiled.name == "" {
+			compiled.name = fmt.Sprintf("#%d", idx+1)
+		}
+		var err error
+		if compiled.matcher, err = newMatcher(r.Match); err != nil {
+			return nil, fmt.Errorf("replace rule %s: %w", compiled.name, err)
+		}
+		if compiled.titleKey, err = regexp.Compile(r.TitleKey); err != nil {
+			return nil, fmt.Errorf("replace rule %s: %w", compiled.name, err)
+		}
+		replacer.rules = append(replacer.rules, compiled)
+	}
+	return replacer, nil
+}
+
+// Enabled returns true if messages can have a replace key at all.
+func (r *Replacer) Enabled() bool {
+	return r.extrasKey != "" || len(r.rules) > 0
+}
+
+// UsesAppName returns true if any rule matches on the application name.
+func (r *Replacer) UsesAppName() bool {
+	for _, rule := range r.rules {
+		if rule.appName != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the replace key of a message, or an empty string if it has
+// none. The extras key takes precedence over the rules. For rules, the key
+// is the first capture group of titleKey, or the whole match if it has no
+// groups. Keys are scoped to the application.
+func (r *Replacer) Key(msg MessageInfo) string {
+	if value := msg.Extras[r.extrasKey]; r.extrasKey != "" && value != "" {
+		return fmt.Sprintf("%d:%s", msg.AppID, value)
+	}
+	for _, rule := range r.rules {
+		if !rule.matches(msg) {
+			continue
+		}
+		match := rule.titleKey.FindStringSubmatch(msg.Title)
+		if match == nil {
+			continue
+		}
+		key := match[0]
+		if len(match) > 1 {
+			key = match[1]
+		}
+		return fmt.Sprintf("%d:%s", msg.AppID, key)
+	}
+	return ""
+}
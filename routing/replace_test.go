@@ -0,0 +1,64 @@
+package routing
+
+import (
+	"gotify_matrix_bot/config"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestReplacerKey(t *testing.T) {
+	replacer, err := NewReplacer(config.ReplaceType{
+		ExtrasKey: "matrix::replaceKey",
+		Rules: []config.ReplaceRuleType{
+			{Name: "deploy", Match: config.RouteMatchType{AppIDs: []int64{3}}, TitleKey: `^(deploy \S+)`},
+			{Name: "backup", TitleKey: `^Backup`},
+		},
+	})
+	assert.NilError(t, err)
+	assert.Assert(t, replacer.Enabled())
+
+	testCases := []struct {
+		name     string
+		msg      MessageInfo
+		expected string
+	}{
+		{
+			name:     "Extras key",
+			msg:      MessageInfo{AppID: 1, Title: "deploy web 30%", Extras: map[string]string{"matrix::replaceKey": "build-7"}},
+			expected: "1:build-7",
+		},
+		{
+			name:     "Capture group of title",
+			msg:      MessageInfo{AppID: 3, Title: "deploy web 60%"},
+			expected: "3:deploy web",
+		},
+		{
+			name:     "Whole match without groups",
+			msg:      MessageInfo{AppID: 5, Title: "Backup running"},
+			expected: "5:Backup",
+		},
+		{
+			name:     "Rule conditions must match",
+			msg:      MessageInfo{AppID: 4, Title: "deploy web 60%"},
+			expected: "",
+		},
+		{
+			name:     "No key",
+			msg:      MessageInfo{AppID: 1, Title: "Hello", Extras: map[string]string{"other": "x"}},
+			expected: "",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, replacer.Key(tc.msg), tc.expected)
+		})
+	}
+}
+
+func TestReplacerDisabled(t *testing.T) {
+	replacer, err := NewReplacer(config.ReplaceType{})
+	assert.NilError(t, err)
+	assert.Assert(t, !replacer.Enabled())
+	assert.Equal(t, replacer.Key(MessageInfo{Title: "Hello"}), "")
+}
@@ -0,0 +1,182 @@
+package routing
+
+import (
+	"fmt"
+	"gotify_matrix_bot/config"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+)
+
+type rule struct {
+	matcher
+	name       string
+	rooms      []string
+	continues  bool
+	quietHours *QuietHours
+	retention  *config.RetentionType
+}
+
+type Router struct {
+	rules             []rule
+	defaultRooms      []string
+	defaultQuietHours *QuietHours
+	defaultRetention  *config.RetentionType
+}
+
+// Destination is a target a message is routed to, with the quiet hours and
+// retention of the route.
+type Destination struct {
+	Target     string
+	QuietHours *QuietHours
+	Retention  *config.RetentionType
+}
+
+// NewRouter compiles the routing configuration. If no default rooms are
+// configured, defaultRoom is used instead.
+func NewRouter(routing config.RoutingType, defaultRoom string) (*Router, error) {
+	router := &Router{
+		defaultRooms:     routing.DefaultRooms,
+		defaultRetention: routing.DefaultRetention,
+	}
+	if len(router.defaultRooms) == 0 && defaultRoom != "" {
+		router.defaultRooms = []string{defaultRoom}
+	}
+
+	var err error
+	if router.defaultQuietHours, err = newQuietHours(routing.DefaultQuietHours); err != nil {
+		return nil, fmt.Errorf("default quiet hours: %w", err)
+	}
+
+	for idx, r := range routing.Rules {
+		compiled := rule{
+			name:      r.Name,
+			rooms:     r.Rooms,
+			continues: r.Continue,
+			retention: r.Retention,
+		}
+		if compiled.name == "" {
+			compiled.name = fmt.Sprintf("#%d", idx+1)
+		}
+		if compiled.matcher, err = newMatcher(r.Match); err != nil {
+			return nil, fmt.Errorf("routing rule %s: %w", compiled.name, err)
+		}
+		if compiled.quietHours, err = newQuietHours(r.QuietHours); err != nil {
+			return nil, fmt.Errorf("routing rule %s: %w", compiled.name, err)
+		}
+		router.rules = append(router.rules, compiled)
+	}
+	return router, nil
+}
+
+// UsesAppName returns true if any rule matches on the application name, so
+// that callers only need to look up names when required.
+func (r *Router) UsesAppName() bool {
+	for _, rule := range r.rules {
+		if rule.appName != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesQuietHours returns true if any route has quiet hours.
+func (r *Router) UsesQuietHours() bool {
+	if r.defaultQuietHours != nil {
+		return true
+	}
+	for _, rule := range r.rules {
+		if rule.quietHours != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesRetention returns true if any route has a retention.
+func (r *Router) UsesRetention() bool {
+	if r.defaultRetention != nil {
+		return true
+	}
+	for _, rule := range r.rules {
+		if rule.retention != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// AllRooms returns every room a message could be routed to.
+func (r *Router) AllRooms() []string {
+	rooms := slices.Clone(r.defaultRooms)
+	for _, rule := range r.rules {
+		for _, room := range rule.rooms {
+			if !slices.Contains(rooms, room) {
+				rooms = append(rooms, room)
+			}
+		}
+	}
+	return rooms
+}
+
+// DefaultQuietHours returns the quiet hours of the default route.
+func (r *Router) DefaultQuietHours() *QuietHours {
+	return r.defaultQuietHours
+}
+
+// QuietHoursFor returns the quiet hours which apply to a target, using the
+// first rule that sends to it. Other targets, such as the default rooms, use
+// the default quiet hours.
+func (r *Router) QuietHoursFor(target string) *QuietHours {
+	for _, rule := range r.rules {
+		if slices.Contains(rule.rooms, target) {
+			return rule.quietHours
+		}
+	}
+	return r.defaultQuietHours
+}
+
+// DefaultRetention returns the retention of the default route.
+func (r *Router) DefaultRetention() *config.RetentionType {
+	return r.defaultRetention
+}
+
+// RetentionFor returns the retention which applies to a target, using the
+// first rule that sends to it, like QuietHoursFor.
+func (r *Router) RetentionFor(target string) *config.RetentionType {
+	for _, rule := range r.rules {
+		if slices.Contains(rule.rooms, target) {
+			return rule.retention
+		}
+	}
+	return r.defaultRetention
+}
+
+// Route returns the destinations a message should be sent to. Rules are
+// evaluated in order. A matching rule adds its rooms and stops evaluation,
+// unless it is marked to continue. If no rule matches, the default rooms are
+// returned and matched is false.
+func (r *Router) Route(msg MessageInfo) (destinations []Destination, matched bool) {
+	for _, rule := range r.rules {
+		if !rule.matches(msg) {
+			continue
+		}
+		log.Debug().Msgf("Message %s matched routing rule %s", msg.Title, rule.name)
+		matched = true
+		for _, room := range rule.rooms {
+			if !slices.ContainsFunc(destinations, func(d Destination) bool { return d.Target == room }) {
+				destinations = append(destinations, Destination{Target: room, QuietHours: rule.quietHours, Retention: rule.retention})
+			}
+		}
+		if !rule.continues {
+			break
+		}
+	}
+	if !matched {
+		for _, room := range r.defaultRooms {
+			destinations = append(destinations, Destination{Target: room, QuietHours: r.defaultQuietHours, Retention: r.defaultRetention})
+		}
+		return destinations, false
+	}
+	return destinations, true
+}
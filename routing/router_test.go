@@ -0,0 +1,182 @@
+package routing
+
+import (
+	"gotify_matrix_bot/config"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func targets(destinations []Destination) []string {
+	var result []string
+	for _, destination := range destinations {
+		result = append(result, destination.Target)
+	}
+	return result
+}
+
+func TestRoute(t *testing.T) {
+	routingConfig := config.RoutingType{
+		Rules: []config.RouteType{
+			{
+				Name:     "oncall",
+				Match:    config.RouteMatchType{MinPriority: intPtr(8)},
+				Rooms:    []string{"!oncall"},
+				Continue: true,
+			},
+			{
+				Name:  "ci",
+				Match: config.RouteMatchType{AppIDs: []int64{3}},
+				Rooms: []string{"!ci"},
+			},
+			{
+				Name:  "backup",
+				Match: config.RouteMatchType{AppName: "(?i)^backup"},
+				Rooms: []string{"!ops"},
+			},
+			{
+				Name:  "failures",
+				Match: config.RouteMatchType{Title: "failed"},
+				Rooms: []string{"!ops", "!oncall"},
+			},
+			{
+				Name:  "never reached",
+				Match: config.RouteMatchType{Message: ".*"},
+				Rooms: []string{"!unused"},
+			},
+		},
+	}
+	router, err := NewRouter(routingConfig, "!default")
+	assert.NilError(t, err)
+
+	testCases := []struct {
+		name     string
+		message  MessageInfo
+		expected []string
+	}{
+		{
+			name:     "Matches by app id",
+			message:  MessageInfo{AppID: 3, Priority: 5},
+			expected: []string{"!ci"},
+		},
+		{
+			name:     "Continue adds rooms of later rules",
+			message:  MessageInfo{AppID: 3, Priority: 8},
+			expected: []string{"!oncall", "!ci"},
+		},
+		{
+			name:     "Matches by app name",
+			message:  MessageInfo{AppID: 4, AppName: "Backups"},
+			expected: []string{"!ops"},
+		},
+		{
+			name:     "Rooms are not duplicated",
+			message:  MessageInfo{AppID: 5, Priority: 9, Title: "job failed"},
+			expected: []string{"!oncall", "!ops"},
+		},
+		{
+			name:     "Catch-all rule matches the rest",
+			message:  MessageInfo{AppID: 5, Title: "job done", Message: "text"},
+			expected: []string{"!unused"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			destinations, matched := router.Route(tc.message)
+			assert.DeepEqual(t, targets(destinations), tc.expected)
+			assert.Assert(t, matched)
+		})
+	}
+}
+
+func TestDefaultRoute(t *testing.T) {
+	t.Run("Room id is used if no default rooms are configured", func(t *testing.T) {
+		router, err := NewRouter(config.RoutingType{}, "!room")
+		assert.NilError(t, err)
+		destinations, matched := router.Route(MessageInfo{})
+		assert.DeepEqual(t, targets(destinations), []string{"!room"})
+		assert.Assert(t, !matched)
+	})
+
+	t.Run("Default rooms are used if no rule matches", func(t *testing.T) {
+		router, err := NewRouter(config.RoutingType{
+			DefaultRooms: []string{"!a", "!b"},
+			Rules: []config.RouteType{
+				{Match: config.RouteMatchType{MaxPriority: intPtr(2)}, Rooms: []string{"!low"}},
+			},
+		}, "!room")
+		assert.NilError(t, err)
+		destinations, matched := router.Route(MessageInfo{Priority: 5})
+		assert.DeepEqual(t, targets(destinations), []string{"!a", "!b"})
+		assert.Assert(t, !matched)
+		destinations, matched = router.Route(MessageInfo{Priority: 1})
+		assert.DeepEqual(t, targets(destinations), []string{"!low"})
+		assert.Assert(t, matched)
+	})
+}
+
+func TestNewRouter(t *testing.T) {
+	t.Run("Invalid regexp returns error", func(t *testing.T) {
+		_, err := NewRouter(config.RoutingType{
+			Rules: []config.RouteType{
+				{Name: "broken", Match: config.RouteMatchType{Title: "$$$^^("}, Rooms: []string{"!a"}},
+			},
+		}, "!room")
+		assert.ErrorContains(t, err, "routing rule broken")
+	})
+
+	t.Run("UsesAppName", func(t *testing.T) {
+		router, err := NewRouter(config.RoutingType{
+			Rules: []config.RouteType{
+				{Match: config.RouteMatchType{AppName: "app"}, Rooms: []string{"!a"}},
+			},
+		}, "!room")
+		assert.NilError(t, err)
+		assert.Assert(t, router.UsesAppName())
+
+		router, err = NewRouter(config.RoutingType{}, "!room")
+		assert.NilError(t, err)
+		assert.Assert(t, !router.UsesAppName())
+	})
+}
+
+func TestAllRooms(t *testing.T) {
+	router, err := NewRouter(config.RoutingType{
+		Rules: []config.RouteType{
+			{Rooms: []string{"!a", "!b"}},
+			{Rooms: []string{"!b", "!c"}},
+		},
+	}, "!default")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, router.AllRooms(), []string{"!default", "!a", "!b", "!c"})
+}
+
+func TestRetention(t *testing.T) {
+	critical := &config.RetentionType{MaxAge: 90 * 24 * time.Hour}
+	normal := &config.RetentionType{MaxAge: 7 * 24 * time.Hour, SetRoomState: true}
+	router, err := NewRouter(config.RoutingType{
+		DefaultRetention: normal,
+		Rules: []config.RouteType{
+			{Match: config.RouteMatchType{MinPriority: intPtr(8)}, Rooms: []string{"!critical"}, Retention: critical},
+			{Match: config.RouteMatchType{AppIDs: []int64{2}}, Rooms: []string{"!keep"}},
+		},
+	}, "!default")
+	assert.NilError(t, err)
+	assert.Assert(t, router.UsesRetention())
+
+	destinations, _ := router.Route(MessageInfo{Priority: 8})
+	assert.Equal(t, destinations[0].Retention, critical)
+	destinations, _ = router.Route(MessageInfo{AppID: 2})
+	assert.Assert(t, destinations[0].Retention == nil)
+	destinations, _ = router.Route(MessageInfo{AppID: 3})
+	assert.Equal(t, destinations[0].Retention, normal)
+
+	assert.Equal(t, router.RetentionFor("!critical"), critical)
+	assert.Assert(t, router.RetentionFor("!keep") == nil)
+	assert.Equal(t, router.RetentionFor("!default"), normal)
+}
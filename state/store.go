@@ -0,0 +1,88 @@
+package state
+
+import (
+	"database/sql"
+	"errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store persists the bot's own state, such as mappings between gotify
+// applications and Matrix rooms, so that it survives restarts.
+// Values are grouped by namespace.
+type Store struct {
+	db *sql.DB
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS kv (
+	namespace TEXT NOT NULL,
+	key       TEXT NOT NULL,
+	value     TEXT NOT NULL,
+	PRIMARY KEY (namespace, key)
+);
+`
+
+// Open opens the store, creating it if needed. With the write-ahead log and a
+// busy timeout, other processes, such as the deadletters command, can use the
+// store while the bot runs.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite does not support concurrent writers.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the value stored for the key, and whether it was found.
+func (s *Store) Get(namespace string, key string) (string, bool, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM kv WHERE namespace = ? AND key = ?`, namespace, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (s *Store) Set(namespace string, key string, value string) error {
+	_, err := s.db.Exec(`INSERT INTO kv (namespace, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (namespace, key) DO UPDATE SET value = excluded.value`, namespace, key, value)
+	return err
+}
+
+func (s *Store) Delete(namespace string, key string) error {
+	_, err := s.db.Exec(`DELETE FROM kv WHERE namespace = ? AND key = ?`, namespace, key)
+	return err
+}
+
+// List returns all key/value pairs of a namespace.
+func (s *Store) List(namespace string) (map[string]string, error) {
+	rows, err := s.db.Query(`SELECT key, value FROM kv WHERE namespace = ?`, namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		result[key] = value
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func openTestStore(t *testing.T) *Store {
+	store, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	assert.NilError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStore(t *testing.T) {
+	t.Run("Store uses the write-ahead log", func(t *testing.T) {
+		store := openTestStore(t)
+
+		var journalMode string
+		var busyTimeout int
+		assert.NilError(t, store.db.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode))
+		assert.NilError(t, store.db.QueryRow(`PRAGMA busy_timeout`).Scan(&busyTimeout))
+
+		assert.Equal(t, journalMode, "wal")
+		assert.Equal(t, busyTimeout, 5000)
+	})
+
+	t.Run("Missing key is not found", func(t *testing.T) {
+		store := openTestStore(t)
+
+		_, found, err := store.Get("ns", "key")
+
+		assert.NilError(t, err)
+		assert.Assert(t, !found)
+	})
+
+	t.Run("Set, overwrite and get", func(t *testing.T) {
+		store := openTestStore(t)
+
+		assert.NilError(t, store.Set("ns", "key", "first"))
+		assert.NilError(t, store.Set("ns", "key", "second"))
+		value, found, err := store.Get("ns", "key")
+
+		assert.NilError(t, err)
+		assert.Assert(t, found)
+		assert.Equal(t, value, "second")
+	})
+
+	t.Run("Namespaces are separate", func(t *testing.T) {
+		store := openTestStore(t)
+
+		assert.NilError(t, store.Set("a", "key", "1"))
+		assert.NilError(t, store.Set("b", "key", "2"))
+		assert.NilError(t, store.Set("b", "other", "3"))
+
+		list, err := store.List("b")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, list, map[string]string{"key": "2", "other": "3"})
+	})
+
+	t.Run("Delete removes key", func(t *testing.T) {
+		store := openTestStore(t)
+
+		assert.NilError(t, store.Set("ns", "key", "value"))
+		assert.NilError(t, store.Delete("ns", "key"))
+		_, found, err := store.Get("ns", "key")
+
+		assert.NilError(t, err)
+		assert.Assert(t, !found)
+	})
+
+	t.Run("Values survive reopening", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.db")
+		store, err := Open(path)
+		assert.NilError(t, err)
+		assert.NilError(t, store.Set("ns", "key", "value"))
+		assert.NilError(t, store.Close())
+
+		store, err = Open(path)
+		assert.NilError(t, err)
+		defer store.Close()
+		value, found, err := store.Get("ns", "key")
+		assert.NilError(t, err)
+		assert.Assert(t, found)
+		assert.Equal(t, value, "value")
+	})
+}
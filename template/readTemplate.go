@@ -8,26 +8,56 @@ import (
 )
 
 type Message struct {
-	Id      int64  `json:"id"`
-	AppId   int64  `json:"appid"`
-	Title   string `json:"title"`
-	Message string `json:"message"`
-	Extras  struct {
+	Id       int64  `json:"id"`
+	AppId    int64  `json:"appid"`
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+	Extras   struct {
 		ClientDisplay struct {
 			ContentType string `json:"contentType"`
 		} `json:"client::display"`
 	} `json:"extras"`
+	// All extras with a string value, by key.
+	StringExtras map[string]string `json:"-"`
 }
 
-func GetFormattedMessageString(message []byte) string {
-
+func ParseMessage(message []byte) (*Message, error) {
 	var m Message
-
 	err := json.Unmarshal(message, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		Extras map[string]json.RawMessage `json:"extras"`
+	}
+	if err := json.Unmarshal(message, &raw); err != nil {
+		return nil, err
+	}
+	for key, value := range raw.Extras {
+		var str string
+		if json.Unmarshal(value, &str) == nil {
+			if m.StringExtras == nil {
+				m.StringExtras = make(map[string]string)
+			}
+			m.StringExtras[key] = str
+		}
+	}
+	return &m, nil
+}
+
+func GetFormattedMessageString(message []byte) string {
+
+	m, err := ParseMessage(message)
 	if err != nil {
 		log.Error().Err(err).Msgf("Could not parse message from: %s", string(message))
 		return "Could not parse message from: " + string(message)
 	}
+	return FormatMessage(m)
+}
+
+func FormatMessage(m *Message) string {
 	log.Info().Msgf("Forwarding message %d/%d with Title %s", m.AppId, m.Id, m.Title)
 
 	contentType := strings.ToLower(strings.TrimSpace(m.Extras.ClientDisplay.ContentType))
@@ -60,3 +60,26 @@ func TestGetFormattedMessageString(t *testing.T) {
 		})
 	}
 }
+
+func TestParseMessage(t *testing.T) {
+	m, err := ParseMessage([]byte(`{"id": 1, "appid": 4, "title": "Title", "message": "Text", "priority": 8}`))
+	if err != nil {
+		t.Fatalf("ParseMessage() returned error %v", err)
+	}
+	if m.Id != 1 || m.AppId != 4 || m.Title != "Title" || m.Message != "Text" || m.Priority != 8 {
+		t.Errorf("ParseMessage() = %+v", m)
+	}
+
+	m, err = ParseMessage([]byte(`{"id": 2, "extras": {"matrix::replaceKey": "deploy-42", "client::display": {"contentType": "text/markdown"}}}`))
+	if err != nil {
+		t.Fatalf("ParseMessage() returned error %v", err)
+	}
+	if m.Extras.ClientDisplay.ContentType != "text/markdown" || len(m.StringExtras) != 1 || m.StringExtras["matrix::replaceKey"] != "deploy-42" {
+		t.Errorf("ParseMessage() extras = %+v", m)
+	}
+
+	_, err = ParseMessage([]byte(`{"id": 1`))
+	if err == nil {
+		t.Errorf("ParseMessage() expected error for invalid json")
+	}
+}